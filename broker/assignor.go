@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"cmp"
+	"errors"
+	"godel/internal/protocol"
+	"godel/options"
+	"slices"
+)
+
+// Assignor assigns the partitions of a topic to the consumers of a group.
+type Assignor interface {
+	// Assign returns the partitions of every consumer. Consumers are sorted
+	// by member key (see consumer.memberKey) and partitions by number, current
+	// holds the partitions owned by the consumers before the rebalance.
+	// Assignments must be deterministic.
+	Assign(consumers []string, partitions []uint32, current map[string][]uint32) map[string][]uint32
+}
+
+var assignors = map[options.AssignmentStrategy]Assignor{
+	options.AssignmentStrategyRange:      rangeAssignor{},
+	options.AssignmentStrategyRoundRobin: roundRobinAssignor{},
+	options.AssignmentStrategySticky:     stickyAssignor{},
+}
+
+func getAssignor(strategy options.AssignmentStrategy) (Assignor, error) {
+	assignor, ok := assignors[strategy]
+	if !ok {
+		return nil, errors.New(protocol.ErrInconsistentGroupProtocol)
+	}
+
+	return assignor, nil
+}
+
+// rangeAssignor assigns consecutive ranges of partitions,
+// the first consumers get one more when they can't be divided evenly.
+type rangeAssignor struct{}
+
+func (rangeAssignor) Assign(consumers []string, partitions []uint32, _ map[string][]uint32) map[string][]uint32 {
+	assignment := make(map[string][]uint32, len(consumers))
+	if len(consumers) == 0 {
+		return assignment
+	}
+
+	quota, extra := len(partitions)/len(consumers), len(partitions)%len(consumers)
+
+	start := 0
+	for i, id := range consumers {
+		n := quota
+		if i < extra {
+			n++
+		}
+
+		assignment[id] = slices.Clone(partitions[start : start+n])
+		start += n
+	}
+
+	return assignment
+}
+
+// roundRobinAssignor deals the partitions to the consumers one at a time.
+type roundRobinAssignor struct{}
+
+func (roundRobinAssignor) Assign(consumers []string, partitions []uint32, _ map[string][]uint32) map[string][]uint32 {
+	assignment := make(map[string][]uint32, len(consumers))
+	if len(consumers) == 0 {
+		return assignment
+	}
+
+	for i, partition := range partitions {
+		id := consumers[i%len(consumers)]
+		assignment[id] = append(assignment[id], partition)
+	}
+
+	return assignment
+}
+
+// stickyAssignor balances the partitions like roundRobinAssignor, but the
+// consumers keep as many of their current partitions as possible, so that
+// rebalances move the fewest partitions.
+type stickyAssignor struct{}
+
+func (stickyAssignor) Assign(consumers []string, partitions []uint32, current map[string][]uint32) map[string][]uint32 {
+	assignment := make(map[string][]uint32, len(consumers))
+	if len(consumers) == 0 {
+		return assignment
+	}
+
+	// the consumers owning more partitions get the extra ones,
+	// so that they have less partitions to give up
+	byOwned := slices.Clone(consumers)
+	slices.SortStableFunc(byOwned, func(a, b string) int {
+		return cmp.Compare(len(current[b]), len(current[a]))
+	})
+
+	quota, extra := len(partitions)/len(consumers), len(partitions)%len(consumers)
+
+	targets := make(map[string]int, len(consumers))
+	for i, id := range byOwned {
+		targets[id] = quota
+		if i < extra {
+			targets[id]++
+		}
+	}
+
+	// partitions keep their owner, up to its target
+	assigned := make(map[uint32]bool, len(partitions))
+	for _, id := range byOwned {
+		owned := slices.Clone(current[id])
+		slices.Sort(owned)
+
+		for _, partition := range owned {
+			if len(assignment[id]) == targets[id] {
+				break
+			}
+			if assigned[partition] || !slices.Contains(partitions, partition) {
+				continue
+			}
+
+			assignment[id] = append(assignment[id], partition)
+			assigned[partition] = true
+		}
+	}
+
+	// the others fill the consumers up to their target
+	i := 0
+	for _, partition := range partitions {
+		if assigned[partition] {
+			continue
+		}
+
+		for len(assignment[consumers[i]]) == targets[consumers[i]] {
+			i++
+		}
+
+		assignment[consumers[i]] = append(assignment[consumers[i]], partition)
+	}
+
+	for id := range assignment {
+		slices.Sort(assignment[id])
+	}
+
+	return assignment
+}
@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"godel/options"
+	"reflect"
+	"testing"
+)
+
+func TestRangeAssignor(t *testing.T) {
+	tests := []struct {
+		name       string
+		consumers  []string
+		partitions []uint32
+		want       map[string][]uint32
+	}{
+		{
+			name:       "no consumers",
+			consumers:  nil,
+			partitions: []uint32{0, 1, 2},
+			want:       map[string][]uint32{},
+		},
+		{
+			name:       "evenly divided",
+			consumers:  []string{"a", "b"},
+			partitions: []uint32{0, 1, 2, 3},
+			want:       map[string][]uint32{"a": {0, 1}, "b": {2, 3}},
+		},
+		{
+			name:       "first consumers get the extra partitions",
+			consumers:  []string{"a", "b", "c"},
+			partitions: []uint32{0, 1, 2, 3, 4, 5, 6, 7},
+			want:       map[string][]uint32{"a": {0, 1, 2}, "b": {3, 4, 5}, "c": {6, 7}},
+		},
+		{
+			name:       "more consumers than partitions",
+			consumers:  []string{"a", "b", "c"},
+			partitions: []uint32{0, 1},
+			want:       map[string][]uint32{"a": {0}, "b": {1}, "c": {}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rangeAssignor{}.Assign(tt.consumers, tt.partitions, nil)
+			assertAssignment(t, got, tt.want)
+		})
+	}
+}
+
+func TestRoundRobinAssignor(t *testing.T) {
+	tests := []struct {
+		name       string
+		consumers  []string
+		partitions []uint32
+		want       map[string][]uint32
+	}{
+		{
+			name:       "no consumers",
+			consumers:  nil,
+			partitions: []uint32{0, 1, 2},
+			want:       map[string][]uint32{},
+		},
+		{
+			name:       "single consumer",
+			consumers:  []string{"a"},
+			partitions: []uint32{0, 1, 2},
+			want:       map[string][]uint32{"a": {0, 1, 2}},
+		},
+		{
+			name:       "partitions dealt one at a time",
+			consumers:  []string{"a", "b", "c"},
+			partitions: []uint32{0, 1, 2, 3, 4, 5, 6, 7},
+			want:       map[string][]uint32{"a": {0, 3, 6}, "b": {1, 4, 7}, "c": {2, 5}},
+		},
+		{
+			name:       "more consumers than partitions",
+			consumers:  []string{"a", "b", "c"},
+			partitions: []uint32{0, 1},
+			want:       map[string][]uint32{"a": {0}, "b": {1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := roundRobinAssignor{}.Assign(tt.consumers, tt.partitions, nil)
+			assertAssignment(t, got, tt.want)
+		})
+	}
+}
+
+func TestStickyAssignor(t *testing.T) {
+	tests := []struct {
+		name       string
+		consumers  []string
+		partitions []uint32
+		current    map[string][]uint32
+		want       map[string][]uint32
+	}{
+		{
+			name:       "no consumers",
+			consumers:  nil,
+			partitions: []uint32{0, 1, 2},
+			want:       map[string][]uint32{},
+		},
+		{
+			name:       "first assignment",
+			consumers:  []string{"a", "b"},
+			partitions: []uint32{0, 1, 2},
+			current:    map[string][]uint32{},
+			want:       map[string][]uint32{"a": {0, 1}, "b": {2}},
+		},
+		{
+			name:       "joining consumer takes only the exceeding partitions",
+			consumers:  []string{"a", "b", "c"},
+			partitions: []uint32{0, 1, 2, 3, 4, 5},
+			current:    map[string][]uint32{"a": {0, 1, 2}, "b": {3, 4, 5}},
+			want:       map[string][]uint32{"a": {0, 1}, "b": {3, 4}, "c": {2, 5}},
+		},
+		{
+			name:       "leaving consumer partitions are spread to the others",
+			consumers:  []string{"a", "c"},
+			partitions: []uint32{0, 1, 2, 3, 4, 5},
+			current:    map[string][]uint32{"a": {0, 1}, "b": {3, 4}, "c": {2, 5}},
+			want:       map[string][]uint32{"a": {0, 1, 3}, "c": {2, 4, 5}},
+		},
+		{
+			name:       "consumers owning more partitions keep the extra ones",
+			consumers:  []string{"a", "b"},
+			partitions: []uint32{0, 1, 2, 3, 4},
+			current:    map[string][]uint32{"a": {0}, "b": {1, 2, 3, 4}},
+			want:       map[string][]uint32{"a": {0, 4}, "b": {1, 2, 3}},
+		},
+		{
+			name:       "deleted partitions are dropped",
+			consumers:  []string{"a", "b"},
+			partitions: []uint32{0, 1},
+			current:    map[string][]uint32{"a": {0, 7}, "b": {1, 8}},
+			want:       map[string][]uint32{"a": {0}, "b": {1}},
+		},
+		{
+			name:       "partitions owned twice are kept once",
+			consumers:  []string{"a", "b"},
+			partitions: []uint32{0, 1, 2, 3},
+			current:    map[string][]uint32{"a": {0, 1}, "b": {1, 2}},
+			want:       map[string][]uint32{"a": {0, 1}, "b": {2, 3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stickyAssignor{}.Assign(tt.consumers, tt.partitions, tt.current)
+			assertAssignment(t, got, tt.want)
+		})
+	}
+}
+
+func TestGetAssignor(t *testing.T) {
+	tests := []struct {
+		strategy options.AssignmentStrategy
+		want     Assignor
+		wantErr  bool
+	}{
+		{strategy: options.AssignmentStrategyRange, want: rangeAssignor{}},
+		{strategy: options.AssignmentStrategyRoundRobin, want: roundRobinAssignor{}},
+		{strategy: options.AssignmentStrategySticky, want: stickyAssignor{}},
+		{strategy: "unknown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			got, err := getAssignor(tt.strategy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAssignor(%q) error = %v, wantErr %v", tt.strategy, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getAssignor(%q) = %T, want %T", tt.strategy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssignmentStaticMemberRejoin(t *testing.T) {
+	for _, strategy := range []options.AssignmentStrategy{options.AssignmentStrategyRange, options.AssignmentStrategyRoundRobin} {
+		t.Run(string(strategy), func(t *testing.T) {
+			topic := &Topic{}
+			for i := range 5 {
+				topic.partitions = append(topic.partitions, &Partition{num: uint32(i)})
+			}
+
+			group := &consumerGroup{name: "group", topic: topic}
+
+			static := &options.ConsumerOptions{PartitionAssignmentStrategy: strategy, GroupInstanceID: "worker-1"}
+			dynamic := &options.ConsumerOptions{PartitionAssignmentStrategy: strategy}
+
+			group.newConsumer("a", nil, static)
+			group.newConsumer("b", nil, dynamic)
+			group.newConsumer("c", nil, dynamic)
+
+			before := group.assignment()
+
+			// the static consumer restarts with a consumer id sorting after the others
+			group.consumers = group.consumers[1:]
+			group.newConsumer("z", before["a"], static)
+
+			after := group.assignment()
+
+			want := map[string][]uint32{"z": partitionNums(before["a"]), "b": partitionNums(before["b"]), "c": partitionNums(before["c"])}
+			got := map[string][]uint32{}
+			for id := range after {
+				got[id] = partitionNums(after[id])
+			}
+
+			assertAssignment(t, got, want)
+		})
+	}
+}
+
+// assertAssignment compares the assignments ignoring consumers without partitions.
+func assertAssignment(t *testing.T, got, want map[string][]uint32) {
+	t.Helper()
+
+	for id := range want {
+		if len(want[id]) == 0 {
+			delete(want, id)
+		}
+	}
+	for id := range got {
+		if len(got[id]) == 0 {
+			delete(got, id)
+		}
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("assignment = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,464 @@
+package broker
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+// Record batch format (v4):
+//
+//	size (4) | base offset (8) | magic (1) | crc (4) | attributes (2) |
+//	last offset delta (4) | base timestamp (8) | max timestamp (8) |
+//	producer id (8) | producer epoch (2) | base sequence (4) |
+//	records count (4) | records
+//
+// v3 batches (still readable) have no base sequence field, while v2
+// batches have no attributes and producer fields either:
+//
+//	size (4) | base offset (8) | magic (1) | crc (4) | last offset delta (4) |
+//	base timestamp (8) | max timestamp (8) | records count (4) | records
+//
+// Each record is encoded as:
+//
+//	length (varint) | offset delta (uvarint) | timestamp delta (varint) |
+//	key length (uvarint) | key | payload length (uvarint) | payload |
+//	headers count (uvarint) | headers
+//
+// Each header is encoded as:
+//
+//	key length (uvarint) | key | value length (uvarint) | value
+//
+// Records written before headers were introduced end right after the
+// payload, so the headers count is read only if the record has more bytes.
+//
+// The crc is a CRC32C (Castagnoli) of everything following it. The base offset
+// is excluded on purpose because it's set by the segment when the batch is appended.
+//
+// The last offset delta is stored in the header because compaction may remove
+// records from a batch, so it can't be derived from the records count.
+//
+// Batches of idempotent producers carry the producer id, epoch and the sequence
+// of the first record: the sequence of every record is the base sequence plus
+// its offset delta, so that the producers state can be rebuilt from the log.
+//
+// Transactional batches have the transactional attribute set and carry the
+// transaction producer id and epoch. Control batches hold a single transaction
+// marker (see controlMarker), written when the transaction ends.
+const (
+	recordMagicV2 byte = 2
+	recordMagicV3 byte = 3
+	recordMagicV4 byte = 4
+
+	batchHeaderSizeV2 = 4 + 8 + 1 + 4 + 4 + 8 + 8 + 4
+	batchHeaderSizeV3 = 4 + 8 + 1 + 4 + 2 + 4 + 8 + 8 + 8 + 2 + 4
+	batchHeaderSizeV4 = 4 + 8 + 1 + 4 + 2 + 4 + 8 + 8 + 8 + 2 + 4 + 4
+)
+
+// batch attributes (v3)
+const (
+	batchAttrTransactional uint16 = 1 << 0
+	batchAttrControl       uint16 = 1 << 1
+)
+
+// batchHeader holds the fixed size fields that precede the records
+// of a batch. Legacy records are handled as batches of a single message.
+type batchHeader struct {
+	size            uint32
+	baseOffset      uint64
+	magic           byte
+	crc             uint32
+	attributes      uint16
+	lastOffsetDelta uint32
+	baseTimestamp   uint64
+	maxTimestamp    uint64
+	producerID      uint64
+	producerEpoch   uint16
+	baseSequence    uint32
+	count           uint32
+}
+
+func (h *batchHeader) headerSize() int {
+	switch h.magic {
+	case recordMagicV0:
+		return recordHeaderSizeV0
+	case recordMagicV1:
+		return recordHeaderSizeV1
+	case recordMagicV2:
+		return batchHeaderSizeV2
+	case recordMagicV3:
+		return batchHeaderSizeV3
+	default:
+		return batchHeaderSizeV4
+	}
+}
+
+func (h *batchHeader) isTransactional() bool {
+	return h.attributes&batchAttrTransactional != 0
+}
+
+func (h *batchHeader) isControl() bool {
+	return h.attributes&batchAttrControl != 0
+}
+
+func (h *batchHeader) lastOffset() uint64 {
+	return h.baseOffset + uint64(h.lastOffsetDelta)
+}
+
+// lastSequence returns the sequence of the last record written in the batch
+// by an idempotent producer, even if compaction removed it.
+func (h *batchHeader) lastSequence() uint32 {
+	return h.baseSequence + h.lastOffsetDelta
+}
+
+// parseBatchHeader parses the header at the beginning of b.
+//
+// Returns io.ErrUnexpectedEOF if b is too short to contain the whole header.
+func parseBatchHeader(b []byte) (*batchHeader, error) {
+	if len(b) < 4+8+1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	h := &batchHeader{
+		size:       binary.BigEndian.Uint32(b),
+		baseOffset: binary.BigEndian.Uint64(b[4:12]),
+		magic:      b[12],
+		count:      1,
+	}
+
+	switch h.magic {
+	case recordMagicV0:
+		if len(b) < recordHeaderSizeV0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		h.baseTimestamp = binary.BigEndian.Uint64(b[12:20])
+		h.maxTimestamp = h.baseTimestamp
+	case recordMagicV1:
+		if len(b) < recordHeaderSizeV1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		h.crc = binary.BigEndian.Uint32(b[13:17])
+		h.baseTimestamp = binary.BigEndian.Uint64(b[17:25])
+		h.maxTimestamp = h.baseTimestamp
+	case recordMagicV2:
+		if len(b) < batchHeaderSizeV2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		h.crc = binary.BigEndian.Uint32(b[13:17])
+		h.lastOffsetDelta = binary.BigEndian.Uint32(b[17:21])
+		h.baseTimestamp = binary.BigEndian.Uint64(b[21:29])
+		h.maxTimestamp = binary.BigEndian.Uint64(b[29:37])
+		h.count = binary.BigEndian.Uint32(b[37:41])
+	case recordMagicV3:
+		if len(b) < batchHeaderSizeV3 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		h.crc = binary.BigEndian.Uint32(b[13:17])
+		h.attributes = binary.BigEndian.Uint16(b[17:19])
+		h.lastOffsetDelta = binary.BigEndian.Uint32(b[19:23])
+		h.baseTimestamp = binary.BigEndian.Uint64(b[23:31])
+		h.maxTimestamp = binary.BigEndian.Uint64(b[31:39])
+		h.producerID = binary.BigEndian.Uint64(b[39:47])
+		h.producerEpoch = binary.BigEndian.Uint16(b[47:49])
+		h.count = binary.BigEndian.Uint32(b[49:53])
+	case recordMagicV4:
+		if len(b) < batchHeaderSizeV4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		h.crc = binary.BigEndian.Uint32(b[13:17])
+		h.attributes = binary.BigEndian.Uint16(b[17:19])
+		h.lastOffsetDelta = binary.BigEndian.Uint32(b[19:23])
+		h.baseTimestamp = binary.BigEndian.Uint64(b[23:31])
+		h.maxTimestamp = binary.BigEndian.Uint64(b[31:39])
+		h.producerID = binary.BigEndian.Uint64(b[39:47])
+		h.producerEpoch = binary.BigEndian.Uint16(b[47:49])
+		h.baseSequence = binary.BigEndian.Uint32(b[49:53])
+		h.count = binary.BigEndian.Uint32(b[53:57])
+	default:
+		return nil, errors.New(errUnknownRecordVersion)
+	}
+
+	if int(h.size) < h.headerSize() {
+		return nil, errors.New(errRecordTooShort)
+	}
+
+	return h, nil
+}
+
+// readBatchHeader reads and parses the batch header found at the given position.
+//
+// Returns io.EOF if pos is the end of the file and io.ErrUnexpectedEOF
+// if the file ends in the middle of the header.
+func readBatchHeader(r io.ReaderAt, pos int64) (*batchHeader, error) {
+	buf := make([]byte, batchHeaderSizeV4)
+	n, err := r.ReadAt(buf, pos)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	return parseBatchHeader(buf[:n])
+}
+
+// serializeBatch encodes the messages in a single record batch. Offset deltas are
+// computed from the messages offsets, so they must be set before calling it.
+//
+// The batch attributes and producer are taken from the first message, so messages of
+// different producers, transactional and control messages must not be mixed in the same
+// batch. Sequences of the messages of idempotent producers must follow their offsets.
+func serializeBatch(baseOffset uint64, messages []*Message) []byte {
+	first, last := messages[0], messages[len(messages)-1]
+
+	header := &batchHeader{
+		baseOffset:      baseOffset,
+		lastOffsetDelta: uint32(last.offset - baseOffset),
+		producerID:      first.producerID,
+		producerEpoch:   first.producerEpoch,
+		baseSequence:    first.sequence - uint32(first.offset-baseOffset),
+	}
+
+	if first.transactional {
+		header.attributes |= batchAttrTransactional
+	}
+
+	if first.control {
+		header.attributes |= batchAttrControl
+	}
+
+	return encodeBatch(header, messages)
+}
+
+// encodeBatch encodes the messages in a v4 record batch, taking the base offset,
+// attributes, last offset delta and producer fields from the header, whatever its
+// version. Timestamps, records count, size and crc are computed from the messages.
+//
+// Compaction uses it to rewrite a batch with the header it was read with, so that the
+// segment next offset and the producer last sequence rebuilt from the log are the
+// ones of the original batch even if its last records are removed.
+func encodeBatch(header *batchHeader, messages []*Message) []byte {
+	baseTimestamp := messages[0].timestamp
+	maxTimestamp := baseTimestamp
+
+	records := []byte{}
+	for _, m := range messages {
+		record := []byte{}
+		record = binary.AppendUvarint(record, m.offset-header.baseOffset)
+		record = binary.AppendVarint(record, int64(m.timestamp-baseTimestamp))
+		record = binary.AppendUvarint(record, uint64(len(m.key)))
+		record = append(record, m.key...)
+		record = binary.AppendUvarint(record, uint64(len(m.payload)))
+		record = append(record, m.payload...)
+		record = appendHeaders(record, m.headers)
+
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+
+		maxTimestamp = max(maxTimestamp, m.timestamp)
+	}
+
+	totalSize := uint32(batchHeaderSizeV4 + len(records))
+
+	blob := make([]byte, 0, totalSize)
+	blob = binary.BigEndian.AppendUint32(blob, totalSize)
+	blob = binary.BigEndian.AppendUint64(blob, header.baseOffset)
+	blob = append(blob, recordMagicV4)
+	blob = binary.BigEndian.AppendUint32(blob, 0) // crc placeholder
+	blob = binary.BigEndian.AppendUint16(blob, header.attributes)
+	blob = binary.BigEndian.AppendUint32(blob, header.lastOffsetDelta)
+	blob = binary.BigEndian.AppendUint64(blob, baseTimestamp)
+	blob = binary.BigEndian.AppendUint64(blob, maxTimestamp)
+	blob = binary.BigEndian.AppendUint64(blob, header.producerID)
+	blob = binary.BigEndian.AppendUint16(blob, header.producerEpoch)
+	blob = binary.BigEndian.AppendUint32(blob, header.baseSequence)
+	blob = binary.BigEndian.AppendUint32(blob, uint32(len(messages)))
+	blob = append(blob, records...)
+
+	binary.BigEndian.PutUint32(blob[13:17], crc32.Checksum(blob[17:], crc32c))
+
+	return blob
+}
+
+// deserializeBatch verifies and decodes all the messages of a batch.
+func deserializeBatch(b []byte) (*batchHeader, []*Message, error) {
+	h, err := parseBatchHeader(b)
+	if err == io.ErrUnexpectedEOF {
+		return nil, nil, errors.New(errRecordTooShort)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if h.size != uint32(len(b)) {
+		return nil, nil, errors.New(errMessageSizeMismatch)
+	}
+
+	if h.magic < recordMagicV2 {
+		message, err := deserializeLegacyRecord(h, b)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return h, []*Message{message}, nil
+	}
+
+	if crc32.Checksum(b[17:], crc32c) != h.crc {
+		return nil, nil, errors.New(errRecordChecksumInvalid)
+	}
+
+	messages := make([]*Message, 0, h.count)
+	r := &recordReader{buf: b[h.headerSize():]}
+
+	for range h.count {
+		length := r.varint()
+		if r.err != nil || length < 0 || length > int64(len(r.buf)) {
+			return nil, nil, errors.New(errRecordMalformed)
+		}
+
+		record := &recordReader{buf: r.bytes(int(length))}
+		offsetDelta := record.uvarint()
+		timestampDelta := record.varint()
+		key := record.bytes(int(record.uvarint()))
+		payload := record.bytes(int(record.uvarint()))
+
+		var headers map[string][]byte
+		if len(record.buf) > 0 {
+			headers = record.headers()
+		}
+
+		if record.err != nil {
+			return nil, nil, record.err
+		}
+
+		message := &Message{
+			offset:    h.baseOffset + offsetDelta,
+			timestamp: h.baseTimestamp + uint64(timestampDelta),
+			key:       key,
+			payload:   payload,
+			headers:   headers,
+		}
+
+		if h.producerID != 0 {
+			message.producerID = h.producerID
+			message.producerEpoch = h.producerEpoch
+			message.sequence = h.baseSequence + uint32(offsetDelta)
+		}
+
+		if h.isTransactional() {
+			message.transactional = true
+			message.control = h.isControl()
+		}
+
+		messages = append(messages, message)
+	}
+
+	return h, messages, nil
+}
+
+// appendHeaders encodes the headers sorted by key,
+// so that the same headers always get the same bytes.
+func appendHeaders(b []byte, headers map[string][]byte) []byte {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = binary.AppendUvarint(b, uint64(len(headers[k])))
+		b = append(b, headers[k]...)
+	}
+
+	return b
+}
+
+// recordReader decodes the fields of a record keeping track
+// of the first error, so that it can be checked only once.
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errors.New(errRecordMalformed)
+		return 0
+	}
+
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *recordReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errors.New(errRecordMalformed)
+		return 0
+	}
+
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *recordReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.buf) {
+		r.err = errors.New(errRecordMalformed)
+		return nil
+	}
+
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *recordReader) headers() map[string][]byte {
+	count := r.uvarint()
+	if r.err != nil || count == 0 {
+		return nil
+	}
+
+	// every header takes at least 2 bytes
+	if count > uint64(len(r.buf)/2) {
+		r.err = errors.New(errRecordMalformed)
+		return nil
+	}
+
+	headers := make(map[string][]byte, count)
+	for range count {
+		key := r.bytes(int(r.uvarint()))
+		value := r.bytes(int(r.uvarint()))
+		if r.err != nil {
+			return nil
+		}
+
+		headers[string(key)] = value
+	}
+
+	return headers
+}
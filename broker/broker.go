@@ -14,6 +14,12 @@ type Broker struct {
 	topics  []*Topic
 
 	mu sync.RWMutex
+
+	// next idempotent producer id
+	nextProducerID uint64
+	producersMu    sync.Mutex
+
+	transactions *transactionCoordinator
 }
 
 func NewBroker(opts ...*options.BrokerOptions) (*Broker, error) {
@@ -48,6 +54,22 @@ func NewBroker(opts ...*options.BrokerOptions) (*Broker, error) {
 			errorCh <- err
 		}
 
+		err = broker.loadProducers()
+		if err != nil {
+			errorCh <- err
+			return
+		}
+
+		// complete the transactions interrupted by a shutdown
+		broker.transactions, err = loadTransactionCoordinator(&broker)
+		if err == nil {
+			err = broker.transactions.recover()
+		}
+		if err != nil {
+			errorCh <- err
+			return
+		}
+
 		readyCh <- struct{}{}
 	}()
 
@@ -56,6 +78,7 @@ func NewBroker(opts ...*options.BrokerOptions) (*Broker, error) {
 		return nil, err
 	case <-readyCh:
 		broker.scheduleRetentionCheck()
+		broker.scheduleFlushCheck()
 		return &broker, nil
 	}
 }
@@ -140,15 +163,22 @@ func (b *Broker) GetOrCreateTopic(name string, opts ...*options.TopicOptions) (*
 	return topic, nil
 }
 
-func (b *Broker) Produce(topic string, message *Message) (uint64, uint32, error) {
+// Produce appends the messages to the topic. If durable is true it returns only
+// after the messages are synced to disk, regardless of the flush options.
+//
+// The returned errors are aligned with the messages, while the last returned
+// error is set if the whole request failed.
+func (b *Broker) Produce(topic string, durable bool, messages ...*Message) ([]error, error) {
 	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	for i := range b.topics {
 		if b.topics[i].name == topic {
-			return b.topics[i].produce(message)
+			return b.topics[i].produce(messages, durable), nil
 		}
 	}
 
-	return 0, 0, errors.New(protocol.ErrTopicNotFound)
+	return nil, errors.New(protocol.ErrTopicNotFound)
 }
 
 func (b *Broker) Run(port int) error {
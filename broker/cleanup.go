@@ -1,7 +1,6 @@
 package broker
 
 import (
-	"godel/options"
 	"log/slog"
 	"time"
 )
@@ -22,89 +21,142 @@ func (b *Broker) scheduleRetentionCheck() {
 }
 
 func (b *Broker) runRetentionCheck() {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	slog.Info("started retention check")
 	now := uint64(time.Now().Unix())
 
 	for i := range b.topics {
-		retentionMilli := b.topics[i].options.RetentionMilli
-		retentionBytes := b.topics[i].options.RetentionBytes
-		cleanupPolicy := b.topics[i].options.CleanupPolicy
-
 		for j := range b.topics[i].partitions {
-			if retentionMilli > -1 {
-				slog.Info("running retention.ms check", "segments", len(b.topics[i].partitions[j].segments))
-
-				for k := range b.topics[i].partitions[j].segments {
-					expired, err := b.topics[i].partitions[j].segments[k].runMaxRetentionMilliCheck(now, retentionMilli)
-					if err != nil {
-						slog.Error("failed retention.ms check",
-							"topic", b.topics[i].name,
-							"partition", b.topics[i].partitions[j].num,
-							"segment", b.topics[i].partitions[j].segments[k].baseOffset,
-							"error", err,
-						)
-					}
-
-					slog.Info("retention.bytes check result",
-						"topic", b.topics[i].name,
-						"partition", b.topics[i].partitions[j].num,
-						"segment", b.topics[i].partitions[j].segments[k].baseOffset,
-						"expired", expired,
-					)
-
-					if expired && cleanupPolicy == options.CleanupPolicyDelete {
-						err = b.topics[i].partitions[j].deleteSegment(k)
-						if err != nil {
-							slog.Error("failed retention.ms check segment deletion",
-								"topic", b.topics[i].name,
-								"partition", b.topics[i].partitions[j].num,
-								"segment", b.topics[i].partitions[j].segments[k].baseOffset,
-								"error", err,
-							)
-						}
-
-						slog.Info("retention.ms check segment deletion done",
-							"topic", b.topics[i].name,
-							"partition", b.topics[i].partitions[j].num,
-							"segment", b.topics[i].partitions[j].segments[k].baseOffset,
-						)
-					}
-
-					// if expired && cleanupPolicy == CleanupPolicyCompact {
-					// }
-				}
+			b.topics[i].partitions[j].runRetentionCheck(now)
+		}
+	}
+
+	slog.Info("retention check done for all topics")
+}
+
+// runRetentionCheck deletes the segments past retention.ms and retention.bytes,
+// and compacts the partition, according to its cleanup.policy. Errors are logged.
+//
+// The partition lock is held for the whole check, so that segments can't be
+// appended or rolled meanwhile. The active segment is never deleted nor compacted:
+// once expired it gets rolled first, so that the partition keeps its next offset
+// even when all of its messages are deleted.
+func (p *Partition) runRetentionCheck(now uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	retentionMilli := p.topicOptions.RetentionMilli
+	retentionBytes := p.topicOptions.RetentionBytes
+	cleanupPolicy := p.topicOptions.CleanupPolicy
+
+	if retentionMilli > -1 && cleanupPolicy.Deletes() && len(p.segments) > 0 {
+		slog.Info("running retention.ms check", "segments", len(p.segments))
+
+		active := p.segments[len(p.segments)-1]
+
+		expired, err := active.runMaxRetentionMilliCheck(now, retentionMilli)
+		if err != nil {
+			slog.Error("failed retention.ms check",
+				"topic", p.topicName,
+				"partition", p.num,
+				"segment", active.baseOffset,
+				"error", err,
+			)
+		}
+
+		if expired {
+			_, err = p.rollSegment()
+			if err != nil {
+				slog.Error("failed retention.ms check segment roll",
+					"topic", p.topicName,
+					"partition", p.num,
+					"segment", active.baseOffset,
+					"error", err,
+				)
 			}
+		}
 
-			if retentionBytes > -1 {
-				for k := range b.topics[i].partitions[j].segments {
-					if b.topics[i].partitions[j].getSize() < retentionBytes {
-						break
-					}
-
-					if cleanupPolicy == options.CleanupPolicyDelete {
-						err := b.topics[i].partitions[j].deleteSegment(k)
-						if err != nil {
-							slog.Error("failed retention.bytes check segment deletion",
-								"topic", b.topics[i].name,
-								"partition", b.topics[i].partitions[j].num,
-								"segment", b.topics[i].partitions[j].segments[k].baseOffset,
-								"error", err,
-							)
-						}
-
-						slog.Info("retention.bytes check segment deletion done",
-							"topic", b.topics[i].name,
-							"partition", b.topics[i].partitions[j].num,
-							"segment", b.topics[i].partitions[j].segments[k].baseOffset,
-						)
-					}
-
-					// if cleanupPolicy == CleanupPolicyCompact {
-					// }
-				}
+		// segments are deleted in place, so the index
+		// is incremented only when a segment is kept
+		for k := 0; k < len(p.segments)-1; {
+			segment := p.segments[k]
+
+			expired, err := segment.runMaxRetentionMilliCheck(now, retentionMilli)
+			if err != nil {
+				slog.Error("failed retention.ms check",
+					"topic", p.topicName,
+					"partition", p.num,
+					"segment", segment.baseOffset,
+					"error", err,
+				)
 			}
+
+			slog.Info("retention.ms check result",
+				"topic", p.topicName,
+				"partition", p.num,
+				"segment", segment.baseOffset,
+				"expired", expired,
+			)
+
+			if !expired {
+				k++
+				continue
+			}
+
+			err = p.deleteSegment(k)
+			if err != nil {
+				slog.Error("failed retention.ms check segment deletion",
+					"topic", p.topicName,
+					"partition", p.num,
+					"segment", segment.baseOffset,
+					"error", err,
+				)
+				k++
+				continue
+			}
+
+			slog.Info("retention.ms check segment deletion done",
+				"topic", p.topicName,
+				"partition", p.num,
+				"segment", segment.baseOffset,
+			)
 		}
 	}
 
-	slog.Info("retention check done for all topics")
+	if retentionBytes > -1 && cleanupPolicy.Deletes() {
+		// oldest segments are deleted first
+		for len(p.segments) > 1 && p.getSize() >= retentionBytes {
+			segment := p.segments[0]
+
+			err := p.deleteSegment(0)
+			if err != nil {
+				slog.Error("failed retention.bytes check segment deletion",
+					"topic", p.topicName,
+					"partition", p.num,
+					"segment", segment.baseOffset,
+					"error", err,
+				)
+				break
+			}
+
+			slog.Info("retention.bytes check segment deletion done",
+				"topic", p.topicName,
+				"partition", p.num,
+				"segment", segment.baseOffset,
+			)
+		}
+	}
+
+	if cleanupPolicy.Compacts() {
+		err := p.compact(now)
+		if err != nil {
+			slog.Error("failed partition compaction",
+				"topic", p.topicName,
+				"partition", p.num,
+				"error", err,
+			)
+		}
+	}
 }
@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"godel/options"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunRetentionCheckKeepsNextOffset(t *testing.T) {
+	topicOptions := &options.TopicOptions{
+		NumPartitions: 1,
+		SegmentBytes:  1 << 20,
+		CleanupPolicy: options.CleanupPolicyDelete,
+		// segments expire a minute after their last append
+		RetentionMilli: time.Minute.Milliseconds(),
+		RetentionBytes: -1,
+	}
+	brokerOptions := &options.BrokerOptions{BasePath: t.TempDir()}
+
+	err := os.Mkdir(filepath.Join(brokerOptions.BasePath, "topic"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partition, err := newPartition(0, "topic", topicOptions, brokerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(messages ...*Message) {
+		t.Helper()
+
+		errs, err := partition.push(messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range errs {
+			if errs[i] != nil {
+				t.Fatalf("push() message %d error = %v", i, errs[i])
+			}
+		}
+	}
+
+	push(NewMessage(0, []byte("k"), []byte("a")), NewMessage(0, []byte("k"), []byte("b")))
+
+	partition.runRetentionCheck(uint64(time.Now().Add(time.Hour).Unix()))
+
+	// the expired active segment is rolled before being deleted
+	if len(partition.segments) != 1 || partition.segments[0].baseOffset != 2 || partition.segments[0].currSize != 0 {
+		t.Fatalf("segments after retention = %d, want a single empty segment at offset 2", len(partition.segments))
+	}
+
+	if got := partition.highWatermark(); got != 2 {
+		t.Errorf("highWatermark() = %d, want 2", got)
+	}
+
+	message := NewMessage(0, []byte("k"), []byte("c"))
+	push(message)
+
+	if message.offset != 2 {
+		t.Errorf("appended message offset = %d, want 2", message.offset)
+	}
+
+	for _, segment := range partition.segments {
+		segment.close()
+	}
+
+	partition, err = loadPartition(0, "topic", topicOptions, brokerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, segment := range partition.segments {
+			segment.close()
+		}
+	}()
+
+	if got := partition.highWatermark(); got != 3 {
+		t.Errorf("highWatermark() after reload = %d, want 3", got)
+	}
+}
@@ -0,0 +1,259 @@
+package broker
+
+import (
+	"godel/options"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// scan calls fn for every batch stored in the first size bytes of the log file.
+//
+// MUST be called while holding the segment lock.
+func (s *Segment) scan(size int64, fn func(header *batchHeader, messages []*Message, blob []byte) error) error {
+	pos := int64(0)
+
+	for pos < size {
+		header, err := readBatchHeader(s.logFile, pos)
+		if err != nil {
+			return s.corruptRecordError(s.nextOffset, err)
+		}
+
+		blob := make([]byte, header.size)
+		_, err = s.logFile.ReadAt(blob, pos)
+		if err != nil {
+			return s.corruptRecordError(header.baseOffset, err)
+		}
+
+		_, messages, err := deserializeBatch(blob)
+		if err != nil {
+			return s.corruptRecordError(header.baseOffset, err)
+		}
+
+		err = fn(header, messages, blob)
+		if err != nil {
+			return err
+		}
+
+		pos += int64(header.size)
+	}
+
+	return nil
+}
+
+// compact rewrites the segment log keeping only the messages accepted by keep.
+// The kept messages retain their offsets and rewritten batches keep their
+// header (see encodeBatch), so the segment next offset and the producers
+// sequences are preserved even if the last messages of a batch are removed.
+// Batches are rewritten only if some of their messages are removed.
+//
+// Returns the number of removed records.
+func (s *Segment) compact(keep func(message *Message) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cleanedPath := s.filePath("log.cleaned")
+	cleaned, err := os.OpenFile(cleanedPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	err = s.scan(s.currSize, func(header *batchHeader, messages []*Message, blob []byte) error {
+		kept := make([]*Message, 0, len(messages))
+		for i := range messages {
+			if keep(messages[i]) {
+				kept = append(kept, messages[i])
+			}
+		}
+
+		removed += len(messages) - len(kept)
+
+		if len(kept) == 0 {
+			return nil
+		}
+
+		if len(kept) < len(messages) {
+			blob = encodeBatch(header, kept)
+		}
+
+		_, err := cleaned.Write(blob)
+		return err
+	})
+	if err == nil && removed > 0 {
+		err = cleaned.Sync()
+	}
+
+	closeErr := cleaned.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil || removed == 0 {
+		os.Remove(cleanedPath)
+		return 0, err
+	}
+
+	// the log modification time is the segment append time (see runMaxRetentionMilliCheck)
+	info, err := s.logFile.Stat()
+	if err == nil {
+		err = os.Chtimes(cleanedPath, time.Time{}, info.ModTime())
+	}
+	if err != nil {
+		os.Remove(cleanedPath)
+		return 0, err
+	}
+
+	// swap the log file with the cleaned one,
+	// indexes get rebuilt while reloading
+	err = s.close()
+	if err != nil {
+		return 0, err
+	}
+
+	renameErr := os.Rename(cleanedPath, s.filePath("log"))
+
+	err = s.openFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	if renameErr != nil {
+		return 0, renameErr
+	}
+
+	nextOffset := s.nextOffset
+	err = s.loadOffsetsAndSizes(false)
+	if err != nil {
+		return 0, err
+	}
+
+	s.nextOffset = nextOffset
+	return removed, nil
+}
+
+// compact removes from the capped segments every record that is not the latest
+// one for its key. Tombstones (records with an empty payload) are removed as
+// well once their segment was last appended to more than delete.retention.ms ago:
+// append times are used regardless of message.timestamp.type, as retention does.
+//
+// Records of aborted transactions are removed, while the ones of open transactions
+// are kept and are not taken into account until their transaction is committed.
+// Transaction markers are always kept.
+//
+// Messages without a key can't be compacted, so they are always kept. The active
+// segment is never compacted, since it's the only one that is not capped.
+//
+// MUST be called while holding the partition lock.
+func (p *Partition) compact(now uint64) error {
+	latestOffsets := map[string]uint64{}
+
+	// transactional records are pending until their marker is found
+	pending := map[uint64][]*Message{}
+	aborted := map[uint64]bool{}
+
+	for i := range p.segments {
+		p.segments[i].mu.RLock()
+		err := p.segments[i].scan(p.segments[i].currSize, func(_ *batchHeader, messages []*Message, _ []byte) error {
+			for _, message := range messages {
+				if message.control {
+					marker, err := message.controlMarker()
+					if err != nil {
+						return err
+					}
+
+					for _, m := range pending[message.producerID] {
+						if marker == controlMarkerAbort {
+							aborted[m.offset] = true
+						} else if len(m.key) > 0 {
+							latestOffsets[string(m.key)] = m.offset
+						}
+					}
+
+					delete(pending, message.producerID)
+					continue
+				}
+
+				if message.transactional {
+					pending[message.producerID] = append(pending[message.producerID], message)
+					continue
+				}
+
+				if len(message.key) > 0 {
+					latestOffsets[string(message.key)] = message.offset
+				}
+			}
+
+			return nil
+		})
+		p.segments[i].mu.RUnlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	undecided := map[uint64]bool{}
+	for _, messages := range pending {
+		for _, m := range messages {
+			undecided[m.offset] = true
+		}
+	}
+
+	deleteRetentionMilli := options.DefaultDeleteRetentionMs
+	if p.topicOptions.DeleteRetentionMilli != nil {
+		deleteRetentionMilli = *p.topicOptions.DeleteRetentionMilli
+	}
+
+	// appendTime is the one of the segment newest message, since append times
+	// are not stored per message (see runMaxRetentionMilliCheck)
+	keep := func(message *Message, appendTime uint64) bool {
+		if message.control || undecided[message.offset] {
+			return true
+		}
+
+		if aborted[message.offset] {
+			return false
+		}
+
+		if len(message.key) == 0 {
+			return true
+		}
+
+		if latestOffsets[string(message.key)] != message.offset {
+			return false
+		}
+
+		if len(message.payload) == 0 {
+			age := time.Unix(int64(now), 0).Sub(time.Unix(int64(appendTime), 0))
+			return age <= time.Duration(deleteRetentionMilli)*time.Millisecond
+		}
+
+		return true
+	}
+
+	for i := range p.segments {
+		if !p.segments[i].capped {
+			continue
+		}
+
+		segment := p.segments[i]
+		removed, err := segment.compact(func(message *Message) bool {
+			return keep(message, segment.maxAppendTime)
+		})
+		if err != nil {
+			return err
+		}
+
+		if removed > 0 {
+			slog.Info("segment compacted",
+				"topic", p.topicName,
+				"partition", p.num,
+				"segment", p.segments[i].baseOffset,
+				"removed", removed,
+			)
+		}
+	}
+
+	return nil
+}
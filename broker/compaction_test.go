@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"godel/options"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompactBatchTail(t *testing.T) {
+	// a segment fits a single batch of two messages
+	topicOptions := &options.TopicOptions{NumPartitions: 1, SegmentBytes: 100, CleanupPolicy: options.CleanupPolicyCompact}
+	brokerOptions := &options.BrokerOptions{BasePath: t.TempDir()}
+
+	err := os.Mkdir(filepath.Join(brokerOptions.BasePath, "topic"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partition, err := newPartition(0, "topic", topicOptions, brokerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second batch overwrites the last message of the first one, which
+	// is removed by compaction once the first segment gets capped
+	batches := [][]*Message{
+		{
+			NewMessage(0, []byte("a"), []byte("1")).WithProducer(1, 0, 0),
+			NewMessage(0, []byte("b"), []byte("1")).WithProducer(1, 0, 1),
+		},
+		{
+			NewMessage(0, []byte("b"), []byte("2")).WithProducer(2, 0, 0),
+		},
+	}
+
+	for _, messages := range batches {
+		errs, err := partition.push(messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range errs {
+			if errs[i] != nil {
+				t.Fatalf("push() message %d error = %v", i, errs[i])
+			}
+		}
+	}
+
+	if len(partition.segments) != 2 {
+		t.Fatalf("segments = %d, want 2", len(partition.segments))
+	}
+
+	err = partition.compact(uint64(time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("compact() error = %v", err)
+	}
+
+	for _, segment := range partition.segments {
+		segment.close()
+	}
+
+	partition, err = loadPartition(0, "topic", topicOptions, brokerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, segment := range partition.segments {
+			segment.close()
+		}
+	}()
+
+	if got := partition.segments[0].nextOffset; got != 2 {
+		t.Errorf("compacted segment nextOffset = %d, want 2", got)
+	}
+
+	err = partition.restoreProducers(nil, 0)
+	if err != nil {
+		t.Fatalf("restoreProducers() error = %v", err)
+	}
+
+	if got := partition.producers[1].LastSequence; got != 1 {
+		t.Errorf("producer last sequence = %d, want 1", got)
+	}
+
+	// the retried batch is still detected after compaction
+	retried := NewMessage(0, []byte("b"), []byte("1")).WithProducer(1, 0, 1)
+	_, errs := partition.checkSequences([]*Message{retried})
+	if errs[0] != nil || !retried.duplicate {
+		t.Errorf("retried message duplicate = %v, error = %v, want a duplicate", retried.duplicate, errs[0])
+	}
+}
+
+func TestCompactTombstoneExpiry(t *testing.T) {
+	now := time.Now()
+	deleteRetentionMilli := time.Hour.Milliseconds()
+
+	tests := []struct {
+		name string
+		// create time of the tombstone
+		timestamp uint64
+		// time the tombstone segment was last appended to
+		appendTime time.Time
+		wantKept   bool
+	}{
+		{name: "old create time appended recently", timestamp: uint64(now.Add(-48 * time.Hour).Unix()), appendTime: now, wantKept: true},
+		{name: "recent create time appended long ago", timestamp: uint64(now.Unix()), appendTime: now.Add(-2 * time.Hour), wantKept: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a segment fits a single batch
+			topicOptions := &options.TopicOptions{
+				NumPartitions:        1,
+				SegmentBytes:         80,
+				CleanupPolicy:        options.CleanupPolicyCompact,
+				DeleteRetentionMilli: &deleteRetentionMilli,
+			}
+			brokerOptions := &options.BrokerOptions{BasePath: t.TempDir()}
+
+			err := os.Mkdir(filepath.Join(brokerOptions.BasePath, "topic"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			partition, err := newPartition(0, "topic", topicOptions, brokerOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				for _, segment := range partition.segments {
+					segment.close()
+				}
+			}()
+
+			for _, message := range []*Message{NewMessage(tt.timestamp, []byte("k"), nil), NewMessage(0, []byte("x"), []byte("v"))} {
+				_, err := partition.push([]*Message{message})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if len(partition.segments) != 2 {
+				t.Fatalf("segments = %d, want 2", len(partition.segments))
+			}
+
+			partition.segments[0].maxAppendTime = uint64(tt.appendTime.Unix())
+
+			err = partition.compact(uint64(now.Unix()))
+			if err != nil {
+				t.Fatalf("compact() error = %v", err)
+			}
+
+			if kept := partition.segments[0].currSize > 0; kept != tt.wantKept {
+				t.Errorf("tombstone kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
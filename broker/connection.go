@@ -0,0 +1,238 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"godel/internal/protocol"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+var errConnectionClosed = errors.New("connection closed")
+
+// connection is a client connection. Requests are pipelined: they are read
+// while the previous ones are still processed, up to the max in flight
+// requests, then reading stops until one of them completes. Consume requests
+// are not counted, since push consumers keep their request open for their
+// whole lifetime: they would block the connection.
+//
+// Responses are written by a single writer goroutine, in the order they are
+// queued. Produce requests are processed one at a time, in the order they are
+// received, so that pipelined messages are appended and acknowledged in order.
+// Every other request is processed concurrently and its response is matched by
+// the client with the correlation id.
+//
+// When the connection is closed the consumers started on it are stopped.
+type connection struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	responsesCh chan *queuedResponse
+	produceCh   chan *protocol.BaseRequest
+
+	// semaphore of the requests being processed
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+type queuedResponse struct {
+	resp *protocol.BaseResponse
+	// receives the write result, nil if not waited
+	resultCh chan error
+}
+
+func newConnection(conn net.Conn, maxInFlight int) *connection {
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+
+	return &connection{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		writer:      bufio.NewWriter(conn),
+		responsesCh: make(chan *queuedResponse, maxInFlight),
+		produceCh:   make(chan *protocol.BaseRequest, maxInFlight),
+		inFlight:    make(chan struct{}, maxInFlight),
+		closedCh:    make(chan struct{}),
+	}
+}
+
+func (b *Broker) handleConnection(netConn net.Conn) {
+	c := newConnection(netConn, int(b.options.MaxInFlightRequestsPerConnection))
+
+	go c.writeResponses()
+	go c.processProduceRequests(b)
+
+	defer func() {
+		close(c.produceCh)
+		c.close()
+		c.wg.Wait()
+		slog.Debug("connection closed, requests completed")
+	}()
+
+	for {
+		req, err := protocol.DeserializeRequest(c.reader, b.options.SocketRequestMaxBytes)
+		if err == io.EOF {
+			slog.Debug("client disconnected, closing connection")
+			return
+		}
+		if err != nil {
+			select {
+			case <-c.closedCh:
+				slog.Debug("connection closed")
+			default:
+				slog.Error("failed to deserialize message, closing connection", "error", err)
+			}
+			return
+		}
+
+		if req.Cmd == protocol.CmdConsume {
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				c.processRequest(b, req)
+			}()
+			continue
+		}
+
+		// blocks reading when too many requests are in flight
+		select {
+		case c.inFlight <- struct{}{}:
+		case <-c.closedCh:
+			return
+		}
+
+		c.wg.Add(1)
+
+		if req.Cmd == protocol.CmdProduce {
+			c.produceCh <- req
+			continue
+		}
+
+		go func() {
+			defer c.done()
+			c.processRequest(b, req)
+		}()
+	}
+}
+
+// processProduceRequests processes the produce requests in the order they are
+// received, until the reader stops. Requests still queued when the connection
+// is closed are dropped.
+func (c *connection) processProduceRequests(b *Broker) {
+	for req := range c.produceCh {
+		select {
+		case <-c.closedCh:
+		default:
+			c.processRequest(b, req)
+		}
+
+		c.done()
+	}
+}
+
+func (c *connection) processRequest(b *Broker, req *protocol.BaseRequest) {
+	slog.Debug("received request", "cmd", req.Cmd, "corrID", req.CorrelationID)
+
+	respPayload, err := b.processRequest(req, c)
+	if err != nil {
+		slog.Error("error while processing request", "error", err)
+		return
+	}
+	if respPayload == nil {
+		return
+	}
+
+	c.send(&protocol.BaseResponse{
+		Cmd:           req.Cmd,
+		CorrelationID: req.CorrelationID,
+		Payload:       respPayload,
+	})
+}
+
+// done releases the in flight slot of a completed request.
+func (c *connection) done() {
+	<-c.inFlight
+	c.wg.Done()
+}
+
+func (c *connection) writeResponses() {
+	for {
+		select {
+		case r := <-c.responsesCh:
+			err := writeFull(c.writer, r.resp.Serialize())
+			if r.resultCh != nil {
+				r.resultCh <- err
+			}
+
+			if err != nil {
+				slog.Error("failed to send response, closing connection", "cmd", r.resp.Cmd, "error", err)
+				c.close()
+				return
+			}
+		case <-c.closedCh:
+			return
+		}
+	}
+}
+
+// send queues the response without waiting for it to be written.
+// The response is dropped if the connection is closed.
+func (c *connection) send(resp *protocol.BaseResponse) {
+	select {
+	case c.responsesCh <- &queuedResponse{resp: resp}:
+	case <-c.closedCh:
+	}
+}
+
+// write queues the response and waits for it to be written.
+func (c *connection) write(resp *protocol.BaseResponse) error {
+	r := &queuedResponse{
+		resp:     resp,
+		resultCh: make(chan error, 1),
+	}
+
+	select {
+	case c.responsesCh <- r:
+	case <-c.closedCh:
+		return errConnectionClosed
+	}
+
+	select {
+	case err := <-r.resultCh:
+		return err
+	case <-c.closedCh:
+		return errConnectionClosed
+	}
+}
+
+// closed is closed with the connection.
+func (c *connection) closed() <-chan struct{} {
+	return c.closedCh
+}
+
+// close closes the network connection, stopping the consumers started on it.
+// Responses not yet written are dropped. It can be called more than once.
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closedCh)
+
+		// unblocks the reader
+		if err := c.conn.Close(); err != nil {
+			slog.Error("failed to close connection", "error", err)
+		}
+	})
+}
+
+func writeFull(w *bufio.Writer, data []byte) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
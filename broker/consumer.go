@@ -17,28 +17,46 @@ type consumer struct {
 	group      *consumerGroup
 	partitions []*Partition
 	// fromBeginning bool
-	started       bool
 	lastHeartbeat time.Time
 	options       *options.ConsumerOptions
 
 	correlationID *int32
 	responder     func(*protocol.BaseResponse)
 
-	stoppedCh chan struct{}
+	// set while the consumer is started (see start)
+	changesCh chan *partitionsChange
 	stopCh    chan struct{}
-	deleteCh  chan struct{}
+	doneCh    chan struct{}
+
+	deleteCh chan struct{}
 
 	mu         sync.Mutex
 	hearbeatMu sync.Mutex
 }
 
+// partitionsChange revokes and assigns partitions of a started consumer,
+// assigned partitions are read from the given offsets.
+type partitionsChange struct {
+	revoked  []uint32
+	assigned map[*Partition]uint64
+	done     chan struct{}
+}
+
+// batch of messages read from a partition by a started consumer
+type consumerBatch struct {
+	partition uint32
+	stop      chan struct{} // identifies the partition reader
+	messages  []*Message
+	err       error
+}
+
+var errConsumeStopped = errors.New("consume stopped")
+
 func (c *consumerGroup) newConsumer(id string, partitions []*Partition, opts *options.ConsumerOptions) *consumer {
 	consumer := &consumer{
 		id:            id,
 		group:         c,
 		partitions:    partitions,
-		stopCh:        make(chan struct{}),
-		stoppedCh:     make(chan struct{}),
 		deleteCh:      make(chan struct{}, 1),
 		options:       opts,
 		lastHeartbeat: time.Now(),
@@ -48,6 +66,17 @@ func (c *consumerGroup) newConsumer(id string, partitions []*Partition, opts *op
 	return consumer
 }
 
+// memberKey identifies the consumer to the assignors: static consumers are
+// keyed by their group instance id, the others by their consumer id. The
+// prefixes keep instance ids and consumer ids from colliding.
+func (c *consumer) memberKey() string {
+	if c.options.GroupInstanceID != "" {
+		return "instance:" + c.options.GroupInstanceID
+	}
+
+	return "consumer:" + c.id
+}
+
 func (c *consumer) lock() {
 	c.mu.Lock()
 }
@@ -66,111 +95,217 @@ func (c *consumer) setResponder(corrID int32, responder func(*protocol.BaseRespo
 	c.responder = responder
 }
 
-// MUST be called when the consumer is running
-func (c *consumer) respond(msg *protocol.BaseResponse) bool {
-	if c.responder != nil || c.correlationID == nil {
-		c.responder(msg)
-		return true
-	}
-
-	return false
-}
+// notifyRebalance sends a rebalance notification with the revoked and assigned
+// partitions on the consume stream. It returns false if the consumer is not
+// started, so the notification can't be sent.
+func (c *consumer) notifyRebalance(generation uint32, revoked, assigned []uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-// MUST be called when the consumer is running (just before stop)
-func (c *consumer) sendRebalanceNotif() bool {
-	if c.correlationID == nil {
+	if c.responder == nil || c.correlationID == nil {
 		return false
 	}
 
 	notif := protocol.RespNotifyRebalance{
-		Group: c.group.name,
+		Group:      c.group.name,
+		Generation: generation,
+		Revoked:    revoked,
+		Assigned:   assigned,
 	}
 
-	buf, _ := protocol.Serialize(notif)
-	// should check error
+	buf, err := protocol.Serialize(notif)
+	if err != nil {
+		slog.Error("failed to serialize rebalance notification", "consumer", c.id, "error", err)
+		return false
+	}
 
-	msg := protocol.BaseResponse{
+	c.responder(&protocol.BaseResponse{
 		Cmd:           protocol.CmdNotifyRebalabce,
 		CorrelationID: *c.correlationID,
 		Payload:       buf,
-	}
+	})
 
-	return c.respond(&msg)
+	return true
 }
 
-func (c *consumer) start(correlationID int32, callback func(m *Message) error, responder func(*protocol.BaseResponse)) error {
+// start consumes the assigned partitions from the group committed offsets,
+// unless a start offset is provided for a partition. It runs until the
+// consumer is stopped, the callback fails or closed is closed (the client
+// connection went away).
+//
+// The assigned partitions are notified first, then the group rebalances
+// revoke and assign partitions while the consumer runs (see changePartitions).
+func (c *consumer) start(correlationID int32, startOffsets map[uint32]uint64, callback func(messages []*Message) error, responder func(*protocol.BaseResponse), closed <-chan struct{}) error {
+	c.group.lock()
 	c.mu.Lock()
-	defer func() {
-		c.started = false
-	}()
-	defer c.mu.Unlock()
+
+	if c.doneCh != nil {
+		c.mu.Unlock()
+		c.group.unlock()
+		return errors.New(protocol.ErrConsumerAlreadyStarted)
+	}
 
 	c.setResponder(correlationID, responder)
-	defer c.clearResponder()
+	c.changesCh = make(chan *partitionsChange)
+	c.stopCh = make(chan struct{})
+	c.doneCh = make(chan struct{})
 
-	c.started = true
+	changesCh, stopCh, doneCh := c.changesCh, c.stopCh, c.doneCh
 
-	messageCh := make(chan *Message)
-	errorCh := make(chan error)
+	offsets := make(map[*Partition]uint64, len(c.partitions))
+	for _, partition := range c.partitions {
+		offsets[partition] = c.group.nextOffset(partition)
 
-	for i := range c.partitions {
-		j := i
-		go func() {
-			offset := c.group.offsets[c.partitions[i].num] + 1 // consume next message
+		if startOffset, ok := startOffsets[partition.num]; ok {
+			offsets[partition] = startOffset
+		}
+	}
 
-			if offset == 0 && c.options.FromBeginning {
-				offset = c.partitions[j].getBaseOffset()
-			}
+	generation := c.group.generation
+	partitions := partitionNums(c.partitions)
 
-			err := c.partitions[j].consume(offset, func(message *Message) error {
-				if message == nil {
-					slog.Error("nil message while consuming", "consumer", c.id)
-				}
-				slog.Debug("consumed message", "offset", message.Offset())
+	c.mu.Unlock()
+	c.group.unlock()
 
-				if len(c.partitions)-1 < j || c.partitions[j] == nil {
-					return errors.New("missing partition while consuming")
-				}
+	readers := map[uint32]chan struct{}{}
+	batchCh := make(chan *consumerBatch)
+	readCommitted := c.options.IsolationLevel == options.IsolationLevelReadCommitted
+
+	startReader := func(partition *Partition, offset uint64) {
+		if _, ok := readers[partition.num]; ok {
+			return
+		}
+
+		stop := make(chan struct{})
+		readers[partition.num] = stop
 
-				message.partition = c.partitions[j].num
-				messageCh <- message
-				return nil
+		go func() {
+			err := partition.consume(offset, readCommitted, stop, func(messages []*Message) error {
+				slog.Debug("consumed batch", "offset", messages[0].Offset(), "messages", len(messages))
+
+				select {
+				case batchCh <- &consumerBatch{partition: partition.num, stop: stop, messages: messages}:
+					return nil
+				case <-stop:
+					return errConsumeStopped
+				}
 			})
 
-			if err != nil {
-				errorCh <- err
+			if err != nil && err != errConsumeStopped {
+				select {
+				case batchCh <- &consumerBatch{partition: partition.num, stop: stop, err: err}:
+				case <-stop:
+				}
 			}
 		}()
 	}
 
+	stopReader := func(num uint32) {
+		if stop, ok := readers[num]; ok {
+			close(stop)
+			delete(readers, num)
+		}
+	}
+
+	defer func() {
+		for num := range readers {
+			stopReader(num)
+		}
+
+		c.mu.Lock()
+		c.clearResponder()
+		c.changesCh, c.stopCh, c.doneCh = nil, nil, nil
+		c.mu.Unlock()
+
+		close(doneCh)
+	}()
+
+	c.notifyRebalance(generation, nil, partitions)
+
+	for partition, offset := range offsets {
+		startReader(partition, offset)
+	}
+
 	for {
 		select {
-		case msg := <-messageCh:
-			slog.Debug("executing callback for", "offset", msg.Offset())
-			err := callback(msg)
-			slog.Debug("executed callback for", "offset", msg.Offset())
-			slog.Debug("received error stopping consumer")
+		case batch := <-batchCh:
+			// batches of revoked partitions may be read before their reader stops
+			if readers[batch.partition] != batch.stop {
+				continue
+			}
+
+			if batch.err != nil {
+				return batch.err
+			}
+
+			slog.Debug("executing callback for", "offset", batch.messages[0].Offset())
+			err := callback(batch.messages)
+			slog.Debug("executed callback for", "offset", batch.messages[0].Offset())
 			if err != nil {
 				return err
 			}
-		case err := <-errorCh:
-			return err
-		case <-c.stopCh:
+		case change := <-changesCh:
+			for _, num := range change.revoked {
+				stopReader(num)
+			}
+
+			for partition, offset := range change.assigned {
+				startReader(partition, offset)
+			}
+
+			close(change.done)
+		case <-stopCh:
 			slog.Debug("consumer stopped", "consumer", c.id)
-			c.stoppedCh <- struct{}{}
+			return nil
+		case <-closed:
+			slog.Debug("connection closed, consumer stopped", "consumer", c.id)
 			return nil
 		}
 	}
 }
 
-// send a stop signal and wait for actual stopped signal
+// changePartitions stops reading the revoked partitions and starts reading the
+// assigned ones, waiting for the started consumer to apply the change: once it
+// returns no more messages of the revoked partitions are sent. It does nothing
+// if the consumer is not started (the partitions are read when it starts).
+func (c *consumer) changePartitions(revoked []uint32, assigned map[*Partition]uint64) {
+	c.mu.Lock()
+	changesCh, doneCh := c.changesCh, c.doneCh
+	c.mu.Unlock()
+
+	if doneCh == nil {
+		return
+	}
+
+	change := &partitionsChange{
+		revoked:  revoked,
+		assigned: assigned,
+		done:     make(chan struct{}),
+	}
+
+	select {
+	case changesCh <- change:
+		<-change.done
+	case <-doneCh:
+	}
+}
+
+// stop stops the consumer if started and waits for it to return.
 func (c *consumer) stop() {
-	if !c.started {
+	c.mu.Lock()
+	stopCh, doneCh := c.stopCh, c.doneCh
+	c.mu.Unlock()
+
+	if doneCh == nil {
 		return
 	}
 
-	c.stopCh <- struct{}{}
-	<-c.stoppedCh
+	select {
+	case stopCh <- struct{}{}:
+	case <-doneCh:
+	}
+
+	<-doneCh
 }
 
 func (c *consumer) close() {
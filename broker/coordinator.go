@@ -0,0 +1,498 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"godel/internal/protocol"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+)
+
+type transactionState string
+
+const (
+	txnStateEmpty          transactionState = "Empty"
+	txnStateOngoing        transactionState = "Ongoing"
+	txnStatePrepareCommit  transactionState = "PrepareCommit"
+	txnStatePrepareAbort   transactionState = "PrepareAbort"
+	txnStateCompleteCommit transactionState = "CompleteCommit"
+	txnStateCompleteAbort  transactionState = "CompleteAbort"
+)
+
+// transaction is the state of a transactional producer, identified by its
+// transactional id. Every change is appended to the transaction log.
+type transaction struct {
+	TransactionalID string              `json:"transactionalId"`
+	ProducerID      uint64              `json:"producerId"`
+	ProducerEpoch   uint16              `json:"producerEpoch"`
+	State           transactionState    `json:"state"`
+	Partitions      map[string][]uint32 `json:"partitions,omitempty"` // topic -> partitions
+	Offsets         []transactionOffset `json:"offsets,omitempty"`    // committed with the transaction
+
+	// held for the whole duration of every operation on the transaction
+	mu sync.Mutex
+}
+
+type transactionOffset struct {
+	Topic     string `json:"topic"`
+	Group     string `json:"group"`
+	Partition uint32 `json:"partition"`
+	Offset    uint64 `json:"offset"`
+}
+
+// transactionCoordinator drives the transactions of the broker. Ending a transaction
+// is done in two phases: the prepare state is persisted in the transaction log first,
+// then the markers are written in the transaction partitions and the complete state is
+// persisted. Transactions found in a prepare state when the broker starts are completed.
+//
+// The transaction log is a file of JSON lines, one for every state change. It's
+// compacted (only the last state of every transaction is kept) when loaded.
+type transactionCoordinator struct {
+	broker       *Broker
+	transactions map[string]*transaction
+	logFile      *os.File
+
+	mu sync.Mutex
+}
+
+func transactionLogPath(basePath string) string {
+	return fmt.Sprintf("%s/transactions.log", basePath)
+}
+
+// loadTransactionCoordinator replays and compacts the transaction log.
+func loadTransactionCoordinator(b *Broker) (*transactionCoordinator, error) {
+	c := &transactionCoordinator{
+		broker:       b,
+		transactions: map[string]*transaction{},
+	}
+
+	logPath := transactionLogPath(b.options.BasePath)
+
+	logFile, err := os.Open(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		decoder := json.NewDecoder(bufio.NewReader(logFile))
+		for {
+			var txn transaction
+			err := decoder.Decode(&txn)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// partially written tail, dropped by the compaction below
+				slog.Warn("invalid transaction log tail, truncating", "error", err)
+				break
+			}
+
+			c.transactions[txn.TransactionalID] = &txn
+		}
+
+		logFile.Close()
+	}
+
+	err = c.rewriteLog()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// rewriteLog replaces the transaction log with the last state of every transaction.
+func (c *transactionCoordinator) rewriteLog() error {
+	logPath := transactionLogPath(c.broker.options.BasePath)
+
+	tmp, err := os.OpenFile(logPath+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, txn := range c.transactions {
+		err = appendTransaction(tmp, txn)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	err = tmp.Sync()
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(logPath+".tmp", logPath)
+	if err != nil {
+		return err
+	}
+
+	c.logFile, err = os.OpenFile(logPath, os.O_RDWR|os.O_APPEND, 0644)
+	return err
+}
+
+func appendTransaction(w io.Writer, txn *transaction) error {
+	line, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// persist appends the transaction state to the log and syncs it to disk.
+//
+// MUST be called while holding the transaction lock.
+func (c *transactionCoordinator) persist(txn *transaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := appendTransaction(c.logFile, txn)
+	if err != nil {
+		return err
+	}
+
+	return c.logFile.Sync()
+}
+
+// recover completes the transactions left in a prepare state.
+func (c *transactionCoordinator) recover() error {
+	for _, txn := range c.transactions {
+		txn.mu.Lock()
+
+		var err error
+		if txn.State == txnStatePrepareCommit || txn.State == txnStatePrepareAbort {
+			slog.Info("completing transaction", "transactionalId", txn.TransactionalID, "state", txn.State)
+			err = c.complete(txn)
+		}
+
+		txn.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// initProducer returns the producer id of the transactional id, with a bumped
+// epoch. The ongoing transaction of the previous producer instance is aborted.
+func (c *transactionCoordinator) initProducer(transactionalID string) (uint64, uint16, error) {
+	c.mu.Lock()
+	txn, ok := c.transactions[transactionalID]
+	if !ok {
+		producerID, err := c.broker.allocateProducerID()
+		if err != nil {
+			c.mu.Unlock()
+			return 0, 0, err
+		}
+
+		txn = &transaction{
+			TransactionalID: transactionalID,
+			ProducerID:      producerID,
+			State:           txnStateEmpty,
+		}
+
+		c.transactions[transactionalID] = txn
+	}
+	c.mu.Unlock()
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if !ok {
+		return txn.ProducerID, txn.ProducerEpoch, c.persist(txn)
+	}
+
+	if txn.State == txnStateOngoing {
+		txn.State = txnStatePrepareAbort
+		err := c.persist(txn)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if txn.State == txnStatePrepareCommit || txn.State == txnStatePrepareAbort {
+		err := c.complete(txn)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	txn.ProducerEpoch++
+	txn.State = txnStateEmpty
+
+	return txn.ProducerID, txn.ProducerEpoch, c.persist(txn)
+}
+
+// lockTransaction returns the locked transaction, after checking
+// that the producer is its current (not fenced) producer.
+func (c *transactionCoordinator) lockTransaction(transactionalID string, producerID uint64, producerEpoch uint16) (*transaction, error) {
+	c.mu.Lock()
+	txn, ok := c.transactions[transactionalID]
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, errors.New(protocol.ErrTransactionNotFound)
+	}
+
+	txn.mu.Lock()
+
+	if txn.ProducerID != producerID || txn.ProducerEpoch != producerEpoch {
+		txn.mu.Unlock()
+		return nil, errors.New(protocol.ErrInvalidProducerEpoch)
+	}
+
+	return txn, nil
+}
+
+// getTopic returns the topic without keeping the broker lock.
+func (c *transactionCoordinator) getTopic(name string) (*Topic, error) {
+	topic, err := c.broker.GetTopic(name)
+	c.broker.RUnlock()
+
+	return topic, err
+}
+
+// complete writes the transaction markers (and commits the transaction
+// offsets) of a prepared transaction, then persists the complete state.
+//
+// MUST be called while holding the transaction lock.
+func (c *transactionCoordinator) complete(txn *transaction) error {
+	marker := controlMarkerAbort
+	if txn.State == txnStatePrepareCommit {
+		marker = controlMarkerCommit
+	}
+
+	for topicName, partitions := range txn.Partitions {
+		topic, err := c.getTopic(topicName)
+		if err != nil {
+			slog.Warn("transaction topic not found, skipping markers", "transactionalId", txn.TransactionalID, "topic", topicName)
+			continue
+		}
+
+		for _, num := range partitions {
+			partition, err := topic.getPartition(num)
+			if err != nil {
+				return err
+			}
+
+			err = partition.writeMarker(txn.ProducerID, txn.ProducerEpoch, marker)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if marker == controlMarkerCommit {
+		for _, o := range txn.Offsets {
+			topic, err := c.getTopic(o.Topic)
+			if err == nil {
+				err = topic.commitOffset(o.Group, "", 0, o.Partition, o.Offset)
+			}
+
+			if err != nil {
+				slog.Error("failed to commit transaction offset",
+					"transactionalId", txn.TransactionalID,
+					"topic", o.Topic,
+					"group", o.Group,
+					"error", err,
+				)
+			}
+		}
+	}
+
+	txn.State = txnStateCompleteAbort
+	if marker == controlMarkerCommit {
+		txn.State = txnStateCompleteCommit
+	}
+
+	txn.Partitions = nil
+	txn.Offsets = nil
+
+	return c.persist(txn)
+}
+
+// BeginTransaction starts a new transaction for the transactional producer.
+func (b *Broker) BeginTransaction(transactionalID string, producerID uint64, producerEpoch uint16) error {
+	txn, err := b.transactions.lockTransaction(transactionalID, producerID, producerEpoch)
+	if err != nil {
+		return err
+	}
+	defer txn.mu.Unlock()
+
+	if txn.State == txnStateOngoing || txn.State == txnStatePrepareCommit || txn.State == txnStatePrepareAbort {
+		return errors.New(protocol.ErrInvalidTransactionState)
+	}
+
+	txn.State = txnStateOngoing
+	txn.Partitions = map[string][]uint32{}
+	txn.Offsets = nil
+
+	return b.transactions.persist(txn)
+}
+
+// AddPartitionsToTransaction adds the topic partitions to the ongoing transaction,
+// messages can be produced in a transaction only to its partitions.
+func (b *Broker) AddPartitionsToTransaction(transactionalID string, producerID uint64, producerEpoch uint16, topicName string, partitions ...uint32) error {
+	txn, err := b.transactions.lockTransaction(transactionalID, producerID, producerEpoch)
+	if err != nil {
+		return err
+	}
+	defer txn.mu.Unlock()
+
+	if txn.State != txnStateOngoing {
+		return errors.New(protocol.ErrInvalidTransactionState)
+	}
+
+	topic, err := b.transactions.getTopic(topicName)
+	if err != nil {
+		return err
+	}
+
+	for _, num := range partitions {
+		_, err = topic.getPartition(num)
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(txn.Partitions[topicName], num) {
+			txn.Partitions[topicName] = append(txn.Partitions[topicName], num)
+		}
+	}
+
+	return b.transactions.persist(txn)
+}
+
+// AddOffsetToTransaction stages a consumer group offset commit,
+// applied only if the ongoing transaction gets committed.
+func (b *Broker) AddOffsetToTransaction(transactionalID string, producerID uint64, producerEpoch uint16, topicName, group string, partition uint32, offset uint64) error {
+	txn, err := b.transactions.lockTransaction(transactionalID, producerID, producerEpoch)
+	if err != nil {
+		return err
+	}
+	defer txn.mu.Unlock()
+
+	if txn.State != txnStateOngoing {
+		return errors.New(protocol.ErrInvalidTransactionState)
+	}
+
+	topic, err := b.transactions.getTopic(topicName)
+	if err != nil {
+		return err
+	}
+
+	if _, err = topic.getConsumerGroup(group); err != nil {
+		return err
+	}
+
+	txn.Offsets = slices.DeleteFunc(txn.Offsets, func(o transactionOffset) bool {
+		return o.Topic == topicName && o.Group == group && o.Partition == partition
+	})
+
+	txn.Offsets = append(txn.Offsets, transactionOffset{
+		Topic:     topicName,
+		Group:     group,
+		Partition: partition,
+		Offset:    offset,
+	})
+
+	return b.transactions.persist(txn)
+}
+
+// EndTransaction commits or aborts the ongoing transaction. Retrying
+// an already completed (or prepared) end with the same outcome succeeds.
+func (b *Broker) EndTransaction(transactionalID string, producerID uint64, producerEpoch uint16, commit bool) error {
+	txn, err := b.transactions.lockTransaction(transactionalID, producerID, producerEpoch)
+	if err != nil {
+		return err
+	}
+	defer txn.mu.Unlock()
+
+	prepared, completed := txnStatePrepareAbort, txnStateCompleteAbort
+	if commit {
+		prepared, completed = txnStatePrepareCommit, txnStateCompleteCommit
+	}
+
+	switch txn.State {
+	case completed:
+		return nil
+	case prepared:
+		return b.transactions.complete(txn)
+	case txnStateOngoing:
+	default:
+		return errors.New(protocol.ErrInvalidTransactionState)
+	}
+
+	txn.State = prepared
+	err = b.transactions.persist(txn)
+	if err != nil {
+		return err
+	}
+
+	return b.transactions.complete(txn)
+}
+
+// ProduceTransactional appends the messages inside the ongoing transaction. Every message
+// must have an explicit partition that was added to the transaction, and must carry the
+// transaction producer id and epoch (see Message.WithProducer).
+//
+// The returned errors are aligned with the messages, while the last returned
+// error is set if the whole request failed.
+func (b *Broker) ProduceTransactional(transactionalID string, topic string, durable bool, messages ...*Message) ([]error, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	txn, err := b.transactions.lockTransaction(transactionalID, messages[0].producerID, messages[0].producerEpoch)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.mu.Unlock()
+
+	if txn.State != txnStateOngoing {
+		return nil, errors.New(protocol.ErrInvalidTransactionState)
+	}
+
+	errs := make([]error, len(messages))
+	accepted := make([]*Message, 0, len(messages))
+	acceptedIndexes := make([]int, 0, len(messages))
+
+	for i, m := range messages {
+		if m.producerID != txn.ProducerID || m.producerEpoch != txn.ProducerEpoch {
+			errs[i] = errors.New(protocol.ErrInvalidProducerEpoch)
+			continue
+		}
+
+		if !m.explicitPartition || !slices.Contains(txn.Partitions[topic], m.partition) {
+			errs[i] = errors.New(protocol.ErrPartitionNotInTransaction)
+			continue
+		}
+
+		m.transactional = true
+		accepted = append(accepted, m)
+		acceptedIndexes = append(acceptedIndexes, i)
+	}
+
+	producedErrs, err := b.Produce(topic, durable, accepted...)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range acceptedIndexes {
+		errs[i] = producedErrs[j]
+	}
+
+	return errs, nil
+}
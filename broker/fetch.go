@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"time"
+)
+
+// fetch reads the partition messages starting from offset, without any consumer
+// group. Messages are returned as soon as at least minBytes are available, up to
+// maxBytes (the first message is returned even if larger, so that readers can
+// always make progress). When less than minBytes are available it waits for new
+// messages for at most maxWait (or until stop is closed), then it returns whatever
+// was read.
+//
+// It returns the offset to be fetched next, which may be past the last returned
+// message when transaction markers or aborted messages are skipped.
+func (p *Partition) fetch(offset uint64, readCommitted bool, minBytes, maxBytes int64, maxWait time.Duration, stop <-chan struct{}) ([]*Message, uint64, error) {
+	reader := p.newReader(offset, readCommitted)
+	timeout := time.After(maxWait)
+
+	fetched := []*Message{}
+	size := int64(0)
+
+	for {
+		// the signal is taken before checking for messages,
+		// so that a push happening in the meantime is not missed
+		newMessages := p.newMessagesSignal()
+
+		messages, err := reader.next()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, message := range messages {
+			if len(fetched) > 0 && maxBytes > 0 && size+message.size() > maxBytes {
+				return fetched, message.offset, nil
+			}
+
+			fetched = append(fetched, message)
+			size += message.size()
+		}
+
+		if messages != nil {
+			continue
+		}
+
+		// no more messages available
+		if size >= minBytes {
+			return fetched, reader.offset, nil
+		}
+
+		select {
+		case <-newMessages:
+		case <-timeout:
+			return fetched, reader.offset, nil
+		case <-stop:
+			return fetched, reader.offset, nil
+		}
+	}
+}
+
+// highWatermark returns the offset of the next message to be appended.
+func (p *Partition) highWatermark() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.getNextOffset()
+}
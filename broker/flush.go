@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"log/slog"
+	"time"
+)
+
+// scheduleFlushCheck asyncronously starts flush checks based on
+// the log.flush.scheduler.interval.ms option. Partitions are synced
+// when their unflushed messages are older than flush.ms, and the
+// idempotent producers states are checkpointed.
+func (b *Broker) scheduleFlushCheck() {
+	if b.options.LogFlushSchedulerIntervalMilli <= 0 {
+		return
+	}
+
+	slog.Info("scheduling flush checks", "interval", b.options.LogFlushSchedulerIntervalMilli)
+
+	go func() {
+		for {
+			schedule := time.Millisecond * time.Duration(b.options.LogFlushSchedulerIntervalMilli)
+			time.Sleep(schedule)
+			b.runFlushCheck()
+		}
+	}()
+}
+
+func (b *Broker) runFlushCheck() {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+
+	for i := range b.topics {
+		for j := range b.topics[i].partitions {
+			partition := b.topics[i].partitions[j]
+
+			err := partition.runFlushMilliCheck(now)
+			if err != nil {
+				slog.Error("failed flush.ms check",
+					"topic", b.topics[i].name,
+					"partition", partition.num,
+					"error", err,
+				)
+			}
+		}
+
+		err := b.topics[i].checkpointProducers()
+		if err != nil {
+			slog.Error("failed producers checkpoint", "topic", b.topics[i].name, "error", err)
+		}
+	}
+}
+
+// flushMessages returns the number of messages after which the partition is synced
+// to disk, falling back to log.flush.interval.messages. Values < 1 disable the check.
+func (p *Partition) flushMessages() int64 {
+	if p.topicOptions.FlushMessages != 0 {
+		return p.topicOptions.FlushMessages
+	}
+
+	return p.brokerOptions.LogFlushIntervalMessages
+}
+
+// flushMilli returns the max time unflushed messages are kept before syncing the
+// partition to disk, falling back to log.flush.interval.ms. Values < 0 disable the check.
+func (p *Partition) flushMilli() int64 {
+	if p.topicOptions.FlushMilli != 0 {
+		return p.topicOptions.FlushMilli
+	}
+
+	return p.brokerOptions.LogFlushIntervalMilli
+}
+
+// runFlushMilliCheck syncs the partition if its unflushed
+// messages have been waiting for more than flush.ms.
+func (p *Partition) runFlushMilliCheck(now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	flushMilli := p.flushMilli()
+	if flushMilli < 0 || p.unflushedMessages == 0 {
+		return nil
+	}
+
+	if now.Sub(p.lastFlush) < time.Duration(flushMilli)*time.Millisecond {
+		return nil
+	}
+
+	return p.flushSegments()
+}
+
+// flush syncs to disk all the messages appended to the partition so far.
+func (p *Partition) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.flushSegments()
+}
+
+// flushSegments syncs the segments having unflushed data. Only the newest
+// segments can be dirty, so the scan stops at the first clean one that is
+// not empty (an empty segment is rolled by retention, see runRetentionCheck).
+//
+// MUST be called while holding the partition lock.
+func (p *Partition) flushSegments() error {
+	for i := len(p.segments) - 1; i >= 0; i-- {
+		flushed, err := p.segments[i].flush()
+		if err != nil {
+			return err
+		}
+
+		if !flushed && p.segments[i].currSize > 0 {
+			break
+		}
+	}
+
+	p.unflushedMessages = 0
+	p.lastFlush = time.Now()
+	return nil
+}
+
+// flush syncs the segment log file if some data was appended since the last flush.
+// Indexes are not synced since they get rebuilt from the log when found stale.
+//
+// The read lock keeps compaction from swapping the log file while syncing,
+// without blocking the readers of the segment.
+//
+// Returns true if the log file was synced.
+func (s *Segment) flush() (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	size := s.currSize
+	if s.flushedSize.Load() >= size {
+		return false, nil
+	}
+
+	err := s.logFile.Sync()
+	if err != nil {
+		return false, err
+	}
+
+	s.flushedSize.Store(size)
+	return true, nil
+}
@@ -1,12 +1,14 @@
 package broker
 
 import (
+	"cmp"
 	"errors"
 	"godel/internal/protocol"
 	"godel/options"
 	"log/slog"
 	"slices"
 	"sync"
+	"time"
 )
 
 type consumerGroup struct {
@@ -15,7 +17,19 @@ type consumerGroup struct {
 	consumers []*consumer
 	offsets   map[uint32]uint64
 
+	// incremented by every rebalance, see rebalance
+	generation uint32
+	// revoked partitions not acknowledged yet with CmdSyncGroup, by consumer id
+	revocations map[string]*revocation
+
 	mu sync.Mutex
+	// only one rebalance runs at a time
+	rebalanceMu sync.Mutex
+}
+
+type revocation struct {
+	partitions []uint32
+	ackCh      chan struct{}
 }
 
 func (c *consumerGroup) lock() {
@@ -33,51 +47,370 @@ func (c *consumerGroup) stop() {
 	}
 }
 
-// consumers and consumer group MUST not be stopped
-func (c *consumerGroup) sendRebalanceNotifs(excluding ...string) {
-	for i := range c.consumers {
-		if slices.Contains(excluding, c.consumers[i].id) {
-			continue
+// rebalance reassigns the partitions to the consumers in a new generation,
+// in two phases (like a JoinGroup/SyncGroup round):
+//
+//  1. the partitions moving to another consumer are revoked: their consumer
+//     stops reading them and gets a rebalance notification, so that it can
+//     commit them. The group waits for the revocations to be acknowledged
+//     with CmdSyncGroup, at most for the consumers rebalance timeout.
+//  2. the partitions are assigned to their new consumer, that gets a rebalance
+//     notification and reads them from the committed offsets.
+//
+// With the eager protocol all the partitions are revoked and assigned again,
+// while with the cooperative one (when all the consumers support it) only the
+// moved partitions are, the others are read without interruptions.
+//
+// MUST NOT be called with the consumer group locked.
+func (c *consumerGroup) rebalance() {
+	c.rebalanceMu.Lock()
+	defer c.rebalanceMu.Unlock()
+
+	c.lock()
+
+	c.generation++
+	generation := c.generation
+	cooperative := c.isCooperative()
+	timeout := c.rebalanceTimeout()
+
+	assignment := c.assignment()
+
+	revoked := map[*consumer][]uint32{}
+	c.revocations = map[string]*revocation{}
+
+	for _, consumer := range c.consumers {
+		consumer.lock()
+
+		kept := []*Partition{}
+		for _, partition := range consumer.partitions {
+			if cooperative && slices.Contains(assignment[consumer.id], partition) {
+				kept = append(kept, partition)
+				continue
+			}
+
+			revoked[consumer] = append(revoked[consumer], partition.num)
 		}
 
-		sent := c.consumers[i].sendRebalanceNotif()
-		if !sent {
-			slog.Debug("failed to send rebalancing notification to consumer", "consumer", c.consumers[i].id)
+		consumer.partitions = kept
+		consumer.unlock()
+
+		if len(revoked[consumer]) > 0 {
+			c.revocations[consumer.id] = &revocation{
+				partitions: revoked[consumer],
+				ackCh:      make(chan struct{}),
+			}
 		}
 	}
+
+	acks := make([]chan struct{}, 0, len(c.revocations))
+	for _, r := range c.revocations {
+		acks = append(acks, r.ackCh)
+	}
+
+	c.unlock()
+
+	for consumer, partitions := range revoked {
+		consumer.changePartitions(partitions, nil)
+
+		// consumers not started have nothing to commit
+		if !consumer.notifyRebalance(generation, partitions, nil) {
+			c.ackRevocation(consumer.id)
+		}
+	}
+
+	timeoutCh := time.After(timeout)
+
+waitAcks:
+	for _, ack := range acks {
+		select {
+		case <-ack:
+		case <-timeoutCh:
+			slog.Warn("rebalance timed out waiting for revoked partitions", "group", c.name, "generation", generation)
+			break waitAcks
+		}
+	}
+
+	c.lock()
+
+	c.revocations = nil
+
+	// consumers joined in the meantime have no partitions yet and those
+	// removed leave theirs unassigned, until the next rebalance
+	assigned := map[*consumer]map[*Partition]uint64{}
+	for _, consumer := range c.consumers {
+		consumer.lock()
+
+		offsets := map[*Partition]uint64{}
+		for _, partition := range assignment[consumer.id] {
+			if !slices.Contains(consumer.partitions, partition) {
+				offsets[partition] = c.nextOffset(partition)
+			}
+
+			slog.Debug("assinging partition to consumer",
+				"group", c.name,
+				"partition", partition.num,
+				"consumer", consumer.id,
+			)
+		}
+
+		consumer.partitions = assignment[consumer.id]
+		consumer.unlock()
+
+		if len(offsets) > 0 {
+			assigned[consumer] = offsets
+		}
+	}
+
+	c.unlock()
+
+	for consumer, offsets := range assigned {
+		partitions := make([]uint32, 0, len(offsets))
+		for partition := range offsets {
+			partitions = append(partitions, partition.num)
+		}
+
+		slices.Sort(partitions)
+
+		consumer.notifyRebalance(generation, nil, partitions)
+		consumer.changePartitions(nil, offsets)
+	}
 }
 
-// reassign partitions
+// assignment assigns the partitions with the assignor of the group strategy,
+// that all its consumers share (see apendConsumer). Consumers are ordered by
+// member key, so that static consumers keep their position (and partitions)
+// when they rejoin with a new consumer id.
 //
-// MUST call the .lock() and .unlock() methods!
-func (c *consumerGroup) rebalance() {
+// MUST lock the consumer group before getting the assignment!
+func (c *consumerGroup) assignment() map[string][]*Partition {
+	assignment := make(map[string][]*Partition, len(c.consumers))
+	if len(c.consumers) == 0 {
+		return assignment
+	}
+
+	assignor, err := getAssignor(c.consumers[0].options.PartitionAssignmentStrategy)
+	if err != nil {
+		// consumers are validated when appended
+		slog.Error("invalid assignment strategy, using range", "group", c.name, "error", err)
+		assignor = rangeAssignor{}
+	}
+
+	keys := make([]string, len(c.consumers))
+	ids := make(map[string]string, len(c.consumers))
+	current := make(map[string][]uint32, len(c.consumers))
+	for i, consumer := range c.consumers {
+		keys[i] = consumer.memberKey()
+		ids[keys[i]] = consumer.id
+
+		consumer.lock()
+		current[keys[i]] = partitionNums(consumer.partitions)
+		consumer.unlock()
+	}
+
+	slices.Sort(keys)
+
+	partitions := make(map[uint32]*Partition, len(c.topic.partitions))
+	for _, partition := range c.topic.partitions {
+		partitions[partition.num] = partition
+	}
+
+	nums := partitionNums(c.topic.partitions)
+	slices.Sort(nums)
+
+	for key, assigned := range assignor.Assign(keys, nums, current) {
+		for _, num := range assigned {
+			assignment[ids[key]] = append(assignment[ids[key]], partitions[num])
+		}
+	}
+
+	return assignment
+}
+
+// the group is cooperative only when all its consumers are
+func (c *consumerGroup) isCooperative() bool {
 	for i := range c.consumers {
-		c.consumers[i].stop()
+		if c.consumers[i].options.RebalanceProtocol != options.RebalanceProtocolCooperative {
+			return false
+		}
 	}
 
-	shuffleSlice(c.consumers)
+	return len(c.consumers) > 0
+}
 
-	// clear assigned partitions
+// rebalanceTimeout is the longest rebalance timeout of the consumers.
+func (c *consumerGroup) rebalanceTimeout() time.Duration {
+	timeout := int64(0)
 	for i := range c.consumers {
-		c.consumers[i].lock()
-		defer c.consumers[i].unlock()
+		timeout = max(timeout, c.consumers[i].options.RebalanceTimeoutMilli)
+	}
+
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// nextOffset is the offset the group reads the partition from, the one after
+// the committed offset, or the partition base offset when none is committed.
+//
+// MUST lock the consumer group before getting the offset!
+func (c *consumerGroup) nextOffset(partition *Partition) uint64 {
+	offset, ok := c.offsets[partition.num]
+	if !ok {
+		return partition.getBaseOffset()
+	}
+
+	return offset + 1 // consume next message
+}
+
+// partitionLag is the progress of the group on a partition.
+type partitionLag struct {
+	partition  uint32
+	logStart   uint64
+	logEnd     uint64
+	committed  *uint64
+	lag        uint64
+	consumerID string
+}
 
-		c.consumers[i].partitions = []*Partition{}
+// lags returns the progress of the group on every partition of the topic,
+// sorted by partition.
+//
+// MUST lock the consumer group before getting the lags!
+func (c *consumerGroup) lags() []partitionLag {
+	owners := map[*Partition]string{}
+	for _, consumer := range c.consumers {
+		consumer.lock()
+		for _, partition := range consumer.partitions {
+			owners[partition] = consumer.id
+		}
+		consumer.unlock()
 	}
 
-	// round robin to reassign partitions
-	j := 0
-	for i := range c.topic.partitions {
-		slog.Debug("assinging partition to consumer",
-			"group", c.name,
-			"partition", c.topic.partitions[i].num,
-			"consumer", c.consumers[j].id,
-		)
-		c.consumers[j].partitions = append(c.consumers[j].partitions, c.topic.partitions[i])
-		if j >= len(c.consumers) {
-			j = 0
+	lags := make([]partitionLag, 0, len(c.topic.partitions))
+	for _, partition := range c.topic.partitions {
+		lag := partitionLag{
+			partition:  partition.num,
+			logStart:   partition.getBaseOffset(),
+			logEnd:     partition.getNextOffset(),
+			consumerID: owners[partition],
 		}
+
+		if committed, ok := c.offsets[partition.num]; ok {
+			lag.committed = &committed
+		}
+
+		if next := c.nextOffset(partition); next < lag.logEnd {
+			lag.lag = lag.logEnd - next
+		}
+
+		lags = append(lags, lag)
 	}
+
+	slices.SortFunc(lags, func(a, b partitionLag) int {
+		return cmp.Compare(a.partition, b.partition)
+	})
+
+	return lags
+}
+
+// setNextOffset commits the offset before the next one to read,
+// removing the committed offset to read from the partition base offset.
+//
+// MUST lock the consumer group before setting the offset!
+func (c *consumerGroup) setNextOffset(partition *Partition, offset uint64) {
+	if offset <= partition.getBaseOffset() {
+		delete(c.offsets, partition.num)
+		return
+	}
+
+	c.offsets[partition.num] = offset - 1
+}
+
+// ackRevocation acknowledges the partitions revoked to the consumer,
+// if any, so that they can be assigned to other consumers.
+func (c *consumerGroup) ackRevocation(consumerID string) {
+	c.lock()
+	defer c.unlock()
+
+	c.deleteRevocation(consumerID)
+}
+
+// MUST lock the consumer group before deleting the revocation!
+func (c *consumerGroup) deleteRevocation(consumerID string) {
+	if r, ok := c.revocations[consumerID]; ok {
+		close(r.ackCh)
+		delete(c.revocations, consumerID)
+	}
+}
+
+// sync acknowledges the partitions revoked to the consumer in the generation
+// and returns the partitions it owns. Consumers must sync after committing the
+// revoked partitions (see protocol.ReqSyncGroup).
+func (c *consumerGroup) sync(consumerID string, generation uint32) ([]uint32, error) {
+	c.lock()
+	defer c.unlock()
+
+	consumer, err := c.getConsumer(consumerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if generation != c.generation {
+		return nil, errors.New(protocol.ErrIllegalGeneration)
+	}
+
+	c.deleteRevocation(consumerID)
+
+	consumer.lock()
+	defer consumer.unlock()
+
+	return partitionNums(consumer.partitions), nil
+}
+
+// checkGeneration returns an error unless the consumer owns the partition in the
+// generation, including the revoked partitions not acknowledged yet.
+//
+// MUST lock the consumer group before checking the generation!
+func (c *consumerGroup) checkGeneration(consumerID string, generation uint32, partition uint32) error {
+	consumer, err := c.getConsumer(consumerID)
+	if err != nil {
+		return err
+	}
+
+	if generation != c.generation {
+		return errors.New(protocol.ErrIllegalGeneration)
+	}
+
+	if r, ok := c.revocations[consumerID]; ok && slices.Contains(r.partitions, partition) {
+		return nil
+	}
+
+	consumer.lock()
+	defer consumer.unlock()
+
+	if !slices.Contains(partitionNums(consumer.partitions), partition) {
+		return errors.New(protocol.ErrIllegalGeneration)
+	}
+
+	return nil
+}
+
+// MUST lock the consumer group before getting the consumer!
+func (c *consumerGroup) getConsumer(id string) (*consumer, error) {
+	for i := range c.consumers {
+		if c.consumers[i].id == id {
+			return c.consumers[i], nil
+		}
+	}
+
+	return nil, errors.New(protocol.ErrConsumerNotFound)
+}
+
+func partitionNums(partitions []*Partition) []uint32 {
+	nums := make([]uint32, len(partitions))
+	for i := range partitions {
+		nums[i] = partitions[i].num
+	}
+
+	return nums
 }
 
 // MUST lock the consumer group before appending consumer!
@@ -88,10 +421,85 @@ func (c *consumerGroup) apendConsumer(id string, opts *options.ConsumerOptions)
 		}
 	}
 
+	// rejoining static consumers replace the previous one (see rejoin)
+	if opts.GroupInstanceID != "" && slices.ContainsFunc(c.consumers, func(consumer *consumer) bool {
+		return consumer.options.GroupInstanceID == opts.GroupInstanceID
+	}) {
+		return nil, errors.New(protocol.ErrConsumerIdAlreadyExists)
+	}
+
+	err := checkProtocol(c.consumers, opts)
+	if err != nil {
+		return nil, err
+	}
+
 	consumer := c.newConsumer(id, []*Partition{}, opts)
 	return consumer, nil
 }
 
+// checkProtocol returns an error unless the consumer can join the consumers,
+// using the same assignment strategy.
+func checkProtocol(consumers []*consumer, opts *options.ConsumerOptions) error {
+	if _, err := getAssignor(opts.PartitionAssignmentStrategy); err != nil {
+		return err
+	}
+
+	// the strategy is chosen by the first consumer of the group
+	if len(consumers) > 0 && consumers[0].options.PartitionAssignmentStrategy != opts.PartitionAssignmentStrategy {
+		return errors.New(protocol.ErrInconsistentGroupProtocol)
+	}
+
+	return nil
+}
+
+// rejoin replaces the static consumer with the same group instance id, if any,
+// with a new consumer that owns its partitions in the current generation, so
+// that restarted consumers don't rebalance the group. The replaced consumer is
+// stopped and removed, fencing its commits. It returns nil when there's no
+// consumer to replace.
+//
+// MUST NOT be called with the consumer group locked.
+func (c *consumerGroup) rejoin(id string, opts *options.ConsumerOptions) (*consumer, error) {
+	// a running rebalance assigns the partitions by consumer id
+	c.rebalanceMu.Lock()
+	defer c.rebalanceMu.Unlock()
+
+	c.lock()
+	defer c.unlock()
+
+	i := slices.IndexFunc(c.consumers, func(consumer *consumer) bool {
+		return consumer.options.GroupInstanceID == opts.GroupInstanceID
+	})
+	if i == -1 {
+		return nil, nil
+	}
+
+	previous := c.consumers[i]
+	others := slices.Delete(slices.Clone(c.consumers), i, i+1)
+
+	for j := range others {
+		if others[j].id == id {
+			return nil, errors.New(protocol.ErrConsumerIdAlreadyExists)
+		}
+	}
+
+	err := checkProtocol(others, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	previous.stop()
+
+	previous.lock()
+	partitions := previous.partitions
+	previous.close()
+	previous.unlock()
+
+	c.consumers = others
+
+	return c.newConsumer(id, partitions, opts), nil
+}
+
 // MUST lock the consumer group before appending consumer!
 func (c *consumerGroup) removeConsumer(id string) error {
 	i := -1
@@ -106,6 +514,9 @@ func (c *consumerGroup) removeConsumer(id string) error {
 	}
 	c.consumers[i].stop()
 
+	// the rebalance must not wait for the removed consumer
+	c.deleteRevocation(id)
+
 	// make sure its not started again,
 	// but should'nt be necessary
 	c.consumers[i].lock()
@@ -145,9 +556,14 @@ func (c *consumerGroup) delete() {
 		// make sure its not started again,
 		// but should'nt be necessary
 		c.consumers[i].lock()
-		defer c.consumers[i].unlock()
-
 		c.consumers[i].close()
-		c.consumers = slices.Delete(c.consumers, i, i+1)
+		c.consumers[i].unlock()
+	}
+
+	c.consumers = []*consumer{}
+
+	// a running rebalance must not wait for the removed consumers
+	for id := range c.revocations {
+		c.deleteRevocation(id)
 	}
 }
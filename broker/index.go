@@ -0,0 +1,208 @@
+package broker
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// size of a single offset index entry on disk:
+// relative offset (4 bytes) + log file position (8 bytes)
+const offsetIndexEntrySize = 4 + 8
+
+// size of a single time index entry on disk:
+// timestamp (8 bytes) + relative offset (4 bytes)
+const timeIndexEntrySize = 8 + 4
+
+type indexEntry interface {
+	comparable
+	serialize() []byte
+}
+
+// sparseIndex is a file made of fixed size entries kept alongside
+// a segment log file. Entries are kept in memory as well so that
+// lookups don't hit the disk.
+type sparseIndex[E indexEntry] struct {
+	file      *os.File
+	entries   []E
+	entrySize int
+}
+
+// openSparseIndex opens (or creates) the index file at the given path and
+// loads all its entries in memory. A trailing partial entry is ignored.
+func openSparseIndex[E indexEntry](path string, entrySize int, deserialize func([]byte) E) (*sparseIndex[E], error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	entries := make([]E, 0, len(buf)/entrySize)
+	for pos := 0; pos+entrySize <= len(buf); pos += entrySize {
+		entries = append(entries, deserialize(buf[pos:pos+entrySize]))
+	}
+
+	return &sparseIndex[E]{
+		file:      file,
+		entries:   entries,
+		entrySize: entrySize,
+	}, nil
+}
+
+// append writes a new entry at the end of the index file.
+func (i *sparseIndex[E]) append(entry E) error {
+	_, err := i.file.WriteAt(entry.serialize(), int64(len(i.entries)*i.entrySize))
+	if err != nil {
+		return err
+	}
+
+	i.entries = append(i.entries, entry)
+	return nil
+}
+
+// matches reports whether the index content is the same as the given entries.
+func (i *sparseIndex[E]) matches(entries []E) bool {
+	if len(i.entries) != len(entries) {
+		return false
+	}
+
+	for j := range entries {
+		if i.entries[j] != entries[j] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rewrite replaces the whole index content with the given entries.
+func (i *sparseIndex[E]) rewrite(entries []E) error {
+	buf := make([]byte, 0, len(entries)*i.entrySize)
+	for j := range entries {
+		buf = append(buf, entries[j].serialize()...)
+	}
+
+	err := i.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.file.WriteAt(buf, 0)
+	if err != nil {
+		return err
+	}
+
+	i.entries = entries
+	return nil
+}
+
+func (i *sparseIndex[E]) close() error {
+	return i.file.Close()
+}
+
+type offsetIndexEntry struct {
+	relativeOffset uint32
+	position       int64
+}
+
+func (e offsetIndexEntry) serialize() []byte {
+	buf := make([]byte, 0, offsetIndexEntrySize)
+	buf = binary.BigEndian.AppendUint32(buf, e.relativeOffset)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.position))
+	return buf
+}
+
+func deserializeOffsetIndexEntry(b []byte) offsetIndexEntry {
+	return offsetIndexEntry{
+		relativeOffset: binary.BigEndian.Uint32(b),
+		position:       int64(binary.BigEndian.Uint64(b[4:])),
+	}
+}
+
+// offsetIndex maps a message offset (relative to the segment base offset)
+// to its position in the log file, with an entry every
+// index.interval.bytes written bytes.
+type offsetIndex struct {
+	*sparseIndex[offsetIndexEntry]
+}
+
+func openOffsetIndex(path string) (*offsetIndex, error) {
+	index, err := openSparseIndex(path, offsetIndexEntrySize, deserializeOffsetIndexEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &offsetIndex{index}, nil
+}
+
+// lookup returns the log file position of the greatest indexed
+// offset that is less than or equal to the requested relative offset.
+// If no such entry exists the beginning of the file is returned.
+func (i *offsetIndex) lookup(relativeOffset uint32) int64 {
+	n := sort.Search(len(i.entries), func(j int) bool {
+		return i.entries[j].relativeOffset > relativeOffset
+	})
+
+	if n == 0 {
+		return 0
+	}
+
+	return i.entries[n-1].position
+}
+
+type timeIndexEntry struct {
+	timestamp      uint64
+	relativeOffset uint32
+}
+
+func (e timeIndexEntry) serialize() []byte {
+	buf := make([]byte, 0, timeIndexEntrySize)
+	buf = binary.BigEndian.AppendUint64(buf, e.timestamp)
+	buf = binary.BigEndian.AppendUint32(buf, e.relativeOffset)
+	return buf
+}
+
+func deserializeTimeIndexEntry(b []byte) timeIndexEntry {
+	return timeIndexEntry{
+		timestamp:      binary.BigEndian.Uint64(b),
+		relativeOffset: binary.BigEndian.Uint32(b[8:]),
+	}
+}
+
+// timeIndex is written together with the offset index. Each entry holds
+// the max timestamp of all the messages that precede the entry relative
+// offset, so its timestamps are always increasing.
+type timeIndex struct {
+	*sparseIndex[timeIndexEntry]
+}
+
+func openTimeIndex(path string) (*timeIndex, error) {
+	index, err := openSparseIndex(path, timeIndexEntrySize, deserializeTimeIndexEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &timeIndex{index}, nil
+}
+
+// lookup returns the greatest indexed relative offset such that all the
+// messages preceding it have a timestamp lower than the requested one.
+// Scanning from there is enough to find the first message at or after
+// the requested timestamp.
+func (i *timeIndex) lookup(timestamp uint64) uint32 {
+	n := sort.Search(len(i.entries), func(j int) bool {
+		return i.entries[j].timestamp >= timestamp
+	})
+
+	if n == 0 {
+		return 0
+	}
+
+	return i.entries[n-1].relativeOffset
+}
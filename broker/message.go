@@ -2,7 +2,40 @@ package broker
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"hash/crc32"
+)
+
+// Legacy record formats, written before record batches were introduced.
+// They are still readable and are handled as batches of a single message.
+//
+// v1:
+//
+//	size (4) | offset (8) | magic (1) | crc (4) | timestamp (8) | key length (4) | key | payload
+//
+// v0 (no magic and crc fields):
+//
+//	size (4) | offset (8) | timestamp (8) | key length (4) | key | payload
+//
+// v0 records are recognized because the first byte of their timestamp
+// (where the magic byte is now) is always 0.
+const (
+	recordMagicV0 byte = 0
+	recordMagicV1 byte = 1
+
+	recordHeaderSizeV0 = 4 + 8 + 8 + 4
+	recordHeaderSizeV1 = 4 + 8 + 1 + 4 + 8 + 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	errRecordTooShort        = "record.too.short"
+	errMessageSizeMismatch   = "message.size.mismatch"
+	errUnknownRecordVersion  = "unknown.record.version"
+	errKeyLengthOutOfRange   = "key.length.out.of.range"
+	errRecordChecksumInvalid = "record.checksum.mismatch"
+	errRecordMalformed       = "record.malformed"
 )
 
 type Message struct {
@@ -11,6 +44,20 @@ type Message struct {
 	key       []byte
 	payload   []byte
 	timestamp uint64
+	headers   map[string][]byte
+
+	// the partition was chosen by the producer
+	explicitPartition bool
+
+	// idempotent producer fields (0 producer id if not idempotent)
+	producerID    uint64
+	producerEpoch uint16
+	sequence      uint32
+	duplicate     bool // already appended by a previous request
+
+	// appended inside a transaction, control messages are transaction markers
+	transactional bool
+	control       bool
 }
 
 func NewMessage(timestamp uint64, key []byte, payload []byte) *Message {
@@ -22,68 +69,73 @@ func NewMessage(timestamp uint64, key []byte, payload []byte) *Message {
 	}
 }
 
-func deserializeMessage(b []byte) (*Message, error) {
-	messageSize := binary.BigEndian.Uint32(b)
+// deserializeLegacyRecord decodes a v0 or v1 record whose header was already parsed.
+func deserializeLegacyRecord(h *batchHeader, b []byte) (*Message, error) {
+	headerSize := uint32(h.headerSize())
+	keyLen := binary.BigEndian.Uint32(b[headerSize-4 : headerSize])
 
-	if messageSize != uint32(len(b)) {
-		return nil, fmt.Errorf("message.size.mismatch")
+	if keyLen > h.size-headerSize {
+		return nil, errors.New(errKeyLengthOutOfRange)
 	}
 
-	offset := binary.BigEndian.Uint64(b[4:12])
-	timestamp := binary.BigEndian.Uint64(b[12:20])
-	keyLen := binary.BigEndian.Uint32(b[20:24])
-
-	key := b[24 : 24+keyLen]
-	payload := b[24+keyLen : messageSize]
+	if h.magic == recordMagicV1 && crc32.Checksum(b[17:], crc32c) != h.crc {
+		return nil, errors.New(errRecordChecksumInvalid)
+	}
 
 	return &Message{
-		offset:    offset,
-		key:       key,
-		payload:   payload,
-		timestamp: timestamp,
+		offset:    h.baseOffset,
+		key:       b[headerSize : headerSize+keyLen],
+		payload:   b[headerSize+keyLen : h.size],
+		timestamp: h.baseTimestamp,
 	}, nil
 }
 
-func (m *Message) serialize() []byte {
-	totalSize := uint32(4 + // total size itself
-		8 + // offset
-		8 + // timestamp
-		4 + // key length
-		// 4 + // payload length
-		len([]byte(m.key)) + // key
-		len(m.payload)) // payload
-
-	totalSizeBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(totalSizeBytes, totalSize)
-
-	offsetBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(offsetBytes, m.offset)
-
-	timestampBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(timestampBytes, m.timestamp)
+// WithHeaders sets the message headers (e.g. tracing ids, content types).
+func (m *Message) WithHeaders(headers map[string][]byte) *Message {
+	m.headers = headers
+	return m
+}
 
-	keyLenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(keyLenBytes, uint32(len(m.key)))
+// WithPartition sets the partition the message must be appended to,
+// regardless of the topic partitioner.
+func (m *Message) WithPartition(partition uint32) *Message {
+	m.partition = partition
+	m.explicitPartition = true
+	return m
+}
 
-	// payloadSizeBytes := make([]byte, 4)
-	// binary.BigEndian.PutUint32(payloadSizeBytes, uint32(len(m.Payload)))
+// WithProducer sets the idempotent producer id, epoch and sequence, used by the
+// partition to detect retried (duplicate) and out of order messages.
+func (m *Message) WithProducer(id uint64, epoch uint16, sequence uint32) *Message {
+	m.producerID = id
+	m.producerEpoch = epoch
+	m.sequence = sequence
+	return m
+}
 
-	blob := make([]byte, 0, totalSize)
-	blob = append(blob, totalSizeBytes...)
-	blob = append(blob, offsetBytes...)
-	blob = append(blob, timestampBytes...)
-	blob = append(blob, keyLenBytes...)
-	// blob = append(blob, payloadSizeBytes...)
-	blob = append(blob, m.key...)
-	blob = append(blob, m.payload...)
+// size returns the bytes of the message key, payload and headers,
+// checked against max.message.bytes.
+func (m *Message) size() int64 {
+	size := int64(len(m.key) + len(m.payload))
+	for k, v := range m.headers {
+		size += int64(len(k) + len(v))
+	}
 
-	return blob
+	return size
 }
 
 func (m *Message) Offset() uint64 {
 	return m.offset
 }
 
+func (m *Message) Partition() uint32 {
+	return m.partition
+}
+
+func (m *Message) Timestamp() uint64 {
+	return m.timestamp
+}
+
 func (m *Message) Key() []byte {
 	return m.key
 }
@@ -99,3 +151,13 @@ func (m *Message) Payload() []byte {
 func (m *Message) PayloadStr() string {
 	return string(m.payload)
 }
+
+func (m *Message) Headers() map[string][]byte {
+	return m.headers
+}
+
+// Duplicate reports whether the message was already appended by a previous
+// request of the same idempotent producer, so it was not appended again.
+func (m *Message) Duplicate() bool {
+	return m.duplicate
+}
@@ -9,15 +9,31 @@ import (
 	"log/slog"
 	"os"
 	"slices"
+	"sync"
+	"time"
 )
 
 type Partition struct {
-	newMessageCh  chan struct{}
+	newMessageCh  chan struct{} // closed and replaced on every push
 	num           uint32
 	segments      []*Segment // guaranteed segments order by offset
 	topicOptions  *options.TopicOptions
 	brokerOptions *options.BrokerOptions
 	topicName     string
+
+	// messages appended since the last flush to disk
+	unflushedMessages int64
+	lastFlush         time.Time
+
+	// last sequences of the idempotent producers, changed since the last checkpoint
+	producers        map[uint64]*producerState
+	producersChanged bool
+
+	// open and aborted transactions, rebuilt from the log when loading
+	ongoingTxns map[uint64]uint64 // producer id -> first offset
+	abortedTxns []abortedTxn
+
+	mu sync.Mutex
 }
 
 func newPartition(id uint32, topicName string, topicOptions *options.TopicOptions, brokerOptions *options.BrokerOptions) (*Partition, error) {
@@ -42,6 +58,9 @@ func newPartition(id uint32, topicName string, topicOptions *options.TopicOption
 		topicName:     topicName,
 		topicOptions:  topicOptions,
 		brokerOptions: brokerOptions,
+		lastFlush:     time.Now(),
+		producers:     map[uint64]*producerState{},
+		ongoingTxns:   map[uint64]uint64{},
 	}, nil
 }
 
@@ -67,24 +86,42 @@ func loadPartition(id uint32, topicName string, topicOptions *options.TopicOptio
 		return nil, err
 	}
 
+	slices.Sort(segmentsBaseOffsets)
+
 	segments := make([]*Segment, 0, len(segmentsBaseOffsets))
 	for i := range segmentsBaseOffsets {
-		segment, err := loadSegment(brokerOptions.BasePath, topicName, id, segmentsBaseOffsets[i], topicOptions.SegmentBytes)
+		// only the active (last) segment can have a partially written
+		// tail after a crash, so it's the only one being recovered
+		isActive := i == len(segmentsBaseOffsets)-1
+
+		segment, err := loadSegment(brokerOptions.BasePath, topicName, id, segmentsBaseOffsets[i], topicOptions, isActive)
 		if err != nil {
 			return nil, err
 		}
 
+		segment.capped = !isActive
+
 		segments = append(segments, segment)
 	}
 
-	return &Partition{
+	partition := &Partition{
 		num:           id,
 		newMessageCh:  make(chan struct{}),
 		topicName:     topicName,
 		topicOptions:  topicOptions,
 		brokerOptions: brokerOptions,
+		lastFlush:     time.Now(),
 		segments:      segments,
-	}, nil
+		producers:     map[uint64]*producerState{},
+		ongoingTxns:   map[uint64]uint64{},
+	}
+
+	err = partition.loadTransactions()
+	if err != nil {
+		return nil, err
+	}
+
+	return partition, nil
 }
 
 func (p *Partition) getBaseOffset() uint64 {
@@ -97,12 +134,30 @@ func (p *Partition) getBaseOffset() uint64 {
 
 func (p *Partition) getNextOffset() uint64 {
 	if len(p.segments) == 0 {
-		return 1
+		return 0
 	}
 
 	return p.segments[len(p.segments)-1].nextOffset
 }
 
+// getOffsetByTimestamp returns the offset of the first message having a timestamp
+// greater or equal to the requested one. If no such message exists the next offset
+// is returned.
+func (p *Partition) getOffsetByTimestamp(timestamp uint64) (uint64, error) {
+	for i := range p.segments {
+		offset, found, err := p.segments[i].getOffsetByTimestamp(timestamp)
+		if err != nil {
+			return 0, err
+		}
+
+		if found {
+			return offset, nil
+		}
+	}
+
+	return p.getNextOffset(), nil
+}
+
 func (p *Partition) getSize() int64 {
 	var size int64
 	for i := range p.segments {
@@ -112,8 +167,62 @@ func (p *Partition) getSize() int64 {
 	return size
 }
 
-func (p *Partition) push(message *Message) (uint64, error) {
-	blob := message.serialize()
+// push appends the messages to the partition as a single record batch
+// (one write per producer) and wakes up all the consumers waiting for new messages.
+//
+// Messages of idempotent producers are checked first (see checkSequences):
+// duplicates are skipped, while rejected messages get their own error.
+// The returned errors are aligned with the messages, the last returned
+// error is set if the whole batch failed.
+//
+// The partition is synced to disk every flush.messages, after the messages are
+// appended: if syncing fails the error is returned, but the messages are kept in
+// the log. Retries of idempotent producers are detected as duplicates, while
+// other producers may append the messages twice.
+//
+// On success the messages offsets and partitions are set.
+func (p *Partition) push(messages []*Message) ([]error, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	accepted, errs := p.checkSequences(messages)
+	for i := range messages {
+		messages[i].partition = p.num
+	}
+
+	for _, batch := range splitByProducer(accepted) {
+		_, err := p.appendBatch(batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// sync to disk every flush.messages (fsync always when 1)
+	if flushMessages := p.flushMessages(); flushMessages > 0 && p.unflushedMessages >= flushMessages {
+		err := p.flushSegments()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return errs, nil
+}
+
+// appendBatch appends the messages as a single record batch, wakes up the
+// waiting consumers and keeps track of the idempotent producers and of the
+// transactions of the partition.
+//
+// On success the messages offsets are set and the batch base offset is returned.
+// The batch is not synced to disk (see flushSegments).
+//
+// MUST be called while holding the partition lock.
+func (p *Partition) appendBatch(messages []*Message) (uint64, error) {
+	// offsets are relative to the batch until it gets appended
+	for i := range messages {
+		messages[i].offset = uint64(i)
+	}
+
+	blob := serializeBatch(0, messages)
 
 	// check that blob size doesn't exceed max message size
 	if len(blob) > int(p.topicOptions.SegmentBytes) {
@@ -124,7 +233,7 @@ func (p *Partition) push(message *Message) (uint64, error) {
 	if len(p.segments) == 0 {
 		slog.Info("initializing new segment", "base_offset", 0)
 
-		firstSegment, err := newSegment(p.brokerOptions.BasePath, p.topicName, p.num, 0, p.topicOptions.SegmentBytes)
+		firstSegment, err := newSegment(p.brokerOptions.BasePath, p.topicName, p.num, 0, p.topicOptions)
 		if err != nil {
 			return 0, err
 		}
@@ -132,26 +241,104 @@ func (p *Partition) push(message *Message) (uint64, error) {
 		p.segments = append(p.segments, firstSegment)
 	}
 
-	// append the message to the log segment
+	// append the batch to the log segment
 	offset, appendErr := p.segments[len(p.segments)-1].appendBlob(blob)
 	if appendErr.isMaxSizeReached() {
-		// if the max size of the segment is reached, create a new one
-		nextOffset := p.getNextOffset()
-		newSegment, err := newSegment(p.brokerOptions.BasePath, p.topicName, p.num, nextOffset, p.topicOptions.SegmentBytes)
+		// if the max size of the segment is reached, cap it
+		// and append the batch to a new one
+		newSegment, err := p.rollSegment()
 		if err != nil {
 			return 0, err
 		}
-		p.segments = append(p.segments, newSegment)
-	} else if appendErr != nil {
+
+		offset, appendErr = newSegment.appendBlob(blob)
+	}
+	if appendErr != nil {
 		return 0, appendErr
 	}
 
-	message.offset = offset
-	p.newMessageCh <- struct{}{}
+	for i := range messages {
+		messages[i].offset = offset + uint64(i)
+		messages[i].partition = p.num
+	}
+
+	if first := messages[0]; first.producerID != 0 && !first.control {
+		p.trackProducer(first.producerID, first.producerEpoch, messages[len(messages)-1].sequence)
+	}
+
+	p.trackTransaction(messages[0], offset, messages[len(messages)-1].offset)
+	p.notifyNewMessages()
+
+	p.unflushedMessages += int64(len(messages))
+
 	return offset, nil
 }
 
-func (p *Partition) consume(offset uint64, callback func(message *Message) error) error {
+// notifyNewMessages wakes up all the consumers waiting for new messages.
+//
+// MUST be called while holding the partition lock.
+func (p *Partition) notifyNewMessages() {
+	close(p.newMessageCh)
+	p.newMessageCh = make(chan struct{})
+}
+
+// newMessagesSignal returns a channel that gets closed on the next push.
+func (p *Partition) newMessagesSignal() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.newMessageCh
+}
+
+// consume reads the partition starting from the given offset and calls the callback
+// for every batch of messages. When the end of the partition is reached it waits for
+// new messages to be pushed, until stop is closed.
+//
+// Transaction markers are never returned. When readCommitted is true, messages of
+// aborted transactions are skipped and the last stable offset is never passed.
+func (p *Partition) consume(offset uint64, readCommitted bool, stop <-chan struct{}, callback func(messages []*Message) error) error {
+	reader := p.newReader(offset, readCommitted)
+
+	// start consume loop
+	for {
+		// the signal is taken before checking for messages,
+		// so that a push happening in the meantime is not missed
+		newMessages := p.newMessagesSignal()
+
+		messages, err := reader.next()
+		if err != nil {
+			return err
+		}
+
+		if messages == nil {
+			select {
+			case <-newMessages:
+			case <-stop:
+				return nil
+			}
+			continue
+		}
+
+		// execute calback on the batch
+		err = callback(messages)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// partitionReader reads the visible messages of a partition batch by batch,
+// keeping track of the segment and offset to be read next.
+type partitionReader struct {
+	partition     *Partition
+	segmentIdx    int
+	offset        uint64
+	readCommitted bool
+}
+
+// newReader returns a reader starting from the given offset. If the offset
+// is less than first available offset, it defaults to the first available one.
+func (p *Partition) newReader(offset uint64, readCommitted bool) *partitionReader {
 	// seatch the segment corresponding to the requested offset
 	segmentIdx := binarySearchSegment(p.segments, offset)
 
@@ -162,115 +349,141 @@ func (p *Partition) consume(offset uint64, callback func(message *Message) error
 		offset = p.segments[0].baseOffset
 	}
 
-	// start consume loop
+	return &partitionReader{
+		partition:     p,
+		segmentIdx:    segmentIdx,
+		offset:        offset,
+		readCommitted: readCommitted,
+	}
+}
+
+// next returns the visible messages of the next batch and moves the reader
+// past it. It returns no messages when the end of the partition (or the last
+// stable offset) is reached: callers should wait for new messages with a
+// newMessagesSignal taken before calling next.
+func (r *partitionReader) next() ([]*Message, error) {
+	p := r.partition
+
 	for {
 		// if there are no segment, or the requested offset is after the last segment.
 		// then wait for a new message before continuing
-		if len(p.segments) == 0 || segmentIdx >= len(p.segments) {
+		if len(p.segments) == 0 || r.segmentIdx >= len(p.segments) {
 			slog.Debug("waiting for new messages")
-			<-p.newMessageCh
-			continue
+			return nil, nil
 		}
 
-		// if the requested offset is inferior to the current segment next offset
-		// (aka if the message actually exists) get the message, otherwise just
-		// wait for a new message signal.
-		if offset < p.segments[segmentIdx].nextOffset {
-			message, err := p.segments[segmentIdx].getMessage(offset)
+		segment := p.segments[r.segmentIdx]
 
-			// last message segment reached and segment capped
-			// increment segmentindex and continue looping
-			if err == io.EOF && p.segments[segmentIdx].capped {
+		// if the requested offset is not in the current segment move to the
+		// next one if the segment is capped, otherwise wait for new messages
+		if r.offset >= segment.nextOffset {
+			if segment.capped {
 				slog.Debug("segment ended")
-				segmentIdx++
+				r.segmentIdx++
 				continue
 			}
 
-			// last message segment reached and segment not capped
-			// (just wait for a new message)
-			if err == io.EOF && !p.segments[segmentIdx].capped {
-				slog.Debug("last segment message, waiting for new")
-				<-p.newMessageCh
-				continue
+			slog.Debug("last segment message, waiting for new")
+			return nil, nil
+		}
+
+		// messages of open transactions can't be read yet
+		lso := p.lastStableOffset()
+		if r.readCommitted && r.offset >= lso {
+			slog.Debug("last stable offset reached, waiting for transactions")
+			return nil, nil
+		}
+
+		messages, err := segment.getBatch(r.offset)
+
+		// the remaining messages of the segment were removed by
+		// compaction, go on with the next segment (if capped)
+		if err == io.EOF && segment.capped {
+			r.segmentIdx++
+			continue
+		}
+
+		if err == io.EOF {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// offsets may not be contiguous in compacted segments
+		nextOffset := messages[len(messages)-1].offset + 1
+
+		visible := make([]*Message, 0, len(messages))
+		for _, message := range messages {
+			if r.readCommitted && message.offset >= lso {
+				nextOffset = message.offset
+				break
 			}
 
-			if err != nil {
-				return err
+			if message.control || (r.readCommitted && p.isAborted(message)) {
+				continue
 			}
 
-			// execute calback on message
 			message.partition = p.num
-			err = callback(message)
-			if err != nil {
-				return err
-			}
+			visible = append(visible, message)
+		}
 
-			// everything went right so we
-			// can increment consumer offset
-			offset++
-		} else {
-			slog.Debug("waiting for new messages 1")
-			<-p.newMessageCh
+		r.offset = nextOffset
+
+		if len(visible) > 0 {
+			return visible, nil
 		}
 	}
 }
 
-// binarySearchSegment search for the segment containing the requested offset.
-//
-// If the segment is found, its index is returned.
-//
-// If the requested offset is inferior to the first available segment, then it returns -1.
-//
-// If it's superior to the maximum available segment, it returns the last segment index + 1.
 func binarySearchSegment(segments []*Segment, offset uint64) int {
-	return bsSegment(segments, offset, 0, len(segments))
-}
-
-func bsSegment(segments []*Segment, offset uint64, lo, hi int) int {
-	maxIndex := hi - 1
-
-	if maxIndex >= len(segments) || maxIndex < 0 {
-		return maxIndex + 1
-	}
+	// first segment ending after the requested offset
+	idx, _ := slices.BinarySearchFunc(segments, offset, func(s *Segment, offset uint64) int {
+		if s.nextOffset <= offset {
+			return -1
+		}
 
-	maxSegment := segments[maxIndex]
+		return 1
+	})
 
-	// offset is inside this segment
-	if offset >= maxSegment.baseOffset && offset < maxSegment.nextOffset {
-		return maxIndex
+	// offset is the next one of the last non-capped segment
+	if idx == len(segments) && idx > 0 && !segments[idx-1].capped && offset == segments[idx-1].nextOffset {
+		return idx - 1
 	}
 
-	// offset is last message of ths non-capped segment
-	if offset >= maxSegment.baseOffset && offset == maxSegment.nextOffset && !maxSegment.capped {
-		return maxIndex
+	if idx == 0 && len(segments) > 0 && offset < segments[0].baseOffset {
+		return -1
 	}
 
-	// offset is first message of the next segment (if exists)
-	if offset >= maxSegment.baseOffset && offset >= maxSegment.nextOffset {
-		return maxIndex + 1
-	}
+	return idx
+}
 
-	// canì't divide anymore
-	if lo == hi-1 {
-		return -1
-	}
+// rollSegment caps the active segment and appends a new
+// one, starting at the partition next offset.
+//
+// MUST be called while holding the partition lock.
+func (p *Partition) rollSegment() (*Segment, error) {
+	p.segments[len(p.segments)-1].capped = true
 
-	// offset is in the high side
-	if offset > maxSegment.baseOffset {
-		return bsSegment(segments, offset, hi, len(segments))
+	segment, err := newSegment(p.brokerOptions.BasePath, p.topicName, p.num, p.getNextOffset(), p.topicOptions)
+	if err != nil {
+		return nil, err
 	}
 
-	// offset is in the low side
-	mid := (hi-lo)/2 + 1
-	return bsSegment(segments, offset, lo, lo+mid)
+	p.segments = append(p.segments, segment)
+	return segment, nil
 }
 
+// deleteSegment deletes the i-th segment files.
+//
+// MUST be called while holding the partition lock.
 func (p *Partition) deleteSegment(i int) error {
-	err := p.segments[i].delete(p.brokerOptions.BasePath, p.topicName, p.num)
+	err := p.segments[i].delete()
 	if err != nil {
 		return err
 	}
 
-	p.segments = slices.Delete(p.segments, i, i)
+	p.segments = slices.Delete(p.segments, i, i+1)
 	return nil
 }
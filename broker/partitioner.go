@@ -1,59 +1,73 @@
 package broker
 
-// Mixing constants; generated offline.
+import (
+	"godel/internal/partitioner"
+	"godel/options"
+)
+
+// Mixing constants of the murmur2 hash, see internal/partitioner.
 const (
-	M     = 0x5bd1e995
-	BIG_M = 0xc6a4a7935bd1e995
-	R     = 24
-	BIG_R = 47
+	M     = partitioner.M
+	BIG_M = partitioner.BIG_M
+	R     = partitioner.R
+	BIG_R = partitioner.BIG_R
 )
 
-// 32-bit mixing function.
-func mmix(h uint32, k uint32) (uint32, uint32) {
-	k *= M
-	k ^= k >> R
-	k *= M
-	h *= M
-	h ^= k
-	return h, k
+const DefaultPartitonerSeed = partitioner.DefaultPartitonerSeed
+
+// MurmurHash2 returns the murmur2 hash of data, the one used by the partitioners.
+func MurmurHash2(data []byte, seed uint32) uint32 {
+	return partitioner.MurmurHash2(data, seed)
 }
 
-func MurmurHash2(data []byte, seed uint32) (h uint32) {
-	var k uint32
+// DefaultPartitioner returns the partition of a key out of n, the murmur2 hash
+// of the key modulo n. Clients use it to choose the same partitions as the broker.
+func DefaultPartitioner(key []byte, n uint32) uint32 {
+	return partitioner.Hash(key, n)
+}
 
-	// Initialize the hash to a 'random' value
-	h = seed ^ uint32(len(data))
+// Partitioner chooses the partitions the messages of a produced batch are appended to.
+type Partitioner interface {
+	// Partition returns the partition number of every message, in order.
+	Partition(messages []*Message, numPartitions uint32) []uint32
+}
 
-	// Mix 4 bytes at a time into the hash
-	for l := len(data); l >= 4; l -= 4 {
-		k = uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
-		h, k = mmix(h, k)
-		data = data[4:]
-	}
+// NewPartitioner returns the partitioner for the partitioner topic option.
+// Explicit message partitions are always honored, unknown (or empty) options
+// default to murmur2 for topics created before the option was introduced.
+func NewPartitioner(partitionerType options.PartitionerType) Partitioner {
+	var fallback partitioner.Partitioner
 
-	// Handle the last few bytes of the input array
-	switch len(data) {
-	case 3:
-		h ^= uint32(data[2]) << 16
-		fallthrough
-	case 2:
-		h ^= uint32(data[1]) << 8
-		fallthrough
-	case 1:
-		h ^= uint32(data[0])
-		h *= M
+	switch partitionerType {
+	case options.PartitionerRoundRobin:
+		fallback = &partitioner.RoundRobin{}
+	case options.PartitionerSticky:
+		fallback = &partitioner.Sticky{}
+	default:
+		fallback = &partitioner.Murmur2{}
 	}
 
-	// Do a few final mixes of the hash to ensure the last few bytes are well incorporated
-	h ^= h >> 13
-	h *= M
-	h ^= h >> 15
+	return &ExplicitPartitioner{Fallback: fallback}
+}
 
-	return
+// ExplicitPartitioner honors the partition set by the producer (see Message.WithPartition),
+// the fallback partitioner chooses the partition of the other messages from their key.
+type ExplicitPartitioner struct {
+	Fallback partitioner.Partitioner
 }
 
-const DefaultPartitonerSeed = uint32(0x9747b28c)
+func (p *ExplicitPartitioner) Partition(messages []*Message, numPartitions uint32) []uint32 {
+	keys := make([][]byte, len(messages))
+	for i := range messages {
+		keys[i] = messages[i].key
+	}
+
+	partitions := p.Fallback.Partition(keys, numPartitions)
+	for i := range messages {
+		if messages[i].explicitPartition {
+			partitions[i] = messages[i].partition
+		}
+	}
 
-func DefaultPartitioner(key []byte, n uint32) uint32 {
-	return MurmurHash2(key, DefaultPartitonerSeed) % n
+	return partitions
 }
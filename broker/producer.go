@@ -0,0 +1,227 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"godel/internal/protocol"
+	"log/slog"
+	"maps"
+	"os"
+)
+
+// producerState is the last appended sequence of an idempotent producer on
+// a partition. States are rebuilt from the log when loading the partition,
+// starting from the checkpoint periodically persisted in the topic state.
+type producerState struct {
+	Epoch        uint16 `json:"epoch"`
+	LastSequence uint32 `json:"lastSequence"`
+}
+
+type brokerProducers struct {
+	NextProducerID uint64 `json:"nextProducerId"`
+}
+
+// loadProducers loads the next producer id from the broker path.
+// Producer ids start from 1, since 0 means a non idempotent producer.
+func (b *Broker) loadProducers() error {
+	producersPath := fmt.Sprintf("%s/producers.json", b.options.BasePath)
+
+	producersBytes, err := os.ReadFile(producersPath)
+	if os.IsNotExist(err) {
+		b.nextProducerID = 1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var producers brokerProducers
+	err = json.Unmarshal(producersBytes, &producers)
+	if err != nil {
+		return err
+	}
+
+	b.nextProducerID = max(producers.NextProducerID, 1)
+	return nil
+}
+
+// InitProducerID assigns a new producer id to an idempotent producer. The id is
+// persisted before being returned, so that it's never reused after a restart.
+//
+// Transactional producers (non empty transactional id) keep the same producer id,
+// while their epoch is bumped on every call: older producer instances are fenced
+// and their ongoing transaction is aborted.
+func (b *Broker) InitProducerID(transactionalID string) (uint64, uint16, error) {
+	if transactionalID != "" {
+		return b.transactions.initProducer(transactionalID)
+	}
+
+	id, err := b.allocateProducerID()
+	return id, 0, err
+}
+
+func (b *Broker) allocateProducerID() (uint64, error) {
+	b.producersMu.Lock()
+	defer b.producersMu.Unlock()
+
+	producers := brokerProducers{NextProducerID: b.nextProducerID + 1}
+
+	producersBytes, err := json.Marshal(&producers)
+	if err != nil {
+		return 0, err
+	}
+
+	producersPath := fmt.Sprintf("%s/producers.json", b.options.BasePath)
+	err = os.WriteFile(producersPath, producersBytes, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	id := b.nextProducerID
+	b.nextProducerID++
+
+	return id, nil
+}
+
+// checkSequences validates the sequences of the messages sent by idempotent producers.
+// Sequences already appended are marked as duplicates, while out of order sequences
+// and old (fenced) producer epochs are rejected. A new epoch must start from sequence 0.
+//
+// It returns the messages to be appended and the errors aligned with the messages.
+// Producer states are updated by appendBatch (see trackProducer) once appended.
+//
+// MUST be called while holding the partition lock.
+func (p *Partition) checkSequences(messages []*Message) ([]*Message, []error) {
+	accepted := make([]*Message, 0, len(messages))
+	errs := make([]error, len(messages))
+	pending := map[uint64]*producerState{}
+
+	for i, m := range messages {
+		if m.producerID == 0 {
+			accepted = append(accepted, m)
+			continue
+		}
+
+		last, ok := pending[m.producerID]
+		if !ok {
+			last = p.producers[m.producerID]
+		}
+
+		switch {
+		case last == nil || m.producerEpoch > last.Epoch:
+			if m.sequence != 0 {
+				errs[i] = errors.New(protocol.ErrOutOfOrderSequence)
+				continue
+			}
+		case m.producerEpoch < last.Epoch:
+			errs[i] = errors.New(protocol.ErrInvalidProducerEpoch)
+			continue
+		case m.sequence <= last.LastSequence:
+			m.duplicate = true
+			continue
+		case m.sequence != last.LastSequence+1:
+			errs[i] = errors.New(protocol.ErrOutOfOrderSequence)
+			continue
+		}
+
+		pending[m.producerID] = &producerState{Epoch: m.producerEpoch, LastSequence: m.sequence}
+		accepted = append(accepted, m)
+	}
+
+	return accepted, errs
+}
+
+// splitByProducer splits the messages in runs of consecutive messages having the
+// same producer id and epoch, since every batch holds a single producer.
+func splitByProducer(messages []*Message) [][]*Message {
+	runs := [][]*Message{}
+
+	start := 0
+	for i := 1; i <= len(messages); i++ {
+		if i < len(messages) && messages[i].producerID == messages[start].producerID &&
+			messages[i].producerEpoch == messages[start].producerEpoch {
+			continue
+		}
+
+		runs = append(runs, messages[start:i])
+		start = i
+	}
+
+	return runs
+}
+
+// trackProducer stores the last sequence of an idempotent producer
+// after one of its batches is appended (or replayed from the log).
+//
+// MUST be called while holding the partition lock.
+func (p *Partition) trackProducer(producerID uint64, producerEpoch uint16, lastSequence uint32) {
+	p.producers[producerID] = &producerState{Epoch: producerEpoch, LastSequence: lastSequence}
+	p.producersChanged = true
+}
+
+// restoreProducers rebuilds the idempotent producers states from the checkpoint taken
+// at the given offset, replaying the headers of the batches appended after it.
+//
+// The checkpoint is ignored if the log ends before its offset (unflushed messages
+// lost by a crash), since it may hold sequences that were never persisted.
+func (p *Partition) restoreProducers(checkpoint map[uint64]*producerState, offset uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset > p.getNextOffset() {
+		slog.Warn("producers checkpoint ahead of the log, rebuilding from the log",
+			"topic", p.topicName,
+			"partition", p.num,
+			"checkpoint_offset", offset,
+			"next_offset", p.getNextOffset(),
+		)
+
+		checkpoint, offset = nil, 0
+	}
+
+	maps.Copy(p.producers, checkpoint)
+
+	for _, segment := range p.segments {
+		if segment.nextOffset <= offset {
+			continue
+		}
+
+		err := segment.scanHeaders(func(header *batchHeader, _ int64) error {
+			// batches written before v4 have no sequences,
+			// their producers are in the checkpoint only
+			if header.baseOffset < offset || header.magic < recordMagicV4 ||
+				header.producerID == 0 || header.isControl() {
+				return nil
+			}
+
+			p.trackProducer(header.producerID, header.producerEpoch, header.lastSequence())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	p.producersChanged = false
+	return nil
+}
+
+// producersCheckpoint returns a copy of the idempotent producers states, along with
+// the partition next offset: the states cover all the batches before it.
+func (p *Partition) producersCheckpoint() (map[uint64]*producerState, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.producersChanged = false
+	return maps.Clone(p.producers), p.getNextOffset()
+}
+
+// hasProducersChanged reports whether the idempotent producers states
+// changed since the last checkpoint.
+func (p *Partition) hasProducersChanged() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.producersChanged
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"godel/options"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRestoreProducers(t *testing.T) {
+	topicOptions := &options.TopicOptions{NumPartitions: 1, SegmentBytes: 1 << 20}
+
+	tests := []struct {
+		name       string
+		checkpoint map[uint64]*producerState
+		offset     uint64
+		want       map[uint64]*producerState
+	}{
+		{
+			name: "no checkpoint",
+			want: map[uint64]*producerState{
+				1: {Epoch: 0, LastSequence: 2},
+				2: {Epoch: 0, LastSequence: 0},
+			},
+		},
+		{
+			name: "batches after the checkpoint are replayed",
+			checkpoint: map[uint64]*producerState{
+				1: {Epoch: 0, LastSequence: 1},
+				3: {Epoch: 1, LastSequence: 5},
+			},
+			offset: 2,
+			want: map[uint64]*producerState{
+				1: {Epoch: 0, LastSequence: 2},
+				2: {Epoch: 0, LastSequence: 0},
+				3: {Epoch: 1, LastSequence: 5},
+			},
+		},
+		{
+			name: "checkpoint ahead of the log is ignored",
+			checkpoint: map[uint64]*producerState{
+				1: {Epoch: 0, LastSequence: 9},
+				3: {Epoch: 1, LastSequence: 5},
+			},
+			offset: 100,
+			want: map[uint64]*producerState{
+				1: {Epoch: 0, LastSequence: 2},
+				2: {Epoch: 0, LastSequence: 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			brokerOptions := &options.BrokerOptions{BasePath: t.TempDir()}
+
+			err := os.Mkdir(filepath.Join(brokerOptions.BasePath, "topic"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			partition, err := newPartition(0, "topic", topicOptions, brokerOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// producers interleaved in the same push are split in batches at offsets 0, 2 and 3
+			errs, err := partition.push([]*Message{
+				NewMessage(0, []byte("k"), []byte("a")).WithProducer(1, 0, 0),
+				NewMessage(0, []byte("k"), []byte("b")).WithProducer(1, 0, 1),
+				NewMessage(0, []byte("k"), []byte("c")).WithProducer(2, 0, 0),
+				NewMessage(0, []byte("k"), []byte("d")).WithProducer(1, 0, 2),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range errs {
+				if errs[i] != nil {
+					t.Fatalf("push() message %d error = %v", i, errs[i])
+				}
+			}
+
+			for _, segment := range partition.segments {
+				segment.close()
+			}
+
+			partition, err = loadPartition(0, "topic", topicOptions, brokerOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				for _, segment := range partition.segments {
+					segment.close()
+				}
+			}()
+
+			err = partition.restoreProducers(tt.checkpoint, tt.offset)
+			if err != nil {
+				t.Fatalf("restoreProducers() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(partition.producers, tt.want) {
+				t.Errorf("producers = %v, want %v", partition.producers, tt.want)
+			}
+
+			// a retried message is detected after the restore
+			retried := NewMessage(0, []byte("k"), []byte("d")).WithProducer(1, 0, 2)
+			_, errs = partition.checkSequences([]*Message{retried})
+			if errs[0] != nil || !retried.duplicate {
+				t.Errorf("retried message duplicate = %v, error = %v, want a duplicate", retried.duplicate, errs[0])
+			}
+		})
+	}
+}
@@ -3,9 +3,14 @@ package broker
 import (
 	"encoding/binary"
 	"fmt"
+	"godel/internal/protocol"
+	"godel/options"
 	"io"
+	"log/slog"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,222 +32,496 @@ func (e *appendError) isMaxSizeReached() bool {
 	return e.err == errMaxSizeReached
 }
 
+// CorruptRecordError is returned when a record read from a segment
+// log file is malformed or doesn't match its checksum.
+type CorruptRecordError struct {
+	Topic     string
+	Partition uint32
+	Offset    uint64
+	Reason    string
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("%s: topic %s, partition %v, offset %v: %s",
+		protocol.ErrCorruptRecord, e.Topic, e.Partition, e.Offset, e.Reason)
+}
+
 type Segment struct {
+	basePath   string
+	topicName  string
+	partition  uint32
 	baseOffset uint64
 	nextOffset uint64
 	logFile    *os.File
+	index      *offsetIndex
+	timeIndex  *timeIndex
 	currSize   int64
 	maxSize    int64
 	capped     bool
+
+	// max message timestamp in the segment
+	maxTimestamp uint64
+
+	// time the last batch was appended, the log file
+	// modification time when the segment is loaded
+	maxAppendTime uint64
+
+	indexIntervalBytes int64
+	bytesSinceIndex    int64
+
+	// size of the log file already synced to disk, atomic since
+	// it's updated by flush while holding only the read lock
+	flushedSize atomic.Int64
+
+	// guards the segment files while they are being swapped by compaction
+	mu sync.RWMutex
 }
 
-// newSegment initializes a segment by opening the file descriptor to the segment log file.
-func newSegment(basePath, topicName string, partition uint32, baseOffset uint64, maxSize int64) (*Segment, error) {
-	logFileName := strconv.Itoa(int(baseOffset)) + ".log"
-	logFilePath := fmt.Sprintf("%s/%s/%v/%s", basePath, topicName, partition, logFileName)
+// segmentFilePath returns the path of a segment file with the given extension
+// (e.g. log, index), named after the segment base offset.
+func segmentFilePath(basePath, topicName string, partition uint32, baseOffset uint64, ext string) string {
+	fileName := strconv.Itoa(int(baseOffset)) + "." + ext
+	return fmt.Sprintf("%s/%s/%v/%s", basePath, topicName, partition, fileName)
+}
 
-	file, err := os.OpenFile(logFilePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+// newSegment initializes a segment by opening the file descriptors
+// to the segment log file and to its sparse offset and time indexes.
+func newSegment(basePath, topicName string, partition uint32, baseOffset uint64, topicOptions *options.TopicOptions) (*Segment, error) {
+	indexIntervalBytes := topicOptions.IndexIntervalBytes
+	if indexIntervalBytes <= 0 {
+		indexIntervalBytes = options.DefaultIndexIntervalBytes
+	}
+
+	segment := &Segment{
+		basePath:           basePath,
+		topicName:          topicName,
+		partition:          partition,
+		baseOffset:         baseOffset,
+		nextOffset:         baseOffset,
+		currSize:           0,
+		maxSize:            topicOptions.SegmentBytes,
+		capped:             false,
+		indexIntervalBytes: indexIntervalBytes,
+	}
+
+	err := segment.openFiles()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Segment{
-		baseOffset: baseOffset,
-		nextOffset: baseOffset,
-		logFile:    file,
-		currSize:   0,
-		maxSize:    maxSize,
-		capped:     false,
-	}, nil
+	return segment, nil
 }
 
-func loadSegment(basePath, topicName string, partition uint32, baseOffset uint64, maxSize int64) (*Segment, error) {
-	segment, err := newSegment(basePath, topicName, partition, baseOffset, maxSize)
+func (s *Segment) filePath(ext string) string {
+	return segmentFilePath(s.basePath, s.topicName, s.partition, s.baseOffset, ext)
+}
+
+// openFiles opens the segment log file and its indexes.
+func (s *Segment) openFiles() error {
+	file, err := os.OpenFile(s.filePath("log"), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	index, err := openOffsetIndex(s.filePath("index"))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	timeIndex, err := openTimeIndex(s.filePath("timeindex"))
+	if err != nil {
+		index.close()
+		file.Close()
+		return err
+	}
+
+	s.logFile = file
+	s.index = index
+	s.timeIndex = timeIndex
+	return nil
+}
+
+// loadSegment opens an existing segment and loads its offsets and size.
+//
+// When truncateInvalidTail is true (active segment) a partially written or
+// corrupted tail is truncated to the last valid record instead of failing.
+func loadSegment(basePath, topicName string, partition uint32, baseOffset uint64, topicOptions *options.TopicOptions, truncateInvalidTail bool) (*Segment, error) {
+	segment, err := newSegment(basePath, topicName, partition, baseOffset, topicOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	err = segment.loadOffsetsAndSizes()
+	err = segment.loadOffsetsAndSizes(truncateInvalidTail)
 	if err != nil {
+		segment.close()
 		return nil, err
 	}
 
 	return segment, nil
 }
 
-func (s *Segment) loadOffsetsAndSizes() error {
+// loadOffsetsAndSizes scans the whole log file to compute the segment
+// offsets and size. While scanning, the expected sparse indexes are
+// computed too: if an index file is missing or stale it gets rebuilt.
+//
+// If truncateInvalidTail is true, the log file is truncated at the first
+// incomplete or invalid batch when the file ends within it (a write interrupted
+// by a crash). Invalid batches followed by other batches are never truncated
+// as that would drop valid records: an error is returned instead.
+func (s *Segment) loadOffsetsAndSizes(truncateInvalidTail bool) error {
+	info, err := s.logFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	fileSize := info.Size()
 	pos := int64(0)
-	var baseOffset uint64
-	var nextOffset uint64
+	nextOffset := s.baseOffset
 	var currSize int64
 
+	expectedIndex := []offsetIndexEntry{}
+	expectedTimeIndex := []timeIndexEntry{}
+	var bytesSinceIndex int64
+	var maxTimestamp uint64
+
 	for {
-		messageOffsetBuf := make([]byte, 8)
-		_, err := s.logFile.ReadAt(messageOffsetBuf, pos+4)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+		header, err := readBatchHeader(s.logFile, pos)
+		if err == io.EOF {
+			break
+		}
 
-			return err
+		// read the whole batch to verify its checksum
+		if err == nil {
+			batchBuf := make([]byte, header.size)
+			_, err = s.logFile.ReadAt(batchBuf, pos)
+			if err == nil {
+				_, _, err = deserializeBatch(batchBuf)
+			}
 		}
 
-		messageSizeBuf := make([]byte, 4)
-		_, err = s.logFile.ReadAt(messageSizeBuf, pos)
-		if err != nil {
-			if err == io.EOF {
-				break
+		isTail := err == io.ErrUnexpectedEOF || header != nil && pos+int64(header.size) >= fileSize
+		if err != nil && truncateInvalidTail && isTail {
+			err = s.truncate(pos, s.corruptRecordError(nextOffset, err))
+			if err != nil {
+				return err
 			}
 
-			return err
+			break
+		}
+		if err != nil {
+			return s.corruptRecordError(nextOffset, err)
 		}
 
-		messageOffset := binary.BigEndian.Uint64(messageOffsetBuf)
-		messageSize := binary.BigEndian.Uint32(messageSizeBuf)
-
-		if pos == 0 {
-			baseOffset = messageOffset
+		if bytesSinceIndex >= s.indexIntervalBytes {
+			expectedIndex = append(expectedIndex, offsetIndexEntry{
+				relativeOffset: uint32(header.baseOffset - s.baseOffset),
+				position:       pos,
+			})
+			expectedTimeIndex = append(expectedTimeIndex, timeIndexEntry{
+				timestamp:      maxTimestamp,
+				relativeOffset: uint32(header.baseOffset - s.baseOffset),
+			})
+			bytesSinceIndex = 0
 		}
 
-		nextOffset = messageOffset + 1
-		currSize += int64(messageSize)
+		nextOffset = header.lastOffset() + 1
+		currSize += int64(header.size)
+		bytesSinceIndex += int64(header.size)
+		maxTimestamp = max(maxTimestamp, header.maxTimestamp)
 
-		pos += int64(messageSize)
+		pos += int64(header.size)
 	}
 
-	s.baseOffset = baseOffset
 	s.nextOffset = nextOffset
 	s.currSize = currSize
+	s.flushedSize.Store(currSize)
+	s.bytesSinceIndex = bytesSinceIndex
+	s.maxTimestamp = maxTimestamp
+	s.maxAppendTime = uint64(info.ModTime().Unix())
+
+	if !s.index.matches(expectedIndex) {
+		slog.Warn("segment index missing or stale, rebuilding",
+			"segment", s.baseOffset,
+			"entries", len(expectedIndex),
+		)
+
+		err := s.index.rewrite(expectedIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !s.timeIndex.matches(expectedTimeIndex) {
+		slog.Warn("segment time index missing or stale, rebuilding",
+			"segment", s.baseOffset,
+			"entries", len(expectedTimeIndex),
+		)
+
+		err := s.timeIndex.rewrite(expectedTimeIndex)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *Segment) close() error {
-	return s.logFile.Close()
+// truncate drops everything in the log file after the given position.
+func (s *Segment) truncate(pos int64, reason *CorruptRecordError) error {
+	info, err := s.logFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	slog.Warn("truncating invalid segment tail",
+		"topic", s.topicName,
+		"partition", s.partition,
+		"segment", s.baseOffset,
+		"position", pos,
+		"dropped_bytes", info.Size()-pos,
+		"reason", reason.Reason,
+	)
+
+	return s.logFile.Truncate(pos)
 }
 
-func (s *Segment) delete(basePath, topicName string, partition uint32) error {
-	err := s.logFile.Close()
+func (s *Segment) close() error {
+	err := s.index.close()
 	if err != nil {
 		return err
 	}
 
-	logFileName := strconv.Itoa(int(s.baseOffset)) + ".log"
-	logFilePath := fmt.Sprintf("%s/%s/%v/%s", basePath, topicName, partition, logFileName)
-
-	err = os.Remove(logFilePath)
+	err = s.timeIndex.close()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return s.logFile.Close()
 }
 
-// append serializes the message and sets its offset based on the segment next
-// available offset. Then it appends it to the segment log.
-//
-// Returns the message offset and an error.
-func (s *Segment) append(message *Message) (uint64, *appendError) {
-	message.offset = s.nextOffset
-	blob := message.serialize()
+func (s *Segment) delete() error {
+	err := s.close()
+	if err != nil {
+		return err
+	}
 
-	offset, appendErr := s.appendBlob(blob)
-	if appendErr != nil {
-		return 0, appendErr
+	err = os.Remove(s.filePath("log"))
+	if err != nil {
+		return err
 	}
 
-	if offset != message.offset {
-		return 0, &appendError{err: errMaxSizeReached}
+	for _, ext := range []string{"index", "timeindex"} {
+		err = os.Remove(s.filePath(ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 
-	return offset, nil
+	return nil
 }
 
-// appendBlob works like Append, but requires an already serialized message.
+// appendBlob appends an already serialized record batch to the segment log.
 //
-// It sets the message offset in the blob but does not set the offset in the message object,
-// so it must be set manually after the function is executed.
+// It sets the base offset in the blob but does not set the offsets in the message objects,
+// so they must be set manually after the function is executed.
 //
-// Returns the message offset and an error.
+// Returns the batch base offset and an error.
 func (s *Segment) appendBlob(blob []byte) (uint64, *appendError) {
 	if len(blob)+int(s.currSize) > int(s.maxSize) {
 		return 0, &appendError{err: errMaxSizeReached}
 	}
 
-	newOffsetBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(newOffsetBuf, s.nextOffset)
+	binary.BigEndian.PutUint64(blob[4:12], s.nextOffset)
+
+	header, err := parseBatchHeader(blob)
+	if err != nil {
+		return 0, &appendError{err: err.Error()}
+	}
 
-	copy(blob[4:12], newOffsetBuf)
+	position := s.currSize
 
-	_, err := s.logFile.Write(blob)
+	_, err = s.logFile.Write(blob)
 	if err != nil {
 		return 0, &appendError{err: err.Error()}
 	}
 
+	// add a sparse index entry every index.interval.bytes
+	if s.bytesSinceIndex >= s.indexIntervalBytes {
+		err = s.index.append(offsetIndexEntry{
+			relativeOffset: uint32(s.nextOffset - s.baseOffset),
+			position:       position,
+		})
+		if err != nil {
+			return 0, &appendError{err: err.Error()}
+		}
+
+		err = s.timeIndex.append(timeIndexEntry{
+			timestamp:      s.maxTimestamp,
+			relativeOffset: uint32(s.nextOffset - s.baseOffset),
+		})
+		if err != nil {
+			return 0, &appendError{err: err.Error()}
+		}
+
+		s.bytesSinceIndex = 0
+	}
+
 	offset := s.nextOffset
-	s.nextOffset++
+	s.nextOffset = header.lastOffset() + 1
 	s.currSize += int64(len(blob))
+	s.bytesSinceIndex += int64(len(blob))
+	s.maxTimestamp = max(s.maxTimestamp, header.maxTimestamp)
+	s.maxAppendTime = uint64(time.Now().Unix())
 
 	return offset, nil
 }
 
-// getMessage efficiently scans the log file to extract the message at the given offset.
+// getBatch efficiently scans the log file to extract the batch containing the given offset.
+// The scan starts from the nearest position found in the sparse offset index.
+//
+// Only the messages starting from the requested offset are returned. If the offset was
+// removed by compaction the batch containing the next available message is returned.
 //
-// Returns a *Message and an error
-func (s *Segment) getMessage(offset uint64) (*Message, error) {
+// Returns the batch messages and an error
+func (s *Segment) getBatch(offset uint64) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	pos := int64(0)
+	if offset > s.baseOffset {
+		pos = s.index.lookup(uint32(offset - s.baseOffset))
+	}
 
 	for {
-		messageOffsetBuf := make([]byte, 8)
-		_, err := s.logFile.ReadAt(messageOffsetBuf, pos+4)
-		if err != nil {
+		header, err := readBatchHeader(s.logFile, pos)
+		if err == io.EOF {
 			return nil, err
 		}
+		if err != nil {
+			return nil, s.corruptRecordError(offset, err)
+		}
+
+		if header.lastOffset() >= offset {
+			batchBuf := make([]byte, header.size)
+			_, err = s.logFile.ReadAt(batchBuf, pos)
+			if err != nil {
+				return nil, s.corruptRecordError(offset, err)
+			}
+
+			_, messages, err := deserializeBatch(batchBuf)
+			if err != nil {
+				return nil, s.corruptRecordError(offset, err)
+			}
+
+			for i := range messages {
+				if messages[i].offset >= offset {
+					return messages[i:], nil
+				}
+			}
+		}
 
-		messageSizeBuf := make([]byte, 4)
-		_, err = s.logFile.ReadAt(messageSizeBuf, pos)
+		pos += int64(header.size)
+	}
+}
+
+// scanHeaders calls fn for the header of every batch of the log file, along with
+// the batch position. Unlike scan, the records are not read.
+func (s *Segment) scanHeaders(fn func(header *batchHeader, pos int64) error) error {
+	pos := int64(0)
+
+	for pos < s.currSize {
+		header, err := readBatchHeader(s.logFile, pos)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return nil, err
+			return s.corruptRecordError(s.nextOffset, err)
+		}
+
+		err = fn(header, pos)
+		if err != nil {
+			return err
 		}
 
-		messageOffset := binary.BigEndian.Uint64(messageOffsetBuf)
-		messageSize := binary.BigEndian.Uint32(messageSizeBuf)
+		pos += int64(header.size)
+	}
+
+	return nil
+}
+
+// getOffsetByTimestamp returns the offset of the first message having a
+// timestamp greater or equal to the requested one. The scan starts from
+// the nearest entry found in the sparse time index.
+//
+// Returns false if no such message exists in the segment.
+func (s *Segment) getOffsetByTimestamp(timestamp uint64) (uint64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.nextOffset == s.baseOffset || s.maxTimestamp < timestamp {
+		return 0, false, nil
+	}
+
+	pos := s.index.lookup(s.timeIndex.lookup(timestamp))
 
-		if messageOffset == offset {
-			messageBuf := make([]byte, messageSize)
-			_, err = s.logFile.ReadAt(messageBuf, pos)
+	for {
+		header, err := readBatchHeader(s.logFile, pos)
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, s.corruptRecordError(s.nextOffset, err)
+		}
+
+		if header.maxTimestamp >= timestamp {
+			batchBuf := make([]byte, header.size)
+			_, err = s.logFile.ReadAt(batchBuf, pos)
 			if err != nil {
-				return nil, err
+				return 0, false, s.corruptRecordError(header.baseOffset, err)
 			}
 
-			msg, err := deserializeMessage(messageBuf)
+			_, messages, err := deserializeBatch(batchBuf)
 			if err != nil {
-				return msg, err
+				return 0, false, s.corruptRecordError(header.baseOffset, err)
 			}
 
-			return msg, nil
+			for i := range messages {
+				if messages[i].timestamp >= timestamp {
+					return messages[i].offset, true, nil
+				}
+			}
 		}
 
-		pos += int64(messageSize)
+		pos += int64(header.size)
 	}
 }
 
+// runMaxRetentionMilliCheck reports whether the newest message of the segment was appended
+// before the retention time. The append time is used regardless of message.timestamp.type,
+// since create times set by producers may be far in the past (expiring the segment too
+// early) or in the future (never expiring it).
 func (s *Segment) runMaxRetentionMilliCheck(now uint64, mrm int64) (bool, error) {
-	if mrm < 0 {
+	if mrm < 0 || s.currSize == 0 {
 		return false, nil
 	}
 
-	lastMessage, err := s.getMessage(s.nextOffset - 1)
-	if err != nil {
-		return false, err
-	}
-
-	// fmt.Println(time.Unix(int64(now), 0))
-	// fmt.Println())
-	fmt.Println(time.Duration(mrm) * time.Millisecond)
-
-	messageAge := time.Unix(int64(now), 0).Sub(time.Unix(int64(lastMessage.timestamp), 0))
+	messageAge := time.Unix(int64(now), 0).Sub(time.Unix(int64(s.maxAppendTime), 0))
 	expired := messageAge > time.Duration(mrm)*time.Millisecond
 
-	// expired := now-lastMessage.timestamp > uint64(mrm)
 	return expired, nil
 }
+
+func (s *Segment) corruptRecordError(offset uint64, err error) *CorruptRecordError {
+	reason := err.Error()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		reason = "unexpected end of segment"
+	}
+
+	return &CorruptRecordError{
+		Topic:     s.topicName,
+		Partition: s.partition,
+		Offset:    offset,
+		Reason:    reason,
+	}
+}
@@ -0,0 +1,267 @@
+package broker
+
+import (
+	"errors"
+	"godel/options"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeTestSegment writes batches of two messages to a new segment, with an
+// index entry for every batch but the first. Returns the batch positions.
+func writeTestSegment(t *testing.T, basePath string, topicOptions *options.TopicOptions, batches int) []int64 {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Join(basePath, "topic", "0"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segment, err := newSegment(basePath, "topic", 0, 0, topicOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segment.close()
+
+	positions := make([]int64, 0, batches)
+	for i := range batches {
+		messages := []*Message{
+			{offset: 0, key: []byte("key"), payload: []byte("first"), timestamp: uint64(1000 + i)},
+			{offset: 1, key: []byte("key"), payload: []byte("second"), timestamp: uint64(1000 + i)},
+		}
+
+		positions = append(positions, segment.currSize)
+
+		_, appendErr := segment.appendBlob(serializeBatch(0, messages))
+		if appendErr != nil {
+			t.Fatal(appendErr)
+		}
+	}
+
+	return positions
+}
+
+func TestLoadSegmentTruncateInvalidTail(t *testing.T) {
+	topicOptions := &options.TopicOptions{SegmentBytes: 1 << 20, IndexIntervalBytes: 1}
+
+	tests := []struct {
+		name string
+		// corrupt changes the log file, given the batch positions
+		corrupt func(t *testing.T, file *os.File, positions []int64)
+		// wantBatches is the number of batches left, -1 if the load must fail
+		wantBatches int
+	}{
+		{
+			name: "cut in the size prefix",
+			corrupt: func(t *testing.T, file *os.File, positions []int64) {
+				truncateFile(t, file, positions[3]+2)
+			},
+			wantBatches: 3,
+		},
+		{
+			name: "cut in the body",
+			corrupt: func(t *testing.T, file *os.File, positions []int64) {
+				truncateFile(t, file, positions[3]+batchHeaderSizeV4+5)
+			},
+			wantBatches: 3,
+		},
+		{
+			name: "last record checksum mismatch",
+			corrupt: func(t *testing.T, file *os.File, positions []int64) {
+				flipByte(t, file, positions[3]+13)
+			},
+			wantBatches: 3,
+		},
+		{
+			name: "middle record checksum mismatch",
+			corrupt: func(t *testing.T, file *os.File, positions []int64) {
+				flipByte(t, file, positions[1]+13)
+			},
+			wantBatches: -1,
+		},
+		{
+			name:        "valid log",
+			corrupt:     func(*testing.T, *os.File, []int64) {},
+			wantBatches: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basePath := t.TempDir()
+			positions := writeTestSegment(t, basePath, topicOptions, 4)
+			logPath := segmentFilePath(basePath, "topic", 0, 0, "log")
+
+			file, err := os.OpenFile(logPath, os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.corrupt(t, file, positions)
+			file.Close()
+
+			info, err := os.Stat(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			corruptedSize := info.Size()
+
+			segment, err := loadSegment(basePath, "topic", 0, 0, topicOptions, true)
+
+			if tt.wantBatches < 0 {
+				var corruptErr *CorruptRecordError
+				if !errors.As(err, &corruptErr) {
+					t.Fatalf("loadSegment() error = %v, want a CorruptRecordError", err)
+				}
+
+				info, err := os.Stat(logPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Size() != corruptedSize {
+					t.Errorf("log size = %d, want %d (not truncated)", info.Size(), corruptedSize)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("loadSegment() error = %v", err)
+			}
+			defer segment.close()
+
+			wantSize := info.Size()
+			if tt.wantBatches < len(positions) {
+				wantSize = positions[tt.wantBatches]
+			}
+
+			if segment.currSize != wantSize {
+				t.Errorf("currSize = %d, want %d", segment.currSize, wantSize)
+			}
+
+			if want := uint64(tt.wantBatches * 2); segment.nextOffset != want {
+				t.Errorf("nextOffset = %d, want %d", segment.nextOffset, want)
+			}
+
+			info, err = os.Stat(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != wantSize {
+				t.Errorf("log size = %d, want %d", info.Size(), wantSize)
+			}
+
+			wantIndex := []offsetIndexEntry{}
+			for i := 1; i < tt.wantBatches; i++ {
+				wantIndex = append(wantIndex, offsetIndexEntry{relativeOffset: uint32(i * 2), position: positions[i]})
+			}
+
+			if !reflect.DeepEqual(segment.index.entries, wantIndex) {
+				t.Errorf("index entries = %v, want %v", segment.index.entries, wantIndex)
+			}
+
+			// the rebuilt index must be on disk as well
+			index, err := openOffsetIndex(segmentFilePath(basePath, "topic", 0, 0, "index"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer index.close()
+
+			if !reflect.DeepEqual(index.entries, wantIndex) {
+				t.Errorf("index file entries = %v, want %v", index.entries, wantIndex)
+			}
+		})
+	}
+}
+
+func truncateFile(t *testing.T, file *os.File, size int64) {
+	t.Helper()
+
+	err := file.Truncate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flipByte(t *testing.T, file *os.File, pos int64) {
+	t.Helper()
+
+	b := make([]byte, 1)
+	_, err := file.ReadAt(b, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b[0] ^= 0xff
+
+	_, err = file.WriteAt(b, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunMaxRetentionMilliCheck(t *testing.T) {
+	topicOptions := &options.TopicOptions{SegmentBytes: 1 << 20, IndexIntervalBytes: 1}
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		// create time of the messages
+		timestamp uint64
+		// modification time of the log file before reloading the segment, zero to keep the segment open
+		appendTime time.Time
+		want       bool
+	}{
+		{name: "recent append", timestamp: uint64(now.Unix()), want: false},
+		{name: "old create time appended recently", timestamp: uint64(now.Add(-48 * time.Hour).Unix()), want: false},
+		{name: "old append after reload", timestamp: uint64(now.Unix()), appendTime: now.Add(-2 * time.Hour), want: true},
+		{name: "future create time appended long ago", timestamp: uint64(now.Add(48 * time.Hour).Unix()), appendTime: now.Add(-2 * time.Hour), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basePath := t.TempDir()
+
+			err := os.MkdirAll(filepath.Join(basePath, "topic", "0"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			segment, err := newSegment(basePath, "topic", 0, 0, topicOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, appendErr := segment.appendBlob(serializeBatch(0, []*Message{NewMessage(tt.timestamp, []byte("k"), []byte("v"))}))
+			if appendErr != nil {
+				t.Fatal(appendErr)
+			}
+
+			if !tt.appendTime.IsZero() {
+				segment.close()
+
+				err = os.Chtimes(segment.filePath("log"), time.Time{}, tt.appendTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				segment, err = loadSegment(basePath, "topic", 0, 0, topicOptions, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer segment.close()
+
+			got, err := segment.runMaxRetentionMilliCheck(uint64(now.Unix()), time.Hour.Milliseconds())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("runMaxRetentionMilliCheck() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,9 @@
 package broker
 
 import (
-	"bufio"
 	"errors"
 	"godel/internal/protocol"
-	"io"
+	"godel/options"
 	"log/slog"
 	"net"
 	"strconv"
@@ -12,11 +11,6 @@ import (
 	"time"
 )
 
-type writeResult struct {
-	Error         error
-	CorrelationID int32
-}
-
 func (b *Broker) runServer(port int) error {
 	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
@@ -37,92 +31,70 @@ func (b *Broker) runServer(port int) error {
 	}
 }
 
-func (b *Broker) handleConnection(conn net.Conn) {
-	defer func() {
-		err := conn.Close()
-		if err != nil {
-			slog.Error("failed to close connection", "error", err)
-		}
-	}()
-
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
-	responsesCh := make(chan *protocol.BaseResponse, 100)
-	resultsCh := make(chan *writeResult) // used to stop consumer on write error
-
-	for {
-		req, err := protocol.DeserializeRequest(reader)
-		if err == io.EOF {
-			slog.Debug("client disconnected, closing connection")
-			return
-
-		}
-		if err != nil {
-			slog.Error("failed to deserialize message, closing connection", "error", err)
-			return
-		}
-
-		// responses goroutine
-		go func() {
-			for resp := range responsesCh {
-				if err := writeFull(writer, resp.Serialize()); err != nil {
-					slog.Error("failed to send response", "cmd", resp.Cmd, "error", err)
-					resultsCh <- &writeResult{
-						Error:         err,
-						CorrelationID: resp.CorrelationID,
-					}
-					return
-				}
-				resultsCh <- &writeResult{
-					Error:         nil,
-					CorrelationID: resp.CorrelationID,
-				}
-			}
-		}()
+// apiVersions are the api versions supported for every command,
+// returned to the clients by CmdApiVersions.
+var apiVersions = []protocol.ApiVersion{
+	{Cmd: protocol.CmdProduce, MinVersion: protocol.ApiVersionJSON, MaxVersion: protocol.ApiVersionBinary},
+	{Cmd: protocol.CmdConsume, MinVersion: protocol.ApiVersionJSON, MaxVersion: protocol.ApiVersionBinary},
+	{Cmd: protocol.CmdListTopics},
+	{Cmd: protocol.CmdCreateConsumer},
+	{Cmd: protocol.CmdDeleteTopic},
+	{Cmd: protocol.CmdCommitOffset},
+	{Cmd: protocol.CmdHeartbeat},
+	{Cmd: protocol.CmdDeleteConsumer},
+	{Cmd: protocol.CmdListConsumerGroups},
+	{Cmd: protocol.CmdCreateTopics},
+	{Cmd: protocol.CmdGetConsumerGroup},
+	{Cmd: protocol.CmdListOffsets},
+	{Cmd: protocol.CmdInitProducerId},
+	{Cmd: protocol.CmdBeginTransaction},
+	{Cmd: protocol.CmdAddPartitionsToTxn},
+	{Cmd: protocol.CmdEndTransaction},
+	{Cmd: protocol.CmdApiVersions},
+	{Cmd: protocol.CmdFetch, MinVersion: protocol.ApiVersionJSON, MaxVersion: protocol.ApiVersionBinary},
+	{Cmd: protocol.CmdSyncGroup},
+	{Cmd: protocol.CmdCreateConsumerGroup},
+	{Cmd: protocol.CmdDeleteConsumerGroup},
+	{Cmd: protocol.CmdResetOffsets},
+}
 
-		// requests goroutine
-		go func(req *protocol.BaseRequest) {
-			responder := func(resp *protocol.BaseResponse) {
-				responsesCh <- resp
-			}
+func isApiVersionSupported(cmd, version int16) bool {
+	for _, v := range apiVersions {
+		if v.Cmd == cmd {
+			return version >= v.MinVersion && version <= v.MaxVersion
+		}
+	}
 
-			slog.Debug("received request", "cmd", req.Cmd)
-			respPayload, err := b.processRequest(req, responder, resultsCh)
-			if err != nil {
-				slog.Error("error while processing request", "error", err)
-				return
-			}
-			if respPayload == nil {
-				return
-			}
+	return false
+}
 
-			responsesCh <- &protocol.BaseResponse{
-				Cmd:           req.Cmd,
-				CorrelationID: req.CorrelationID,
-				Payload:       respPayload,
-			}
-		}(req)
+// processRequest dispatches the request to the handler of its api version.
+// Requests with an unknown command or an unsupported api version get a
+// protocol.RespError response, while CmdApiVersions is accepted with any
+// api version, so that clients can always discover the supported ones.
+func (b *Broker) processRequest(req *protocol.BaseRequest, conn *connection) ([]byte, error) {
+	if req.Cmd == protocol.CmdApiVersions {
+		return protocol.Serialize(protocol.RespApiVersions{ApiVersions: apiVersions})
 	}
-}
 
-func writeFull(w *bufio.Writer, data []byte) error {
-	if _, err := w.Write(data); err != nil {
-		return err
+	if !isApiVersionSupported(req.Cmd, req.ApiVersion) {
+		return protocol.Serialize(protocol.RespError{
+			ErrorCode:    protocol.ErrCodeUnsupportedVersion,
+			ErrorMessage: protocol.ErrUnsupportedVersion,
+		})
 	}
-	return w.Flush()
-}
 
-func (b *Broker) processRequest(req *protocol.BaseRequest, responder func(resp *protocol.BaseResponse), resultsCh chan *writeResult) ([]byte, error) {
 	switch req.ApiVersion {
-	case 0:
-		return b.processApiV0Request(req, responder, resultsCh)
+	case protocol.ApiVersionJSON:
+		return b.processApiV0Request(req, conn)
+	case protocol.ApiVersionBinary:
+		return b.processApiV1Request(req, conn)
 	default:
 		return nil, errors.New("unsupported api version")
 	}
 }
 
-func (b *Broker) processApiV0Request(r *protocol.BaseRequest, responder func(resp *protocol.BaseResponse), resultsCh chan *writeResult) ([]byte, error) {
+func (b *Broker) processApiV0Request(r *protocol.BaseRequest, conn *connection) ([]byte, error) {
 	switch r.Cmd {
 	case protocol.CmdCreateTopics:
 		req, err := protocol.Deserialize[protocol.ReqCreateTopics](r.Payload)
@@ -131,30 +103,8 @@ func (b *Broker) processApiV0Request(r *protocol.BaseRequest, responder func(res
 		}
 
 		return b.processCreateTopicsReq(req)
-	case protocol.CmdProduce:
-		req, err := protocol.Deserialize[protocol.ReqProduce](r.Payload)
-		if err != nil {
-			return nil, errors.New("failed to deserialize request")
-		}
-
-		return b.processProduceReq(req)
-	case protocol.CmdConsume:
-		req, err := protocol.Deserialize[protocol.ReqConsume](r.Payload)
-		if err != nil {
-			return nil, errors.New("failed to deserialize request")
-		}
-
-		resp := b.processConsumeReq(r.CorrelationID, req, responder, resultsCh)
-		if resp == nil {
-			return nil, nil
-		}
-
-		buf, err := protocol.Serialize(resp)
-		if err != nil {
-			return nil, err
-		}
-
-		return buf, nil
+	case protocol.CmdProduce, protocol.CmdConsume, protocol.CmdFetch:
+		return b.processDataRequest(r, conn)
 	case protocol.CmdDeleteConsumer:
 		req, err := protocol.Deserialize[protocol.ReqDeleteConsumer](r.Payload)
 		if err != nil {
@@ -284,21 +234,200 @@ func (b *Broker) processApiV0Request(r *protocol.BaseRequest, responder func(res
 		}
 
 		return buf, nil
+	case protocol.CmdListOffsets:
+		req, err := protocol.Deserialize[protocol.ReqListOffsets](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		resp := b.processListOffsetsReq(req)
+		if resp == nil {
+			return nil, nil
+		}
+		buf, err := protocol.Serialize(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	case protocol.CmdInitProducerId:
+		req, err := protocol.Deserialize[protocol.ReqInitProducerId](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		resp := b.processInitProducerIdReq(req)
+		buf, err := protocol.Serialize(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	case protocol.CmdBeginTransaction:
+		req, err := protocol.Deserialize[protocol.ReqBeginTransaction](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		err = b.BeginTransaction(req.TransactionalID, req.ProducerID, req.ProducerEpoch)
+		buf, err := protocol.Serialize(newRespTransaction(req.TransactionalID, err))
+		if err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	case protocol.CmdAddPartitionsToTxn:
+		req, err := protocol.Deserialize[protocol.ReqAddPartitionsToTxn](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		err = b.AddPartitionsToTransaction(req.TransactionalID, req.ProducerID, req.ProducerEpoch, req.Topic, req.Partitions...)
+		buf, err := protocol.Serialize(newRespTransaction(req.TransactionalID, err))
+		if err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	case protocol.CmdEndTransaction:
+		req, err := protocol.Deserialize[protocol.ReqEndTransaction](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		err = b.EndTransaction(req.TransactionalID, req.ProducerID, req.ProducerEpoch, req.Commit)
+		buf, err := protocol.Serialize(newRespTransaction(req.TransactionalID, err))
+		if err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	case protocol.CmdSyncGroup:
+		req, err := protocol.Deserialize[protocol.ReqSyncGroup](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		return protocol.Serialize(b.processSyncGroupReq(req))
+	case protocol.CmdCreateConsumerGroup:
+		req, err := protocol.Deserialize[protocol.ReqCreateConsumerGroup](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		return protocol.Serialize(b.processCreateConsumerGroupReq(req))
+	case protocol.CmdDeleteConsumerGroup:
+		req, err := protocol.Deserialize[protocol.ReqDeleteConsumerGroup](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		return protocol.Serialize(b.processDeleteConsumerGroupReq(req))
+	case protocol.CmdResetOffsets:
+		req, err := protocol.Deserialize[protocol.ReqResetOffsets](r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		return protocol.Serialize(b.processResetOffsetsReq(req))
 	default:
 		return nil, errors.New("unknonw command " + strconv.Itoa(int(r.Cmd)))
 	}
 }
 
+// processApiV1Request handles the requests with binary encoded payloads,
+// which exist only for produce, consume and fetch. Every other request is the same
+// as in api version 0.
+func (b *Broker) processApiV1Request(r *protocol.BaseRequest, conn *connection) ([]byte, error) {
+	switch r.Cmd {
+	case protocol.CmdProduce, protocol.CmdConsume, protocol.CmdFetch:
+		return b.processDataRequest(r, conn)
+	default:
+		return b.processApiV0Request(r, conn)
+	}
+}
+
+// processDataRequest handles produce, consume and fetch requests, whose
+// payloads are encoded according to the request api version.
+func (b *Broker) processDataRequest(r *protocol.BaseRequest, conn *connection) ([]byte, error) {
+	switch r.Cmd {
+	case protocol.CmdProduce:
+		req, err := protocol.DeserializeVersion[protocol.ReqProduce](r.ApiVersion, r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		return b.processProduceReq(r.ApiVersion, req)
+	case protocol.CmdConsume:
+		req, err := protocol.DeserializeVersion[protocol.ReqConsume](r.ApiVersion, r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		resp := b.processConsumeReq(r.CorrelationID, r.ApiVersion, req, conn)
+		if resp == nil {
+			return nil, nil
+		}
+
+		buf, err := protocol.SerializeVersion(r.ApiVersion, resp)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	case protocol.CmdFetch:
+		req, err := protocol.DeserializeVersion[protocol.ReqFetch](r.ApiVersion, r.Payload)
+		if err != nil {
+			return nil, errors.New("failed to deserialize request")
+		}
+
+		return protocol.SerializeVersion(r.ApiVersion, b.processFetchReq(req, conn))
+	default:
+		return nil, errors.New("unknown command")
+	}
+}
+
 func (b *Broker) processCreateTopicsReq(req *protocol.ReqCreateTopics) ([]byte, error) {
 	var resp protocol.RespCreateTopics
 	resp.Topics = make([]protocol.RespCreateTopicTopic, 0, len(req.Topics))
 
+	// topics are created in order, buffered so that
+	// the creation can complete after the timeout
+	errCh := make(chan error, len(req.Topics))
+
+	go func() {
+		for i := range req.Topics {
+			_, err := b.CreateTopic(req.Topics[i].Name, &req.Topics[i].Configs)
+			errCh <- err
+		}
+	}()
+
+	timeout := timeoutCh(req.TimeoutMs)
+	timedOut := false
+
 	for i := range req.Topics {
-		_, err := b.CreateTopic(req.Topics[i].Name, &req.Topics[i].Configs)
+		var err error
+		if !timedOut {
+			select {
+			case err = <-errCh:
+			case <-timeout:
+				timedOut = true
+			}
+		}
+
+		if timedOut {
+			resp.Topics = append(resp.Topics, protocol.RespCreateTopicTopic{
+				Name:         req.Topics[i].Name,
+				ErrorCode:    protocol.ErrCodeRequestTimedOut,
+				ErrorMessage: protocol.ErrRequestTimedOut,
+			})
+			continue
+		}
+
 		if err != nil {
 			resp.Topics = append(resp.Topics, protocol.RespCreateTopicTopic{
 				Name:         req.Topics[i].Name,
-				ErrorCode:    1,
+				ErrorCode:    protocol.ErrorCodeOf(err),
 				ErrorMessage: err.Error(),
 			})
 			continue
@@ -317,32 +446,117 @@ func (b *Broker) processCreateTopicsReq(req *protocol.ReqCreateTopics) ([]byte,
 	return respBuf, nil
 }
 
-func (b *Broker) processProduceReq(req *protocol.ReqProduce) ([]byte, error) {
+// timeoutCh returns a channel that fires once the request timeout expires.
+// Requests without a timeout (0) never time out.
+func timeoutCh(timeoutMs uint64) <-chan time.Time {
+	if timeoutMs == 0 {
+		return nil
+	}
+
+	return time.After(time.Duration(timeoutMs) * time.Millisecond)
+}
+
+func (b *Broker) processProduceReq(apiVersion int16, req *protocol.ReqProduce) ([]byte, error) {
 	var resp protocol.RespProduce
 	resp.Messages = make([]protocol.RespProduceMessage, 0, len(req.Messages))
 
+	messages := make([]*Message, 0, len(req.Messages))
 	for i := range req.Messages {
-		timestamp := uint64(time.Now().Unix())
-		message := NewMessage(timestamp, req.Messages[i].Key, req.Messages[i].Value)
+		// missing timestamps are set by the topic
+		message := NewMessage(req.Messages[i].Timestamp, req.Messages[i].Key, req.Messages[i].Value)
+		if req.Messages[i].Partition != nil {
+			message.WithPartition(*req.Messages[i].Partition)
+		}
 
-		offset, partition, err := b.Produce(req.Topic, message)
-		if err != nil {
+		if req.Messages[i].ProducerID != 0 {
+			message.WithProducer(req.Messages[i].ProducerID, req.Messages[i].ProducerEpoch, req.Messages[i].Sequence)
+		}
+
+		messages = append(messages, message.WithHeaders(req.Messages[i].Headers))
+	}
+
+	acks := protocol.AcksLeader
+	if req.Acks != nil {
+		acks = *req.Acks
+	}
+
+	// until replication exists, acks=all waits for the messages to be synced to disk
+	durable := req.Durable || acks == protocol.AcksAll
+
+	type produceResult struct {
+		errs []error
+		err  error
+	}
+
+	// buffered, so the append can complete after the timeout
+	resultCh := make(chan produceResult, 1)
+
+	go func() {
+		var result produceResult
+		if req.TransactionalID != "" {
+			result.errs, result.err = b.ProduceTransactional(req.TransactionalID, req.Topic, durable, messages...)
+		} else {
+			result.errs, result.err = b.Produce(req.Topic, durable, messages...)
+		}
+
+		resultCh <- result
+	}()
+
+	var result produceResult
+	select {
+	case result = <-resultCh:
+	case <-timeoutCh(req.TimeoutMs):
+		if acks == protocol.AcksNone {
+			return nil, nil
+		}
+
+		for i := range req.Messages {
 			resp.Messages = append(resp.Messages, protocol.RespProduceMessage{
 				Key:          string(req.Messages[i].Key),
-				ErrorCode:    1,
-				ErrorMessage: err.Error(),
+				ErrorCode:    protocol.ErrCodeRequestTimedOut,
+				ErrorMessage: protocol.ErrRequestTimedOut,
+			})
+		}
+
+		return protocol.SerializeVersion(apiVersion, resp)
+	}
+
+	if acks == protocol.AcksNone {
+		return nil, nil
+	}
+
+	for i := range messages {
+		messageErr := result.err
+		if messageErr == nil {
+			messageErr = result.errs[i]
+		}
+
+		if messageErr != nil {
+			resp.Messages = append(resp.Messages, protocol.RespProduceMessage{
+				Key:          string(req.Messages[i].Key),
+				ErrorCode:    protocol.ErrorCodeOf(messageErr),
+				ErrorMessage: messageErr.Error(),
+			})
+			continue
+		}
+
+		if messages[i].duplicate {
+			resp.Messages = append(resp.Messages, protocol.RespProduceMessage{
+				Key:       string(req.Messages[i].Key),
+				Partition: &messages[i].partition,
+				Duplicate: true,
 			})
 			continue
 		}
 
 		resp.Messages = append(resp.Messages, protocol.RespProduceMessage{
 			Key:       string(req.Messages[i].Key),
-			Partition: &partition,
-			Offset:    &offset,
+			Partition: &messages[i].partition,
+			Offset:    &messages[i].offset,
 		})
 	}
 
-	respBuf, err := protocol.Serialize(resp)
+	respBuf, err := protocol.SerializeVersion(apiVersion, resp)
 	if err != nil {
 		return nil, err
 	}
@@ -350,11 +564,11 @@ func (b *Broker) processProduceReq(req *protocol.ReqProduce) ([]byte, error) {
 	return respBuf, nil
 }
 
-func (b *Broker) processConsumeReq(cID int32, req *protocol.ReqConsume, responder func(resp *protocol.BaseResponse), resultsCh chan *writeResult) *protocol.RespConsume {
+func (b *Broker) processConsumeReq(cID int32, apiVersion int16, req *protocol.ReqConsume, conn *connection) *protocol.RespConsume {
 	topic, err := b.GetTopic(req.Topic)
 	if err != nil {
 		return &protocol.RespConsume{
-			ErrorCode:    1,
+			ErrorCode:    protocol.ErrorCodeOf(err),
 			ErrorMessage: err.Error(),
 		}
 	}
@@ -362,27 +576,30 @@ func (b *Broker) processConsumeReq(cID int32, req *protocol.ReqConsume, responde
 	consumer, err := topic.getConsumer(req.Group, req.ID)
 	if err != nil {
 		return &protocol.RespConsume{
-			ErrorCode:    1,
+			ErrorCode:    protocol.ErrorCodeOf(err),
 			ErrorMessage: err.Error(),
 		}
 	}
 
 	b.RUnlock()
 
-	onMessage := func(message *Message) error {
+	onMessages := func(messages []*Message) error {
 		r := protocol.RespConsume{
-			Messages: []protocol.RespConsumeMessage{
-				{
-					Key:       string(message.key),
-					Group:     req.Group,
-					Partition: &message.partition,
-					Offset:    &message.offset,
-					Payload:   message.payload,
-				},
-			},
+			Messages: make([]protocol.RespConsumeMessage, 0, len(messages)),
+		}
+
+		for _, message := range messages {
+			r.Messages = append(r.Messages, protocol.RespConsumeMessage{
+				Key:       string(message.key),
+				Group:     req.Group,
+				Partition: &message.partition,
+				Offset:    &message.offset,
+				Payload:   message.payload,
+				Headers:   message.headers,
+			})
 		}
 
-		respBuf, err := protocol.Serialize(r)
+		respBuf, err := protocol.SerializeVersion(apiVersion, r)
 		if err != nil {
 			return err
 		}
@@ -393,21 +610,18 @@ func (b *Broker) processConsumeReq(cID int32, req *protocol.ReqConsume, responde
 			Payload:       respBuf,
 		}
 
-		responder(&resp)
-
-		writeResult := <-resultsCh
-		if writeResult.Error != nil {
-			slog.Debug("write error, stopping consumer", "corrID", cID, "offet", message.offset, "err", err)
-			return writeResult.Error
+		if err := conn.write(&resp); err != nil {
+			slog.Debug("write error, stopping consumer", "corrID", cID, "offset", messages[len(messages)-1].offset, "err", err)
+			return err
 		}
 
 		return nil
 	}
 
-	err = consumer.start(cID, onMessage, responder)
+	err = consumer.start(cID, req.StartOffsets, onMessages, conn.send, conn.closed())
 	if err != nil {
 		return &protocol.RespConsume{
-			ErrorCode:    1,
+			ErrorCode:    protocol.ErrorCodeOf(err),
 			ErrorMessage: err.Error(),
 		}
 	}
@@ -415,6 +629,67 @@ func (b *Broker) processConsumeReq(cID int32, req *protocol.ReqConsume, responde
 	return nil
 }
 
+// processFetchReq reads the requested partition, waiting up to MaxWaitMs
+// (at most options.MaxFetchWaitMs) for MinBytes to be available, or until
+// the connection is closed (see Partition.fetch).
+func (b *Broker) processFetchReq(req *protocol.ReqFetch, conn *connection) *protocol.RespFetch {
+	resp := &protocol.RespFetch{
+		Topic:     req.Topic,
+		Partition: req.Partition,
+		Messages:  []protocol.RespConsumeMessage{},
+	}
+
+	topic, err := b.GetTopic(req.Topic)
+	if err != nil {
+		b.RUnlock()
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	partition, err := topic.getPartition(req.Partition)
+
+	// the broker must not be locked while waiting for messages
+	b.RUnlock()
+
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	maxBytes := req.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = options.DefaultFetchMaxBytes
+	}
+
+	readCommitted := req.IsolationLevel == options.IsolationLevelReadCommitted
+	maxWait := time.Duration(min(req.MaxWaitMs, uint64(options.MaxFetchWaitMs))) * time.Millisecond
+
+	messages, nextOffset, err := partition.fetch(req.Offset, readCommitted, req.MinBytes, maxBytes, maxWait, conn.closed())
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	for _, message := range messages {
+		resp.Messages = append(resp.Messages, protocol.RespConsumeMessage{
+			Key:       string(message.key),
+			Partition: &message.partition,
+			Offset:    &message.offset,
+			Payload:   message.payload,
+			Headers:   message.headers,
+		})
+	}
+
+	resp.NextOffset = nextOffset
+	resp.HighWatermark = partition.highWatermark()
+	resp.LastStableOffset = partition.lastStableOffset()
+
+	return resp
+}
+
 func (b *Broker) processDeleteConsumerReq(req *protocol.ReqDeleteConsumer) *protocol.RespDeleteConsumer {
 	resp := &protocol.RespDeleteConsumer{
 		ID:    req.ID,
@@ -423,16 +698,19 @@ func (b *Broker) processDeleteConsumerReq(req *protocol.ReqDeleteConsumer) *prot
 	}
 
 	topic, err := b.GetTopic(req.Topic)
-	defer b.RUnlock()
+
+	// the broker must not be locked while rebalancing
+	b.RUnlock()
+
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
 
-	err = topic.removeConsumer(req.Group, req.ID)
+	err = topic.leaveGroup(req.Group, req.ID)
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
@@ -448,7 +726,7 @@ func (b *Broker) processListConsumerGroupsReq(req *protocol.ReqListConsumerGroup
 	topic, err := b.GetTopic(req.Topic)
 	defer b.RUnlock()
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
@@ -474,6 +752,7 @@ func (b *Broker) processListConsumerGroupsReq(req *protocol.ReqListConsumerGroup
 
 			consumers = append(consumers, protocol.Consumer{
 				ID:         groups[k].consumers[i].id,
+				InstanceID: groups[k].consumers[i].options.GroupInstanceID,
 				Partitions: consumerPartitions,
 			})
 		}
@@ -494,17 +773,27 @@ func (b *Broker) processCommitOffsetRequest(req *protocol.ReqCommitOffset) *prot
 		Offset:    &req.Offset,
 	}
 
+	if req.TransactionalID != "" {
+		err := b.AddOffsetToTransaction(req.TransactionalID, req.ProducerID, req.ProducerEpoch, req.Topic, req.Group, req.Partition, req.Offset)
+		if err != nil {
+			resp.ErrorCode = protocol.ErrorCodeOf(err)
+			resp.ErrorMessage = err.Error()
+		}
+
+		return resp
+	}
+
 	topic, err := b.GetTopic(req.Topic)
 	defer b.RUnlock()
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
 
-	err = topic.commitOffset(req.Group, req.Partition, req.Offset)
+	err = topic.commitOffset(req.Group, req.ConsumerID, req.Generation, req.Partition, req.Offset)
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
@@ -520,14 +809,14 @@ func (b *Broker) processHeartbeatRequest(req *protocol.ReqHeartbeat) *protocol.R
 	topic, err := b.GetTopic(req.Topic)
 	defer b.RUnlock()
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
 
 	err = topic.heartbeat(req.Group, req.ConsumerID)
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
@@ -578,22 +867,57 @@ func (b *Broker) processReqCreateConsumer(req *protocol.ReqCreateConsumer) *prot
 	}
 
 	topic, err := b.GetTopic(req.Topic)
-	defer b.RUnlock()
+
+	// the broker must not be locked while rebalancing
+	b.RUnlock()
+
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
 
 	consumer, err := topic.createConsumer(req.Group, req.ID, &req.Options)
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
 
 	resp.ID = consumer.id
 
+	consumer.group.lock()
+	consumer.lock()
+	resp.Generation = consumer.group.generation
+	resp.Partitions = partitionNums(consumer.partitions)
+	consumer.unlock()
+	consumer.group.unlock()
+
+	return resp
+}
+
+// processSyncGroupReq acknowledges the partitions revoked to the consumer
+// by a rebalance and returns the partitions it owns.
+func (b *Broker) processSyncGroupReq(req *protocol.ReqSyncGroup) *protocol.RespSyncGroup {
+	resp := &protocol.RespSyncGroup{
+		Generation: req.Generation,
+	}
+
+	topic, err := b.GetTopic(req.Topic)
+	defer b.RUnlock()
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	resp.Partitions, err = topic.syncConsumer(req.Group, req.ConsumerID, req.Generation)
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
 	return resp
 }
 
@@ -604,7 +928,7 @@ func (b *Broker) processDeleteTopicReq(req *protocol.ReqDeleteTopic) *protocol.R
 
 	err := b.deleteTopic(req.Topic)
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
@@ -616,19 +940,23 @@ func (b *Broker) processGetConsumerGroupReq(req *protocol.ReqGetConsumerGroup) *
 	resp := &protocol.RespGetConsumerGroup{}
 
 	topic, err := b.GetTopic(req.Topic)
+	defer b.RUnlock()
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
 
 	cg, err := topic.getConsumerGroup(req.Name)
 	if err != nil {
-		resp.ErrorCode = 1
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
 		resp.ErrorMessage = err.Error()
 		return resp
 	}
 
+	cg.lock()
+	defer cg.unlock()
+
 	consumers := make([]protocol.Consumer, len(cg.consumers))
 	for i := range cg.consumers {
 		partitions := make([]uint32, len(cg.consumers[i].partitions))
@@ -638,6 +966,7 @@ func (b *Broker) processGetConsumerGroupReq(req *protocol.ReqGetConsumerGroup) *
 
 		consumers[i] = protocol.Consumer{
 			ID:         cg.consumers[i].id,
+			InstanceID: cg.consumers[i].options.GroupInstanceID,
 			Partitions: partitions,
 		}
 	}
@@ -656,5 +985,225 @@ func (b *Broker) processGetConsumerGroupReq(req *protocol.ReqGetConsumerGroup) *
 		Offsets:   offsets,
 	}
 
+	for _, lag := range cg.lags() {
+		resp.Partitions = append(resp.Partitions, protocol.ConsumerGroupPartition{
+			Partition:       lag.partition,
+			LogStartOffset:  lag.logStart,
+			LogEndOffset:    lag.logEnd,
+			CommittedOffset: lag.committed,
+			Lag:             lag.lag,
+			ConsumerID:      lag.consumerID,
+		})
+
+		resp.TotalLag += lag.lag
+	}
+
+	return resp
+}
+
+func (b *Broker) processListOffsetsReq(req *protocol.ReqListOffsets) *protocol.RespListOffsets {
+	resp := &protocol.RespListOffsets{
+		Topic:      req.Topic,
+		Partitions: []protocol.RespListOffsetsPartition{},
+	}
+
+	topic, err := b.GetTopic(req.Topic)
+	defer b.RUnlock()
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	partitions := req.Partitions
+	if len(partitions) == 0 {
+		for i := range topic.partitions {
+			partitions = append(partitions, topic.partitions[i].num)
+		}
+	}
+
+	for _, num := range partitions {
+		offset, err := topic.listOffset(num, req.Timestamp)
+		if err != nil {
+			resp.Partitions = append(resp.Partitions, protocol.RespListOffsetsPartition{
+				Partition:    num,
+				ErrorCode:    protocol.ErrorCodeOf(err),
+				ErrorMessage: err.Error(),
+			})
+			continue
+		}
+
+		resp.Partitions = append(resp.Partitions, protocol.RespListOffsetsPartition{
+			Partition: num,
+			Offset:    &offset,
+		})
+	}
+
 	return resp
 }
+
+func (b *Broker) processInitProducerIdReq(req *protocol.ReqInitProducerId) *protocol.RespInitProducerId {
+	resp := &protocol.RespInitProducerId{}
+
+	id, epoch, err := b.InitProducerID(req.TransactionalID)
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	resp.ProducerID = id
+	resp.ProducerEpoch = epoch
+	return resp
+}
+
+func newRespTransaction(transactionalID string, err error) *protocol.RespTransaction {
+	resp := &protocol.RespTransaction{
+		TransactionalID: transactionalID,
+	}
+
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+	}
+
+	return resp
+}
+
+func (b *Broker) processCreateConsumerGroupReq(req *protocol.ReqCreateConsumerGroup) *protocol.RespCreateConsumerGroup {
+	resp := &protocol.RespCreateConsumerGroup{
+		Topic: req.Topic,
+		Group: req.Group,
+	}
+
+	topic, err := b.GetTopic(req.Topic)
+	defer b.RUnlock()
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	err = topic.createConsumerGroup(req.Group)
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	return resp
+}
+
+func (b *Broker) processDeleteConsumerGroupReq(req *protocol.ReqDeleteConsumerGroup) *protocol.RespDeleteConsumerGroup {
+	resp := &protocol.RespDeleteConsumerGroup{
+		Topic: req.Topic,
+		Group: req.Group,
+	}
+
+	topic, err := b.GetTopic(req.Topic)
+	defer b.RUnlock()
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	err = topic.deleteConsumerGroup(req.Group, req.Force)
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	return resp
+}
+
+func (b *Broker) processResetOffsetsReq(req *protocol.ReqResetOffsets) *protocol.RespResetOffsets {
+	resp := &protocol.RespResetOffsets{
+		Topic:  req.Topic,
+		Group:  req.Group,
+		DryRun: req.DryRun,
+	}
+
+	topic, err := b.GetTopic(req.Topic)
+	defer b.RUnlock()
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	target, err := newResetTarget(req)
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	resets, err := topic.resetOffsets(req.Group, req.Partitions, target, req.DryRun, req.Force)
+	if err != nil {
+		resp.ErrorCode = protocol.ErrorCodeOf(err)
+		resp.ErrorMessage = err.Error()
+		return resp
+	}
+
+	for _, reset := range resets {
+		resp.Partitions = append(resp.Partitions, protocol.RespResetOffsetsPartition{
+			Partition:      reset.partition,
+			PreviousOffset: reset.previous,
+			Offset:         reset.offset,
+		})
+	}
+
+	return resp
+}
+
+// newResetTarget returns the target of the reset request,
+// that must have exactly one of them.
+func newResetTarget(req *protocol.ReqResetOffsets) (resetTarget, error) {
+	var targets []resetTarget
+
+	if req.ToEarliest {
+		targets = append(targets, func(p *Partition, _ uint64) (uint64, error) {
+			return p.getBaseOffset(), nil
+		})
+	}
+
+	if req.ToLatest {
+		targets = append(targets, func(p *Partition, _ uint64) (uint64, error) {
+			return p.getNextOffset(), nil
+		})
+	}
+
+	if req.ToOffset != nil {
+		targets = append(targets, func(_ *Partition, _ uint64) (uint64, error) {
+			return *req.ToOffset, nil
+		})
+	}
+
+	if req.ToTimestamp != nil {
+		if *req.ToTimestamp < 0 {
+			return nil, errors.New(protocol.ErrInvalidTimestamp)
+		}
+
+		targets = append(targets, func(p *Partition, _ uint64) (uint64, error) {
+			return p.getOffsetByTimestamp(uint64(*req.ToTimestamp))
+		})
+	}
+
+	if req.ShiftBy != nil {
+		targets = append(targets, func(_ *Partition, current uint64) (uint64, error) {
+			if *req.ShiftBy < 0 && uint64(-*req.ShiftBy) > current {
+				return 0, nil
+			}
+
+			return uint64(int64(current) + *req.ShiftBy), nil
+		})
+	}
+
+	if len(targets) != 1 {
+		return nil, errors.New(protocol.ErrInvalidRequest + ": exactly one reset target is required")
+	}
+
+	return targets[0], nil
+}
@@ -2,6 +2,13 @@ package broker
 
 type topicState struct {
 	ConsumerGroups []topicStateGroup `json:"groups"`
+
+	// partition -> producer id -> last sequence
+	Producers map[uint32]map[uint64]*producerState `json:"producers,omitempty"`
+
+	// partition -> next offset when the producers checkpoint was taken,
+	// later batches are replayed from the log when loading
+	ProducersOffsets map[uint32]uint64 `json:"producersOffsets,omitempty"`
 }
 
 type topicStateGroup struct {
@@ -8,7 +8,9 @@ import (
 	"godel/options"
 	"log/slog"
 	"os"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -19,6 +21,7 @@ type Topic struct {
 	options        *options.TopicOptions
 	brokerOptions  *options.BrokerOptions
 	consumerGroups map[string]*consumerGroup
+	partitioner    Partitioner
 
 	mu sync.Mutex
 	// consumers     []*TopicConsumer
@@ -65,6 +68,11 @@ func (t *Topic) loadOptions() error {
 func newTopic(name string, topicOptions *options.TopicOptions, brokerOptions *options.BrokerOptions) (*Topic, error) {
 	topicPath := fmt.Sprintf("%s/%s", brokerOptions.BasePath, name)
 
+	// an unset timestamp type means CreateTime
+	if tt := topicOptions.MessageTimestampType; tt != "" && !tt.Valid() {
+		return nil, fmt.Errorf("%s: unknown message.timestamp.type %q", protocol.ErrInvalidConfig, tt)
+	}
+
 	if _, err := os.Stat(topicPath); os.IsNotExist(err) {
 		err = os.Mkdir(topicPath, 0755)
 		if err != nil {
@@ -83,6 +91,7 @@ func newTopic(name string, topicOptions *options.TopicOptions, brokerOptions *op
 		options:        topicOptions,
 		brokerOptions:  brokerOptions,
 		consumerGroups: map[string]*consumerGroup{},
+		partitioner:    NewPartitioner(topicOptions.Partitioner),
 	}
 
 	err := topic.persistOptions()
@@ -153,6 +162,8 @@ func loadTopic(name string, brokerOptions *options.BrokerOptions, newTopicOption
 		}
 	}
 
+	topic.partitioner = NewPartitioner(topic.options.Partitioner)
+
 	partitionsNames, err := listSubfolders(topicPath)
 	if err != nil {
 		return nil, err
@@ -199,6 +210,16 @@ func loadTopic(name string, brokerOptions *options.BrokerOptions, newTopicOption
 		return nil, err
 	}
 
+	// rebuild the last sequences of the idempotent producers
+	for i := range topic.partitions {
+		num := topic.partitions[i].num
+
+		err = topic.partitions[i].restoreProducers(topicState.Producers[num], topicState.ProducersOffsets[num])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// load existing consumer groups with their offsets
 	if len(topicState.ConsumerGroups) > 0 {
 		groupNames := make([]string, len(topicState.ConsumerGroups))
@@ -228,22 +249,134 @@ func (t *Topic) Options() *options.TopicOptions {
 	return t.options
 }
 
-func (t *Topic) produce(message *Message) (uint64, uint32, error) {
-	partitionNumber := DefaultPartitioner([]byte(message.key), t.options.NumPartitions)
+// produce appends the messages to their partitions, writing a single
+// record batch for each partition. Messages order is preserved inside
+// every partition.
+//
+// When durable is true, the partitions are synced to disk before returning.
+// If syncing fails the messages get the error even though they were appended
+// (see Partition.push).
+// The idempotent producers sequences are stored in the batches, and
+// periodically checkpointed in the topic state (see checkpointProducers).
+//
+// Messages larger than max.message.bytes are rejected.
+//
+// The returned errors are aligned with the messages. On success the
+// messages offsets and partitions are set.
+func (t *Topic) produce(messages []*Message, durable bool) []error {
+	errs := make([]error, len(messages))
+
+	batches := map[uint32][]*Message{}
+	indexes := map[uint32][]int{}
+	order := []uint32{}
+
+	now := uint64(time.Now().Unix())
+
+	accepted := make([]*Message, 0, len(messages))
+	acceptedIndexes := make([]int, 0, len(messages))
+
+	for i := range messages {
+		if maxBytes := t.options.MaxMessageBytes; maxBytes > 0 && messages[i].size() > maxBytes {
+			errs[i] = errors.New(protocol.ErrMessageTooLarge)
+			continue
+		}
+
+		errs[i] = t.setTimestamp(messages[i], now)
+		if errs[i] != nil {
+			continue
+		}
+
+		accepted = append(accepted, messages[i])
+		acceptedIndexes = append(acceptedIndexes, i)
+	}
+
+	partitionNumbers := t.partitioner.Partition(accepted, t.options.NumPartitions)
+
+	for j, partitionNumber := range partitionNumbers {
+		if _, ok := batches[partitionNumber]; !ok {
+			order = append(order, partitionNumber)
+		}
+
+		batches[partitionNumber] = append(batches[partitionNumber], accepted[j])
+		indexes[partitionNumber] = append(indexes[partitionNumber], acceptedIndexes[j])
+	}
+
+	for _, partitionNumber := range order {
+		var pushErrs []error
 
-	var partition *Partition
+		partition, err := t.getPartition(partitionNumber)
+		if err == nil {
+			pushErrs, err = partition.push(batches[partitionNumber])
+		}
+
+		if err == nil && durable {
+			err = partition.flush()
+		}
+
+		for j, i := range indexes[partitionNumber] {
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+
+			errs[i] = pushErrs[j]
+		}
+	}
+
+	return errs
+}
+
+// setTimestamp sets the message timestamp according to message.timestamp.type.
+// Missing create times (0) are set to now. Create times too far from now
+// (max.timestamp.difference.ms) are rejected.
+func (t *Topic) setTimestamp(message *Message, now uint64) error {
+	if t.options.MessageTimestampType == options.TimestampTypeLogAppendTime || message.timestamp == 0 {
+		message.timestamp = now
+		return nil
+	}
+
+	maxDifference := t.options.MaxTimestampDifferenceMilli
+	if maxDifference < 0 {
+		return nil
+	}
+
+	difference := time.Unix(int64(message.timestamp), 0).Sub(time.Unix(int64(now), 0)).Abs()
+	if difference > time.Duration(maxDifference)*time.Millisecond {
+		return errors.New(protocol.ErrInvalidTimestamp)
+	}
+
+	return nil
+}
+
+func (t *Topic) getPartition(num uint32) (*Partition, error) {
 	for i := range t.partitions {
-		if t.partitions[i].num == partitionNumber {
-			partition = t.partitions[i]
+		if t.partitions[i].num == num {
+			return t.partitions[i], nil
 		}
 	}
 
-	offset, err := partition.push(message)
+	return nil, errors.New(protocol.ErrPartitionNotFound)
+}
+
+// listOffset returns the offset of the first message of the partition
+// having a timestamp greater or equal to the requested one.
+//
+// The special timestamps protocol.ListOffsetsLatest and protocol.ListOffsetsEarliest
+// return respectively the partition next offset and base offset.
+func (t *Topic) listOffset(num uint32, timestamp int64) (uint64, error) {
+	partition, err := t.getPartition(num)
 	if err != nil {
-		return 0, 0, nil
+		return 0, err
 	}
 
-	return offset, partitionNumber, nil
+	switch timestamp {
+	case protocol.ListOffsetsLatest:
+		return partition.getNextOffset(), nil
+	case protocol.ListOffsetsEarliest:
+		return partition.getBaseOffset(), nil
+	default:
+		return partition.getOffsetByTimestamp(uint64(timestamp))
+	}
 }
 
 func (t *Topic) createConsumerGroups(names []string, offsets []map[uint32]uint64) ([]*consumerGroup, error) {
@@ -314,6 +447,8 @@ func (t *Topic) createConsumer(group, id string, opts *options.ConsumerOptions)
 		id = group + "-" + uuid.NewString()
 	}
 
+	options.MergeConsumerOptions(opts, options.DefaulcConsumerOption())
+
 	isGroupNew := false
 	if _, ok := t.consumerGroups[group]; !ok {
 		isGroupNew = true
@@ -323,17 +458,56 @@ func (t *Topic) createConsumer(group, id string, opts *options.ConsumerOptions)
 		}
 	}
 
-	t.consumerGroups[group].lock()
-	defer t.consumerGroups[group].unlock()
+	cg := t.consumerGroups[group]
+
+	if opts.GroupInstanceID != "" {
+		consumer, err := cg.rejoin(id, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if consumer != nil {
+			t.startHeartbeatChecks(group, consumer)
+
+			slog.Info("static consumer rejoined, partitions kept without rebalancing",
+				"group", group,
+				"instance", opts.GroupInstanceID,
+				"consumer", consumer.id,
+			)
+			return consumer, nil
+		}
+	}
+
+	cg.lock()
 
-	consumer, err := t.consumerGroups[group].apendConsumer(id, opts)
+	consumer, err := cg.apendConsumer(id, opts)
 	if err != nil {
-		if len(t.consumerGroups[group].consumers) == 0 && isGroupNew {
+		if len(cg.consumers) == 0 && isGroupNew {
 			delete(t.consumerGroups, group)
 		}
+		cg.unlock()
 		return nil, err
 	}
 
+	t.startHeartbeatChecks(group, consumer)
+
+	slog.Info("consumer crated, consumer group rebalancing",
+		"group", group,
+		"consumers", len(cg.consumers),
+		"consumer", consumer.id,
+	)
+
+	cg.unlock()
+
+	cg.rebalance()
+
+	slog.Info("rebalancing done", "group", group)
+	return consumer, nil
+}
+
+// startHeartbeatChecks removes the consumer from the group once its
+// session times out.
+func (t *Topic) startHeartbeatChecks(group string, consumer *consumer) {
 	consumer.startHearbeatChecks(func(id string) {
 		slog.Info("consumer expired, removing", "group", group, "consumer", id)
 		err := t.removeConsumer(group, id)
@@ -341,20 +515,29 @@ func (t *Topic) createConsumer(group, id string, opts *options.ConsumerOptions)
 			slog.Error("failed to remove consumer after heartbeat check", "group", group, "consumer", id, "error", err)
 		}
 	})
+}
 
-	slog.Info("consumer crated, consumer group rebalancing",
-		"group", group,
-		"consumers", len(t.consumerGroups[group].consumers),
-		"consumer", consumer.id,
-	)
+// leaveGroup removes the consumer from the group, unless it's a static member:
+// static consumers are only stopped, keeping their partitions until they rejoin
+// or their session times out.
+func (t *Topic) leaveGroup(group string, id string) error {
+	consumer, err := t.getConsumer(group, id)
+	if err != nil {
+		return err
+	}
 
-	// should show a DEBUG log because the new consumer is not listening yet,
-	// however for now rebalancing is fast so the new consumer doesn't need a notif.
-	t.consumerGroups[group].sendRebalanceNotifs()
-	t.consumerGroups[group].rebalance()
+	if consumer.options.GroupInstanceID == "" {
+		return t.removeConsumer(group, id)
+	}
 
-	slog.Info("rebalancing done", "group", group)
-	return consumer, nil
+	consumer.stop()
+
+	slog.Info("static consumer left, waiting for it to rejoin",
+		"group", group,
+		"instance", consumer.options.GroupInstanceID,
+		"consumer", id,
+	)
+	return nil
 }
 
 func (t *Topic) removeConsumer(group string, id string) error {
@@ -366,36 +549,34 @@ func (t *Topic) removeConsumer(group string, id string) error {
 		return errors.New(protocol.ErrMissingConsumerId)
 	}
 
-	if _, ok := t.consumerGroups[group]; !ok {
+	cg, ok := t.consumerGroups[group]
+	if !ok {
 		return errors.New(protocol.ErrConsumerGroupNotFound)
 	}
 
-	// sending rebalance notif to all consumers excluding the removed one
-	// (should send a removal notif to the removed consumer?)
-	excluding := []string{id}
-	t.consumerGroups[group].sendRebalanceNotifs(excluding...)
-	t.consumerGroups[group].stop()
+	cg.lock()
 
-	t.consumerGroups[group].lock()
-	defer t.consumerGroups[group].unlock()
-
-	err := t.consumerGroups[group].removeConsumer(id)
+	err := cg.removeConsumer(id)
 	if err != nil {
+		cg.unlock()
 		return err
 	}
 
-	if len(t.consumerGroups[group].consumers) == 0 {
+	consumers := len(cg.consumers)
+	cg.unlock()
+
+	if consumers == 0 {
 		slog.Warn("consumer group has zero consumers", "group", group)
 		return nil
 	}
 
 	slog.Info("consumer removed, consumer group rebalancing",
 		"group", group,
-		"consumers", len(t.consumerGroups[group].consumers),
+		"consumers", consumers,
 		"consumer", id,
 	)
 
-	t.consumerGroups[group].rebalance()
+	cg.rebalance()
 
 	slog.Info("rebalancing done", "group", group)
 	return nil
@@ -421,7 +602,165 @@ func (t *Topic) getConsumerGroup(name string) (*consumerGroup, error) {
 	return nil, errors.New(protocol.ErrConsumerGroupNotFound)
 }
 
-func (t *Topic) commitOffset(group string, partition uint32, offset uint64) error {
+func (t *Topic) createConsumerGroup(name string) error {
+	if name == "" {
+		return errors.New(protocol.ErrMissingGroupName)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.consumerGroups[name]; ok {
+		return errors.New(protocol.ErrConsumerGroupAlreadyExists)
+	}
+
+	_, err := t.createConsumerGroups([]string{name}, nil)
+	return err
+}
+
+// deleteConsumerGroup deletes the group and its committed offsets. Groups with
+// consumers are deleted only when forced, removing the consumers.
+func (t *Topic) deleteConsumerGroup(name string, force bool) error {
+	if name == "" {
+		return errors.New(protocol.ErrMissingGroupName)
+	}
+
+	cg, err := t.getConsumerGroup(name)
+	if err != nil {
+		return err
+	}
+
+	cg.lock()
+
+	if len(cg.consumers) > 0 && !force {
+		cg.unlock()
+		return errors.New(protocol.ErrConsumerGroupNotEmpty)
+	}
+
+	cg.delete()
+	cg.unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.consumerGroups, name)
+
+	slog.Info("consumer group deleted", "topic", t.name, "group", name)
+	return t.persistState()
+}
+
+// resetTarget returns the offset a partition is reset to,
+// given the offset the group reads it from.
+type resetTarget func(partition *Partition, current uint64) (uint64, error)
+
+// offsetReset is the offset a group reads a partition from, before and after a reset.
+type offsetReset struct {
+	partition uint32
+	previous  uint64
+	offset    uint64
+}
+
+// resetOffsets resets the group offsets of the partitions (all of them if none
+// is given) to the target, clamped to the partitions range. Groups with consumers
+// are reset only when forced, and the consumers reading the partitions are moved
+// to the new offsets. When dryRun is true the offsets are only returned.
+func (t *Topic) resetOffsets(group string, partitions []uint32, target resetTarget, dryRun, force bool) ([]offsetReset, error) {
+	if group == "" {
+		return nil, errors.New(protocol.ErrMissingGroupName)
+	}
+
+	cg, err := t.getConsumerGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(partitions) == 0 {
+		partitions = partitionNums(t.partitions)
+		slices.Sort(partitions)
+	}
+
+	cg.lock()
+
+	if len(cg.consumers) > 0 && !force {
+		cg.unlock()
+		return nil, errors.New(protocol.ErrConsumerGroupNotEmpty)
+	}
+
+	resets := make([]offsetReset, 0, len(partitions))
+	for _, num := range partitions {
+		partition, err := t.getPartition(num)
+		if err != nil {
+			cg.unlock()
+			return nil, err
+		}
+
+		current := cg.nextOffset(partition)
+
+		offset, err := target(partition, current)
+		if err != nil {
+			cg.unlock()
+			return nil, err
+		}
+
+		offset = max(partition.getBaseOffset(), min(offset, partition.getNextOffset()))
+
+		resets = append(resets, offsetReset{
+			partition: num,
+			previous:  current,
+			offset:    offset,
+		})
+	}
+
+	if dryRun {
+		cg.unlock()
+		return resets, nil
+	}
+
+	changes := map[*consumer]map[*Partition]uint64{}
+	for _, reset := range resets {
+		partition, _ := t.getPartition(reset.partition)
+		cg.setNextOffset(partition, reset.offset)
+
+		for _, consumer := range cg.consumers {
+			consumer.lock()
+			if slices.Contains(consumer.partitions, partition) {
+				if changes[consumer] == nil {
+					changes[consumer] = map[*Partition]uint64{}
+				}
+				changes[consumer][partition] = reset.offset
+			}
+			consumer.unlock()
+		}
+	}
+
+	t.mu.Lock()
+	err = t.persistState()
+	t.mu.Unlock()
+
+	cg.unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the readers are restarted from the new offsets
+	for consumer, offsets := range changes {
+		revoked := make([]uint32, 0, len(offsets))
+		for partition := range offsets {
+			revoked = append(revoked, partition.num)
+		}
+
+		consumer.changePartitions(revoked, offsets)
+	}
+
+	slog.Info("consumer group offsets reset", "topic", t.name, "group", group, "partitions", len(resets))
+	return resets, nil
+}
+
+// commitOffset commits the offset of the group partition. When the generation
+// is not 0, the offset is committed only if the consumer owns the partition in
+// the current group generation.
+func (t *Topic) commitOffset(group, consumerID string, generation uint32, partition uint32, offset uint64) error {
 	if group == "" {
 		return errors.New(protocol.ErrMissingGroupName)
 	}
@@ -433,6 +772,13 @@ func (t *Topic) commitOffset(group string, partition uint32, offset uint64) erro
 	t.consumerGroups[group].lock()
 	defer t.consumerGroups[group].unlock()
 
+	if generation != 0 {
+		err := t.consumerGroups[group].checkGeneration(consumerID, generation, partition)
+		if err != nil {
+			return err
+		}
+	}
+
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -449,6 +795,25 @@ func (t *Topic) commitOffset(group string, partition uint32, offset uint64) erro
 	return nil
 }
 
+// syncConsumer acknowledges the partitions revoked to the consumer in the
+// generation and returns the partitions it owns (see consumerGroup.sync).
+func (t *Topic) syncConsumer(group, id string, generation uint32) ([]uint32, error) {
+	if group == "" {
+		return nil, errors.New(protocol.ErrMissingGroupName)
+	}
+
+	if id == "" {
+		return nil, errors.New(protocol.ErrMissingConsumerId)
+	}
+
+	cg, ok := t.consumerGroups[group]
+	if !ok {
+		return nil, errors.New(protocol.ErrConsumerGroupNotFound)
+	}
+
+	return cg.sync(id, generation)
+}
+
 func (t *Topic) heartbeat(group, id string) error {
 	if group == "" {
 		return errors.New(protocol.ErrMissingGroupName)
@@ -490,7 +855,17 @@ func (t *Topic) persistState() error {
 	statePath := fmt.Sprintf("%s/%s/state.json", t.brokerOptions.BasePath, t.name)
 
 	state := topicState{
-		ConsumerGroups: []topicStateGroup{},
+		ConsumerGroups:   []topicStateGroup{},
+		Producers:        map[uint32]map[uint64]*producerState{},
+		ProducersOffsets: map[uint32]uint64{},
+	}
+
+	for i := range t.partitions {
+		producers, offset := t.partitions[i].producersCheckpoint()
+		if len(producers) > 0 {
+			state.Producers[t.partitions[i].num] = producers
+			state.ProducersOffsets[t.partitions[i].num] = offset
+		}
 	}
 
 	for i := range t.consumerGroups {
@@ -513,6 +888,22 @@ func (t *Topic) persistState() error {
 	return nil
 }
 
+// checkpointProducers persists the topic state if the idempotent producers states
+// changed since the last checkpoint. Batches appended after the checkpoint are
+// replayed when the topic is loaded, so checkpoints are not needed on every produce.
+func (t *Topic) checkpointProducers() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.partitions {
+		if t.partitions[i].hasProducersChanged() {
+			return t.persistState()
+		}
+	}
+
+	return nil
+}
+
 func (t *Topic) delete() error {
 	slog.Info("deleting topic", "topic", t.name)
 
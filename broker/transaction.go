@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Transaction markers are written by the coordinator in every partition of a
+// transaction when it ends. They are stored as a control batch holding a single
+// record, whose key is the marker type.
+type controlMarker uint16
+
+const (
+	controlMarkerAbort  controlMarker = 0
+	controlMarkerCommit controlMarker = 1
+)
+
+const errInvalidControlRecord = "invalid.control.record"
+
+// abortedTxn is the offsets range of an aborted transaction, used
+// by read_committed consumers to skip the aborted messages.
+type abortedTxn struct {
+	producerID  uint64
+	firstOffset uint64
+	lastOffset  uint64 // offset of the abort marker
+}
+
+func newControlMessage(producerID uint64, producerEpoch uint16, marker controlMarker) *Message {
+	return &Message{
+		key:           binary.BigEndian.AppendUint16(nil, uint16(marker)),
+		timestamp:     uint64(time.Now().Unix()),
+		producerID:    producerID,
+		producerEpoch: producerEpoch,
+		transactional: true,
+		control:       true,
+	}
+}
+
+func (m *Message) controlMarker() (controlMarker, error) {
+	if len(m.key) != 2 {
+		return 0, errors.New(errInvalidControlRecord)
+	}
+
+	return controlMarker(binary.BigEndian.Uint16(m.key)), nil
+}
+
+// trackTransaction updates the open and aborted transactions after a batch
+// (starting with the given message) is appended.
+//
+// MUST be called while holding the partition lock.
+func (p *Partition) trackTransaction(first *Message, baseOffset, lastOffset uint64) {
+	if !first.transactional {
+		return
+	}
+
+	if !first.control {
+		if _, ok := p.ongoingTxns[first.producerID]; !ok {
+			p.ongoingTxns[first.producerID] = baseOffset
+		}
+
+		return
+	}
+
+	firstOffset, ok := p.ongoingTxns[first.producerID]
+	if !ok {
+		// marker written again while recovering the transaction
+		return
+	}
+
+	delete(p.ongoingTxns, first.producerID)
+
+	if marker, _ := first.controlMarker(); marker == controlMarkerAbort {
+		p.abortedTxns = append(p.abortedTxns, abortedTxn{
+			producerID:  first.producerID,
+			firstOffset: firstOffset,
+			lastOffset:  lastOffset,
+		})
+	}
+}
+
+// writeMarker ends the transaction of the producer in the partition
+// by appending a commit or abort marker. The marker is synced to disk.
+func (p *Partition) writeMarker(producerID uint64, producerEpoch uint16, marker controlMarker) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.appendBatch([]*Message{newControlMessage(producerID, producerEpoch, marker)})
+	if err != nil {
+		return err
+	}
+
+	return p.flushSegments()
+}
+
+// lastStableOffset returns the first offset of the oldest open transaction,
+// or the next offset if no transaction is open. read_committed consumers
+// can't read past it, since the outcome of the transaction is still unknown.
+func (p *Partition) lastStableOffset() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lso := p.getNextOffset()
+	for _, firstOffset := range p.ongoingTxns {
+		lso = min(lso, firstOffset)
+	}
+
+	return lso
+}
+
+// isAborted reports whether the message belongs to an aborted transaction.
+func (p *Partition) isAborted(m *Message) bool {
+	if !m.transactional {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, txn := range p.abortedTxns {
+		if txn.producerID == m.producerID && m.offset >= txn.firstOffset && m.offset <= txn.lastOffset {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadTransactions rebuilds the open and aborted transactions by scanning the
+// batch headers of the log. Only control batches are read entirely.
+func (p *Partition) loadTransactions() error {
+	for _, segment := range p.segments {
+		err := segment.scanHeaders(func(header *batchHeader, pos int64) error {
+			if !header.isTransactional() {
+				return nil
+			}
+
+			first := &Message{
+				producerID:    header.producerID,
+				producerEpoch: header.producerEpoch,
+				transactional: true,
+			}
+
+			if header.isControl() {
+				blob := make([]byte, header.size)
+				_, err := segment.logFile.ReadAt(blob, pos)
+				if err != nil {
+					return segment.corruptRecordError(header.baseOffset, err)
+				}
+
+				_, messages, err := deserializeBatch(blob)
+				if err != nil {
+					return segment.corruptRecordError(header.baseOffset, err)
+				}
+
+				first = messages[0]
+			}
+
+			p.trackTransaction(first, header.baseOffset, header.lastOffset())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -45,13 +45,11 @@ func (c *GodelClient) ListTopics(nameFilter ...string) ([]*Topic, error) {
 	if resp.ErrorCode == 0 {
 		topics := make([]*Topic, len(resp.Topics))
 		for i := range resp.Topics {
-			topics[i] = &Topic{
-				name: resp.Topics[i].Name,
-			}
+			topics[i] = c.newTopic(&resp.Topics[i])
 		}
 		return topics, nil
 	}
-	return nil, errors.New(resp.ErrorMessage)
+	return nil, brokerError(resp.ErrorCode, resp.ErrorMessage)
 }
 
 func (c *GodelClient) GetTopic(name string, opts *options.TopicOptions) (*Topic, error) {
@@ -60,9 +58,9 @@ func (c *GodelClient) GetTopic(name string, opts *options.TopicOptions) (*Topic,
 		return nil, err
 	}
 	if resp.ErrorCode == 0 {
-		return &Topic{name: resp.Topic.Name}, nil
+		return c.newTopic(&resp.Topic), nil
 	}
-	return nil, errors.New(resp.ErrorMessage)
+	return nil, brokerError(resp.ErrorCode, resp.ErrorMessage)
 }
 
 func (c *GodelClient) GetOrCreateTopic(name string, opts *options.TopicOptions) (*Topic, error) {
@@ -71,10 +69,10 @@ func (c *GodelClient) GetOrCreateTopic(name string, opts *options.TopicOptions)
 		return nil, err
 	}
 	if resp1.ErrorCode == 0 {
-		return &Topic{name: resp1.Topic.Name}, nil
+		return c.newTopic(&resp1.Topic), nil
 	}
-	if resp1.ErrorMessage != protocol.ErrTopicNotFound {
-		return nil, errors.New(resp1.ErrorMessage)
+	if resp1.ErrorCode != protocol.ErrCodeTopicNotFound {
+		return nil, brokerError(resp1.ErrorCode, resp1.ErrorMessage)
 	}
 
 	resp2, err := c.conn.CreateTopics(name, opts)
@@ -85,10 +83,18 @@ func (c *GodelClient) GetOrCreateTopic(name string, opts *options.TopicOptions)
 		return nil, errors.New("unexpected topics number in response")
 	}
 	if resp2.Topics[0].ErrorCode != 0 {
-		return nil, errors.New(resp2.Topics[0].ErrorMessage)
+		return nil, brokerError(resp2.Topics[0].ErrorCode, resp2.Topics[0].ErrorMessage)
 	}
 
-	return &Topic{name: resp2.Topics[0].Name}, nil
+	return c.GetTopic(resp2.Topics[0].Name, opts)
+}
+
+func (c *GodelClient) newTopic(t *protocol.Topic) *Topic {
+	return &Topic{
+		name:          t.Name,
+		conn:          c.conn,
+		numPartitions: t.Options.NumPartitions,
+	}
 }
 
 func (c *GodelClient) DeleteTopic(name string) error {
@@ -99,5 +105,5 @@ func (c *GodelClient) DeleteTopic(name string) error {
 	if resp.ErrorCode == 0 {
 		return nil
 	}
-	return errors.New(resp.ErrorMessage)
+	return brokerError(resp.ErrorCode, resp.ErrorMessage)
 }
@@ -0,0 +1,138 @@
+package godel
+
+import (
+	"godel/internal/protocol"
+	"godel/options"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PartitionReader reads partitions of a topic starting from explicit offsets,
+// without joining a consumer group (assign mode): there are no heartbeats, no
+// rebalances and no committed offsets. It's meant for replay tools, debugging
+// and batch exports.
+type PartitionReader struct {
+	topic          *Topic
+	offsets        map[uint32]uint64
+	maxBytes       int64
+	isolationLevel options.IsolationLevel
+
+	mu sync.Mutex
+}
+
+// Assign returns a reader of the partitions in offsets, each starting from its
+// offset. Offsets before the first available one start from the first available.
+func (t *Topic) Assign(offsets map[uint32]uint64) *PartitionReader {
+	r := &PartitionReader{
+		topic:          t,
+		offsets:        make(map[uint32]uint64, len(offsets)),
+		isolationLevel: options.IsolationLevelReadUncommitted,
+	}
+
+	for partition, offset := range offsets {
+		r.offsets[partition] = offset
+	}
+
+	return r
+}
+
+// WithMaxBytes sets the max bytes fetched from every partition on each poll.
+func (r *PartitionReader) WithMaxBytes(n int64) *PartitionReader {
+	r.maxBytes = n
+	return r
+}
+
+func (r *PartitionReader) WithIsolationLevel(l options.IsolationLevel) *PartitionReader {
+	r.isolationLevel = l
+	return r
+}
+
+// Seek moves the partition to the given offset, assigning it if needed.
+func (r *PartitionReader) Seek(partition uint32, offset uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.offsets[partition] = offset
+}
+
+// Offsets returns the next offset to be read for every assigned partition.
+func (r *PartitionReader) Offsets() map[uint32]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	offsets := make(map[uint32]uint64, len(r.offsets))
+	for partition, offset := range r.offsets {
+		offsets[partition] = offset
+	}
+
+	return offsets
+}
+
+// Poll fetches the assigned partitions in parallel, waiting up to maxWait for
+// new messages, and moves every partition past the returned messages. The
+// messages are sorted by partition, then by offset.
+//
+// If a partition fails the error is returned, while the messages of the other
+// partitions are returned anyway (their offsets are moved).
+func (r *PartitionReader) Poll(maxWait time.Duration) ([]protocol.RespConsumeMessage, error) {
+	offsets := r.Offsets()
+
+	partitions := make([]uint32, 0, len(offsets))
+	for partition := range offsets {
+		partitions = append(partitions, partition)
+	}
+
+	slices.Sort(partitions)
+
+	responses := make([]*protocol.RespFetch, len(partitions))
+	errs := make([]error, len(partitions))
+
+	var wg sync.WaitGroup
+	for i, partition := range partitions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := r.topic.conn.Fetch(protocol.ReqFetch{
+				Topic:          r.topic.name,
+				Partition:      partition,
+				Offset:         offsets[partition],
+				MinBytes:       1,
+				MaxBytes:       r.maxBytes,
+				MaxWaitMs:      uint64(maxWait.Milliseconds()),
+				IsolationLevel: r.isolationLevel,
+			})
+			if err == nil {
+				err = brokerError(resp.ErrorCode, resp.ErrorMessage)
+			}
+
+			responses[i], errs[i] = resp, err
+		}()
+	}
+
+	wg.Wait()
+
+	var messages []protocol.RespConsumeMessage
+	var firstErr error
+
+	for i, partition := range partitions {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+
+		messages = append(messages, responses[i].Messages...)
+
+		// the partition may have been moved by Seek in the meantime
+		r.mu.Lock()
+		if r.offsets[partition] == offsets[partition] {
+			r.offsets[partition] = responses[i].NextOffset
+		}
+		r.mu.Unlock()
+	}
+
+	return messages, firstErr
+}
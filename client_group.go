@@ -1,5 +1,259 @@
 package godel
 
+import (
+	"errors"
+	"godel/internal/client"
+	"godel/internal/protocol"
+	"godel/options"
+	"slices"
+	"sync"
+	"time"
+)
+
 type ConsumerGroup struct {
 	name string
 }
+
+// RebalanceListener is notified when the partitions of a group consumer change.
+// Callbacks are called between the message batches, never concurrently.
+type RebalanceListener struct {
+	// OnRevoked is called when the partitions move to other consumers, after
+	// all their messages are handled and before the other consumers read them:
+	// it's the last chance to commit them (see GroupConsumer.Commit).
+	OnRevoked func(c *GroupConsumer, partitions []uint32)
+
+	// OnAssigned is called before the messages of the assigned partitions.
+	OnAssigned func(c *GroupConsumer, partitions []uint32)
+}
+
+// GroupConsumer reads the partitions assigned to it by its consumer group.
+// Partitions are moved between the group consumers by the broker rebalances,
+// that notify the RebalanceListener.
+type GroupConsumer struct {
+	topic    *Topic
+	group    string
+	id       string
+	options  *options.ConsumerOptions
+	listener RebalanceListener
+
+	generation uint32
+	partitions []uint32
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+}
+
+// JoinGroup creates a consumer of the group. The partitions assigned to it are
+// read (and notified to the listener) once Consume is called.
+func (t *Topic) JoinGroup(group string, opts *options.ConsumerOptions, listener RebalanceListener) (*GroupConsumer, error) {
+	if opts == nil {
+		opts = options.DefaulcConsumerOption()
+	}
+
+	resp, err := t.conn.CreateConsumer(t.name, group, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = brokerError(resp.ErrorCode, resp.ErrorMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupConsumer{
+		topic:      t,
+		group:      group,
+		id:         resp.ID,
+		options:    opts,
+		listener:   listener,
+		generation: resp.Generation,
+		partitions: resp.Partitions,
+		closeCh:    make(chan struct{}),
+	}, nil
+}
+
+func (c *GroupConsumer) ID() string {
+	return c.id
+}
+
+// Generation returns the group generation known by the consumer.
+func (c *GroupConsumer) Generation() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// Partitions returns the partitions assigned to the consumer.
+func (c *GroupConsumer) Partitions() []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Clone(c.partitions)
+}
+
+// Consume reads the assigned partitions and calls the handler for every batch
+// of messages, one batch at a time. It sends the heartbeats of the consumer and
+// returns when the consumer is closed or the consume fails.
+func (c *GroupConsumer) Consume(handler func(messages []protocol.RespConsumeMessage)) error {
+	corrID, err := client.GenerateCorrelationID()
+	if err != nil {
+		return err
+	}
+
+	conn := c.topic.conn
+	apiVersion := conn.ApiVersion(protocol.CmdConsume)
+
+	errCh := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+
+	remove := conn.AppendListener(corrID, func(r *protocol.BaseResponse) {
+		if r.Cmd == protocol.CmdNotifyRebalabce {
+			notif, err := protocol.Deserialize[protocol.RespNotifyRebalance](r.Payload)
+			if err == nil {
+				err = c.rebalance(notif)
+			}
+			if err != nil {
+				fail(err)
+			}
+			return
+		}
+
+		resp, err := protocol.DeserializeVersion[protocol.RespConsume](apiVersion, r.Payload)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		err = brokerError(resp.ErrorCode, resp.ErrorMessage)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		handler(resp.Messages)
+	}, false)
+	defer remove()
+
+	reqBuf, err := protocol.SerializeVersion(apiVersion, protocol.ReqConsume{
+		ID:    c.id,
+		Topic: c.topic.name,
+		Group: c.group,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = conn.SendMessage(&protocol.BaseRequest{
+		Cmd:           protocol.CmdConsume,
+		ApiVersion:    apiVersion,
+		CorrelationID: corrID,
+		Payload:       reqBuf,
+	})
+	if err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(time.Duration(c.options.HeartbeatIntervalMilli) * time.Millisecond)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-heartbeat.C:
+			resp, err := conn.Heartbeat(c.topic.name, c.group, c.id)
+			if err == nil {
+				err = brokerError(resp.ErrorCode, resp.ErrorMessage)
+			}
+			if err != nil {
+				return err
+			}
+		case err := <-errCh:
+			return err
+		case <-c.closeCh:
+			return nil
+		}
+	}
+}
+
+// rebalance calls the listener for the revoked partitions, acknowledging them
+// to the group when done, then for the assigned ones.
+func (c *GroupConsumer) rebalance(notif *protocol.RespNotifyRebalance) error {
+	c.mu.Lock()
+	c.generation = notif.Generation
+	c.mu.Unlock()
+
+	if len(notif.Revoked) > 0 {
+		if c.listener.OnRevoked != nil {
+			c.listener.OnRevoked(c, notif.Revoked)
+		}
+
+		c.mu.Lock()
+		c.partitions = slices.DeleteFunc(c.partitions, func(p uint32) bool {
+			return slices.Contains(notif.Revoked, p)
+		})
+		c.mu.Unlock()
+
+		resp, err := c.topic.conn.SyncGroup(c.topic.name, c.group, c.id, notif.Generation)
+		if err != nil {
+			return err
+		}
+
+		// a newer generation started in the meantime, its notification follows
+		err = brokerError(resp.ErrorCode, resp.ErrorMessage)
+		if err != nil && !errors.Is(err, ErrIllegalGeneration) {
+			return err
+		}
+	}
+
+	if len(notif.Assigned) > 0 {
+		c.mu.Lock()
+		for _, p := range notif.Assigned {
+			if !slices.Contains(c.partitions, p) {
+				c.partitions = append(c.partitions, p)
+			}
+		}
+		slices.Sort(c.partitions)
+		c.mu.Unlock()
+
+		if c.listener.OnAssigned != nil {
+			c.listener.OnAssigned(c, notif.Assigned)
+		}
+	}
+
+	return nil
+}
+
+// Commit commits the offset of the last handled message of a partition. It
+// fails with ErrIllegalGeneration if the partition is not owned by the consumer
+// anymore, in which case its messages may be read by other consumers.
+func (c *GroupConsumer) Commit(partition uint32, offset uint64) error {
+	resp, err := c.topic.conn.CommitConsumerOffset(c.topic.name, c.group, c.id, c.Generation(), partition, offset)
+	if err != nil {
+		return err
+	}
+
+	return brokerError(resp.ErrorCode, resp.ErrorMessage)
+}
+
+// Close leaves the group, stopping Consume: the partitions of the consumer
+// are assigned to the other consumers of the group. Static consumers (with a
+// group instance id) keep their partitions until they join the group again,
+// or until their session times out.
+func (c *GroupConsumer) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+	})
+
+	resp, err := c.topic.conn.DeleteConsumer(c.topic.name, c.group, c.id)
+	if err != nil {
+		return err
+	}
+
+	return brokerError(resp.ErrorCode, resp.ErrorMessage)
+}
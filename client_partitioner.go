@@ -0,0 +1,34 @@
+package godel
+
+import "godel/internal/partitioner"
+
+// Partitioner chooses, client side, the partitions the messages of a produced batch are sent to.
+type Partitioner interface {
+	// Partition returns the partition number of every key, in order.
+	Partition(keys [][]byte, numPartitions uint32) []uint32
+}
+
+// Murmur2Partitioner hashes the message key the same way the broker does,
+// so messages without a key always land on the same partition.
+type Murmur2Partitioner = partitioner.Murmur2
+
+// RoundRobinPartitioner hashes the message key, while
+// messages without a key are rotated across partitions.
+type RoundRobinPartitioner = partitioner.RoundRobin
+
+// StickyPartitioner hashes the message key, while messages without a key of the
+// same batch stick to a single partition. The partition is rotated on every batch.
+type StickyPartitioner = partitioner.Sticky
+
+// ExplicitPartitioner sends every message to the same
+// partition, e.g. ExplicitPartitioner(2).
+type ExplicitPartitioner uint32
+
+func (p ExplicitPartitioner) Partition(keys [][]byte, numPartitions uint32) []uint32 {
+	partitions := make([]uint32, len(keys))
+	for i := range keys {
+		partitions[i] = uint32(p)
+	}
+
+	return partitions
+}
@@ -1,5 +1,74 @@
 package godel
 
+import (
+	"errors"
+	"godel/internal/client"
+	"godel/internal/protocol"
+	"time"
+)
+
 type Topic struct {
-	name string
+	name          string
+	conn          *client.Connection
+	numPartitions uint32
+	partitioner   Partitioner
+}
+
+// WithPartitioner sets the partitioner used to choose the partition of the
+// produced messages. When no partitioner is set the topic partitioner
+// (broker side) is used.
+func (t *Topic) WithPartitioner(p Partitioner) *Topic {
+	t.partitioner = p
+	return t
+}
+
+// Produce sends a batch of messages with the same key to the topic.
+func (t *Topic) Produce(key []byte, values ...[]byte) (*protocol.RespProduce, error) {
+	messages := make([]protocol.ReqProduceMessage, len(values))
+	for i := range values {
+		messages[i] = protocol.ReqProduceMessage{Key: key, Value: values[i]}
+	}
+
+	if t.partitioner != nil {
+		if t.numPartitions == 0 {
+			return nil, errors.New("unknown topic partitions number")
+		}
+
+		keys := make([][]byte, len(messages))
+		for i := range messages {
+			keys[i] = messages[i].Key
+		}
+
+		partitions := t.partitioner.Partition(keys, t.numPartitions)
+		for i := range messages {
+			messages[i].Partition = &partitions[i]
+		}
+	}
+
+	return t.conn.Produce(t.name, protocol.AcksLeader, 0, messages...)
+}
+
+// Fetch reads the messages of a partition starting from offset, without joining
+// a consumer group. It waits up to maxWait for at least minBytes to be available,
+// and returns at most maxBytes (0 for the broker default). The next fetch should
+// start from the returned RespFetch.NextOffset.
+func (t *Topic) Fetch(partition uint32, offset uint64, minBytes, maxBytes int64, maxWait time.Duration) (*protocol.RespFetch, error) {
+	resp, err := t.conn.Fetch(protocol.ReqFetch{
+		Topic:     t.name,
+		Partition: partition,
+		Offset:    offset,
+		MinBytes:  minBytes,
+		MaxBytes:  maxBytes,
+		MaxWaitMs: uint64(maxWait.Milliseconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = brokerError(resp.ErrorCode, resp.ErrorMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
 }
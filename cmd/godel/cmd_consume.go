@@ -10,6 +10,7 @@ import (
 	"godel/options"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,12 +18,14 @@ import (
 )
 
 type printableMessage struct {
-	Key          string  `json:"key"`
-	Partition    *uint32 `json:"partition,omitempty"`
-	Offset       *uint64 `json:"offset,omitempty"`
-	Payload      string  `json:"payload"`
-	ErrorCode    int     `json:"errorCode"`
-	ErrorMessage string  `json:"errorMessage,omitempty"`
+	Key          string             `json:"key"`
+	Partition    *uint32            `json:"partition,omitempty"`
+	Offset       *uint64            `json:"offset,omitempty"`
+	Payload      string             `json:"payload"`
+	ErrorCode    protocol.ErrorCode `json:"errorCode"`
+	ErrorMessage string             `json:"errorMessage,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 var cmdConsume = &cli.Command{
@@ -54,6 +57,10 @@ var cmdConsume = &cli.Command{
 			Name:  "from.beginning",
 			Value: false,
 		},
+		&cli.StringFlag{
+			Name:  "from.timestamp",
+			Usage: "start consuming from the first message at or after the given time (RFC3339 or unix seconds)",
+		},
 		&cli.BoolFlag{
 			Name:  "json",
 			Value: false,
@@ -79,6 +86,40 @@ var cmdConsume = &cli.Command{
 			Name:  "auto.commit.interval.ms",
 			Value: 5000,
 		},
+		&cli.Int64Flag{
+			Name:    "partition",
+			Aliases: []string{"p"},
+			Usage:   "read only this partition, without joining a consumer group (no group needed, offsets are not committed)",
+			Value:   -1,
+		},
+		&cli.Int64Flag{
+			Name:  "offset",
+			Usage: "offset to start reading the --partition from (latest if missing, unless from.beginning or from.timestamp are set)",
+			Value: -1,
+		},
+		&cli.StringFlag{
+			Name:  "isolation.level",
+			Usage: "read_uncommitted or read_committed (skips aborted transactions)",
+			Value: string(options.IsolationLevelReadUncommitted),
+		},
+		&cli.StringFlag{
+			Name:  "rebalance.protocol",
+			Usage: "eager (all partitions are revoked on rebalance) or cooperative (only the moved ones)",
+			Value: string(options.RebalanceProtocolEager),
+		},
+		&cli.Int64Flag{
+			Name:  "rebalance.timeout.ms",
+			Value: options.DefaultRebalanceTimeoutMs,
+		},
+		&cli.StringFlag{
+			Name:  "partition.assignment.strategy",
+			Usage: "range, roundrobin or sticky, must be the same for all the consumers of the group",
+			Value: string(options.AssignmentStrategyRange),
+		},
+		&cli.StringFlag{
+			Name:  "group.instance.id",
+			Usage: "static member id, restarting within session.timeout.ms keeps the partitions without rebalancing",
+		},
 	},
 	Action: func(ctx context.Context, cmd *cli.Command) (err error) {
 		topic := cmd.StringArg("topic")
@@ -86,6 +127,10 @@ var cmdConsume = &cli.Command{
 			return errors.New("topic must be provided")
 		}
 
+		if partition := cmd.Int64("partition"); partition >= 0 {
+			return consumePartition(cmd, topic, uint32(partition))
+		}
+
 		group := cmd.StringArg("group")
 		if group == "" {
 			return errors.New("group must be provided")
@@ -104,6 +149,12 @@ var cmdConsume = &cli.Command{
 			HeartbeatIntervalMilli:  cmd.Int64("heartbeat.interval.ms"),
 			AutoCommitIntervalMilli: cmd.Int64("auto.commit.interval.ms"),
 			EnableAutoCommit:        cmd.Bool("enable.auto.commit"),
+			IsolationLevel:          options.IsolationLevel(cmd.String("isolation.level")),
+			RebalanceProtocol:       options.RebalanceProtocol(cmd.String("rebalance.protocol")),
+			RebalanceTimeoutMilli:   cmd.Int64("rebalance.timeout.ms"),
+
+			PartitionAssignmentStrategy: options.AssignmentStrategy(cmd.String("partition.assignment.strategy")),
+			GroupInstanceID:             cmd.String("group.instance.id"),
 		}
 
 		options.MergeConsumerOptions(&opts, options.DefaulcConsumerOption())
@@ -147,14 +198,44 @@ var cmdConsume = &cli.Command{
 			return err
 		}
 
+		apiVersion := conn.ApiVersion(protocol.CmdConsume)
+
 		if consumerID == "" {
 			consumerResp, err := conn.CreateConsumer(topic, group, &opts)
 			if err != nil {
 				return err
 			}
+			if consumerResp.ErrorCode != 0 {
+				return errors.New(consumerResp.ErrorMessage)
+			}
 			consumerID = consumerResp.ID
 		}
 
+		var startOffsets map[uint32]uint64
+		if fromTimestamp := cmd.String("from.timestamp"); fromTimestamp != "" {
+			timestamp, err := parseTimestamp(fromTimestamp)
+			if err != nil {
+				return err
+			}
+
+			offsetsResp, err := conn.ListOffsets(topic, timestamp)
+			if err != nil {
+				return err
+			}
+			if offsetsResp.ErrorCode != 0 {
+				return errors.New(offsetsResp.ErrorMessage)
+			}
+
+			startOffsets = map[uint32]uint64{}
+			for _, p := range offsetsResp.Partitions {
+				if p.ErrorCode != 0 {
+					return errors.New(p.ErrorMessage)
+				}
+
+				startOffsets[p.Partition] = *p.Offset
+			}
+		}
+
 		// go func() {
 		// 	for {
 		// 		time.Sleep(time.Duration(opts.HeartbeatIntervalMilli) * time.Millisecond)
@@ -187,7 +268,35 @@ var cmdConsume = &cli.Command{
 		go func() {
 			count := 0
 			conn.AppendListener(corrID, func(r *protocol.BaseResponse) {
-				resp, err := protocol.Deserialize[protocol.RespConsume](r.Payload)
+				if r.Cmd == protocol.CmdNotifyRebalabce {
+					notif, err := protocol.Deserialize[protocol.RespNotifyRebalance](r.Payload)
+					if err != nil {
+						fmt.Println("deser error", err)
+						return
+					}
+
+					if len(notif.Revoked) > 0 {
+						fmt.Fprintf(os.Stderr, "partitions revoked: %v (generation %d)\n", notif.Revoked, notif.Generation)
+
+						for _, partition := range notif.Revoked {
+							delete(latestOffsets, partition)
+						}
+
+						// the revoked partitions are released to the other consumers
+						syncResp, err := conn.SyncGroup(topic, group, consumerID, notif.Generation)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "sync group error: %s\n", err.Error())
+						} else if syncResp.ErrorCode != 0 {
+							fmt.Fprintf(os.Stderr, "sync group error: %s\n", syncResp.ErrorMessage)
+						}
+					}
+					if len(notif.Assigned) > 0 {
+						fmt.Fprintf(os.Stderr, "partitions assigned: %v (generation %d)\n", notif.Assigned, notif.Generation)
+					}
+					return
+				}
+
+				resp, err := protocol.DeserializeVersion[protocol.RespConsume](apiVersion, r.Payload)
 				if err != nil {
 					fmt.Println("deser error", err)
 					return
@@ -204,32 +313,7 @@ var cmdConsume = &cli.Command{
 
 					count++
 
-					if cmd.Bool("json") {
-						m := printableMessage{
-							Key:          string(resp.Messages[i].Key),
-							Partition:    resp.Messages[i].Partition,
-							Offset:       resp.Messages[i].Offset,
-							Payload:      string(resp.Messages[i].Payload),
-							ErrorCode:    resp.Messages[i].ErrorCode,
-							ErrorMessage: resp.Messages[i].ErrorMessage,
-						}
-
-						bytes, err := json.Marshal(&m)
-						if err != nil {
-							fmt.Println("marshal error", err)
-						}
-
-						fmt.Println(string(bytes))
-						continue
-					}
-
-					fmt.Println(
-						"key:", string(resp.Messages[i].Key),
-						"partition:", *resp.Messages[i].Partition,
-						"offset", *resp.Messages[i].Offset,
-					)
-					fmt.Println("payload", string(resp.Messages[i].Payload))
-					fmt.Println()
+					printMessage(&resp.Messages[i], cmd.Bool("json"))
 				}
 			}, false)
 			if err != nil {
@@ -242,17 +326,18 @@ var cmdConsume = &cli.Command{
 			Topic:           topic,
 			Group:           group,
 			FromBeginning:   cmd.Bool("fromBeginning"),
+			StartOffsets:    startOffsets,
 			ConsumerOptions: opts,
 		}
 
-		reqBuf, err := protocol.Serialize(req)
+		reqBuf, err := protocol.SerializeVersion(apiVersion, req)
 		if err != nil {
 			return err
 		}
 
 		msg := &protocol.BaseRequest{
 			Cmd:           protocol.CmdConsume,
-			ApiVersion:    0,
+			ApiVersion:    apiVersion,
 			CorrelationID: corrID,
 			Payload:       reqBuf,
 		}
@@ -270,6 +355,141 @@ var cmdConsume = &cli.Command{
 	},
 }
 
+// consumePartition reads a single partition with fetch requests, without
+// joining a consumer group: there are no heartbeats and no committed offsets.
+func consumePartition(cmd *cli.Command, topic string, partition uint32) error {
+	// the read loop fails on close, that's expected once done
+	var closing atomic.Bool
+
+	conn, err := client.ConnectToBroker(getAddr(cmd), func(c *client.Connection, err error) {
+		if closing.Load() {
+			return
+		}
+
+		fmt.Fprintf(os.Stderr, "connection error: %s\n", err.Error())
+		os.Exit(1)
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closing.Store(true)
+		conn.Close()
+	}()
+
+	offset, err := partitionStartOffset(cmd, conn, topic, partition)
+	if err != nil {
+		return err
+	}
+
+	maxMessages := cmd.Int32("number")
+	count := 0
+
+	for {
+		resp, err := conn.Fetch(protocol.ReqFetch{
+			Topic:          topic,
+			Partition:      partition,
+			Offset:         offset,
+			MinBytes:       1,
+			MaxWaitMs:      5000,
+			IsolationLevel: options.IsolationLevel(cmd.String("isolation.level")),
+		})
+		if err != nil {
+			return err
+		}
+		if resp.ErrorCode != 0 {
+			return errors.New(resp.ErrorMessage)
+		}
+
+		for i := range resp.Messages {
+			printMessage(&resp.Messages[i], cmd.Bool("json"))
+
+			count++
+			if maxMessages != 0 && count >= int(maxMessages) {
+				return nil
+			}
+		}
+
+		offset = resp.NextOffset
+	}
+}
+
+// partitionStartOffset returns the --offset flag, or the offset found
+// with from.beginning, from.timestamp or the latest one if missing.
+func partitionStartOffset(cmd *cli.Command, conn *client.Connection, topic string, partition uint32) (uint64, error) {
+	if offset := cmd.Int64("offset"); offset >= 0 {
+		return uint64(offset), nil
+	}
+
+	timestamp := protocol.ListOffsetsLatest
+	if cmd.Bool("from.beginning") {
+		timestamp = protocol.ListOffsetsEarliest
+	}
+
+	if fromTimestamp := cmd.String("from.timestamp"); fromTimestamp != "" {
+		var err error
+		timestamp, err = parseTimestamp(fromTimestamp)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	resp, err := conn.ListOffsets(topic, timestamp, partition)
+	if err != nil {
+		return 0, err
+	}
+	if resp.ErrorCode != 0 {
+		return 0, errors.New(resp.ErrorMessage)
+	}
+	if len(resp.Partitions) != 1 {
+		return 0, errors.New("unexpected partitions number in response")
+	}
+	if resp.Partitions[0].ErrorCode != 0 {
+		return 0, errors.New(resp.Partitions[0].ErrorMessage)
+	}
+
+	return *resp.Partitions[0].Offset, nil
+}
+
+func printMessage(message *protocol.RespConsumeMessage, asJSON bool) {
+	if asJSON {
+		m := printableMessage{
+			Key:          string(message.Key),
+			Partition:    message.Partition,
+			Offset:       message.Offset,
+			Payload:      string(message.Payload),
+			ErrorCode:    message.ErrorCode,
+			ErrorMessage: message.ErrorMessage,
+		}
+
+		if len(message.Headers) > 0 {
+			m.Headers = map[string]string{}
+			for k, v := range message.Headers {
+				m.Headers[k] = string(v)
+			}
+		}
+
+		bytes, err := json.Marshal(&m)
+		if err != nil {
+			fmt.Println("marshal error", err)
+		}
+
+		fmt.Println(string(bytes))
+		return
+	}
+
+	fmt.Println(
+		"key:", string(message.Key),
+		"partition:", *message.Partition,
+		"offset", *message.Offset,
+	)
+	for k, v := range message.Headers {
+		fmt.Println("header", k+"="+string(v))
+	}
+	fmt.Println("payload", string(message.Payload))
+	fmt.Println()
+}
+
 func onShutdown(callback func()) {
 	sigs := make(chan os.Signal, 1)
 
@@ -53,6 +53,49 @@ var cmdCreateTopic = &cli.Command{
 			Name:  "retention.bytes",
 			Value: options.DefaultRetentionBytes,
 		},
+		&cli.StringFlag{
+			Name:  "cleanup.policy",
+			Usage: "delete, compact or compact,delete",
+			Value: string(options.CleanupPolicyDelete),
+		},
+		&cli.Int64Flag{
+			Name:  "delete.retention.ms",
+			Usage: "how long tombstones are retained in compacted topics",
+			Value: options.DefaultDeleteRetentionMs,
+		},
+		&cli.Int64Flag{
+			Name:  "flush.messages",
+			Usage: "number of messages after which the partition is synced to disk (default from broker)",
+		},
+		&cli.Int64Flag{
+			Name:  "flush.ms",
+			Usage: "max time in ms messages are kept before syncing them to disk (default from broker)",
+		},
+		&cli.StringFlag{
+			Name:  "message.timestamp.type",
+			Usage: "CreateTime or LogAppendTime",
+			Value: string(options.TimestampTypeCreateTime),
+			Validator: func(v string) error {
+				if !options.TimestampType(v).Valid() {
+					return fmt.Errorf("invalid message.timestamp.type %q: expected CreateTime or LogAppendTime", v)
+				}
+				return nil
+			},
+		},
+		&cli.Int64Flag{
+			Name:  "max.timestamp.difference.ms",
+			Usage: "max difference allowed between create times and the broker time (-1 for no limit)",
+			Value: options.DefaultMaxTimestampDifferenceMs,
+		},
+		&cli.StringFlag{
+			Name:  "partitioner",
+			Usage: "murmur2, round-robin or sticky (partition of messages without a key)",
+			Value: string(options.PartitionerSticky),
+		},
+		&cli.BoolFlag{
+			Name:  "fsync.always",
+			Usage: "sync every produced batch to disk before acknowledging it (same as flush.messages=1)",
+		},
 	},
 	Action: func(ctx context.Context, cmd *cli.Command) (err error) {
 		name := cmd.StringArg("name")
@@ -69,13 +112,28 @@ var cmdCreateTopic = &cli.Command{
 			return err
 		}
 
+		deleteRetentionMilli := cmd.Int64("delete.retention.ms")
+
 		topicOptions := options.TopicOptions{
 			NumPartitions:   cmd.Uint32("partitions"),
-			CleanupPolicy:   options.CleanupPolicy(cmd.String("cleanup")),
+			CleanupPolicy:   options.CleanupPolicy(cmd.String("cleanup.policy")),
 			RetentionMilli:  cmd.Int64("retention.ms"),
 			RetentionBytes:  cmd.Int64("retention.bytes"),
 			SegmentBytes:    cmd.Int64("segment.bytes"),
 			MaxMessageBytes: cmd.Int64("max.message.bytes"),
+
+			DeleteRetentionMilli: &deleteRetentionMilli,
+			FlushMessages:        cmd.Int64("flush.messages"),
+			FlushMilli:           cmd.Int64("flush.ms"),
+
+			MessageTimestampType:        options.TimestampType(cmd.String("message.timestamp.type")),
+			MaxTimestampDifferenceMilli: cmd.Int64("max.timestamp.difference.ms"),
+
+			Partitioner: options.PartitionerType(cmd.String("partitioner")),
+		}
+
+		if cmd.Bool("fsync.always") {
+			topicOptions.WithFsyncAlways()
 		}
 
 		resp, err := conn.CreateTopics(name, &topicOptions)
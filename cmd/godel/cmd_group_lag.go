@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"godel/internal/client"
+	"godel/internal/protocol"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+var cmdConsumerGroupLag = &cli.Command{
+	Name:  "lag",
+	Usage: "show how far behind the group is, per partition",
+	Arguments: []cli.Argument{
+		&cli.StringArg{
+			Name: "topic",
+		},
+		&cli.StringArg{
+			Name: "name",
+		},
+	},
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "watch",
+			Aliases: []string{"w"},
+			Usage:   "refresh the lag periodically",
+		},
+		&cli.Int64Flag{
+			Name:  "interval.ms",
+			Usage: "refresh interval of --watch",
+			Value: 2000,
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		topic := cmd.StringArg("topic")
+		if topic == "" {
+			return errors.New("topic name is required")
+		}
+
+		name := cmd.StringArg("name")
+		if name == "" {
+			return errors.New("group name is required")
+		}
+
+		conn, err := client.ConnectToBroker(getAddr(cmd), func(c *client.Connection, err error) {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		})
+		if err != nil {
+			return err
+		}
+
+		for {
+			resp, err := conn.GetConsumerGroup(topic, name)
+			if err != nil {
+				return err
+			}
+			if resp.ErrorCode != 0 {
+				return errors.New(resp.ErrorMessage)
+			}
+
+			if !cmd.Bool("watch") {
+				return printLag(resp)
+			}
+
+			// clear the screen before every refresh
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("%s  group %s, topic %s\n\n", time.Now().Format(time.TimeOnly), name, topic)
+
+			err = printLag(resp)
+			if err != nil {
+				return err
+			}
+
+			select {
+			case <-time.After(time.Duration(cmd.Int64("interval.ms")) * time.Millisecond):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	},
+}
+
+func printLag(resp *protocol.RespGetConsumerGroup) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "PARTITION\tLOG-START\tLOG-END\tCOMMITTED\tLAG\tCONSUMER")
+	for _, p := range resp.Partitions {
+		committed := "-"
+		if p.CommittedOffset != nil {
+			committed = strconv.FormatUint(*p.CommittedOffset, 10)
+		}
+
+		consumer := "-"
+		if p.ConsumerID != "" {
+			consumer = p.ConsumerID
+		}
+
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%d\t%s\n", p.Partition, p.LogStartOffset, p.LogEndOffset, committed, p.Lag, consumer)
+	}
+
+	fmt.Fprintf(w, "\nTOTAL LAG\t%d\n", resp.TotalLag)
+	return w.Flush()
+}
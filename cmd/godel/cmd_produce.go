@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"godel/internal/client"
@@ -29,6 +30,39 @@ var cmdProduce = &cli.Command{
 			Aliases:  []string{"s"},
 			OnlyOnce: true,
 		},
+		&cli.StringSliceFlag{
+			Name:    "header",
+			Aliases: []string{"H"},
+			Usage:   "message header as key=value (can be repeated)",
+		},
+		&cli.StringFlag{
+			Name:     "timestamp",
+			Usage:    "create time of the messages (RFC3339 or unix seconds), set by the broker if missing",
+			OnlyOnce: true,
+		},
+		&cli.Int64Flag{
+			Name:     "partition",
+			Aliases:  []string{"p"},
+			Usage:    "partition of the messages, chosen by the topic partitioner if missing",
+			Value:    -1,
+			OnlyOnce: true,
+		},
+		&cli.BoolFlag{
+			Name:     "durable",
+			Usage:    "wait for messages to be synced to disk before being acknowledged",
+			OnlyOnce: true,
+		},
+		&cli.Int64Flag{
+			Name:     "acks",
+			Usage:    "0 (no response), 1 (after the local append) or -1 (all, after fsync)",
+			Value:    int64(protocol.AcksLeader),
+			OnlyOnce: true,
+		},
+		&cli.Uint64Flag{
+			Name:     "timeout.ms",
+			Usage:    "max time to wait for the messages to be appended (0 for no timeout)",
+			OnlyOnce: true,
+		},
 	},
 	Action: func(ctx context.Context, cmd *cli.Command) (err error) {
 		topic := cmd.StringArg("topic")
@@ -38,6 +72,30 @@ var cmdProduce = &cli.Command{
 			return errors.New("topic must be provided")
 		}
 
+		headers, err := parseHeaders(cmd.StringSlice("header"))
+		if err != nil {
+			return err
+		}
+
+		var timestamp int64
+		if ts := cmd.String("timestamp"); ts != "" {
+			timestamp, err = parseTimestamp(ts)
+			if err != nil {
+				return err
+			}
+		}
+
+		acks := int8(cmd.Int64("acks"))
+		if acks != protocol.AcksNone && acks != protocol.AcksLeader && acks != protocol.AcksAll {
+			return errors.New("acks must be 0, 1 or -1")
+		}
+
+		var partition *uint32
+		if p := cmd.Int64("partition"); p >= 0 {
+			partition = new(uint32)
+			*partition = uint32(p)
+		}
+
 		corrID, err := client.GenerateCorrelationID()
 		if err != nil {
 			return err
@@ -63,15 +121,25 @@ var cmdProduce = &cli.Command{
 			return err
 		}
 
+		apiVersion := conn.ApiVersion(protocol.CmdProduce)
+
 		if cmd.Bool("showResponse") {
 			go func() {
 				conn.AppendListener(corrID, func(r *protocol.BaseResponse) {
-					fmt.Println(string(r.Payload))
-
-					// _, err := protocol.Deserialize[protocol.RespProduce](r.Payload)
-					// if err != nil {
-					// 	return err
-					// }
+					// printed as JSON whatever the api version
+					resp, err := protocol.DeserializeVersion[protocol.RespProduce](apiVersion, r.Payload)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+						return
+					}
+
+					buf, err := json.Marshal(resp)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+						return
+					}
+
+					fmt.Println(string(buf))
 				}, false)
 			}()
 		}
@@ -87,23 +155,29 @@ var cmdProduce = &cli.Command{
 			input = strings.TrimSuffix(input, "\n")
 
 			req := protocol.ReqProduce{
-				Topic: topic,
+				Topic:     topic,
+				Durable:   cmd.Bool("durable"),
+				Acks:      &acks,
+				TimeoutMs: cmd.Uint64("timeout.ms"),
 				Messages: []protocol.ReqProduceMessage{
 					{
-						Key:   key,
-						Value: []byte(input),
+						Key:       key,
+						Value:     []byte(input),
+						Headers:   headers,
+						Timestamp: uint64(timestamp),
+						Partition: partition,
 					},
 				},
 			}
 
-			reqBuf, err := protocol.Serialize(req)
+			reqBuf, err := protocol.SerializeVersion(apiVersion, req)
 			if err != nil {
 				return err
 			}
 
 			msg := &protocol.BaseRequest{
 				Cmd:           protocol.CmdProduce,
-				ApiVersion:    0,
+				ApiVersion:    apiVersion,
 				CorrelationID: corrID,
 				Payload:       reqBuf,
 			}
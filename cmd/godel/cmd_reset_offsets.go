@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"godel/internal/client"
+	"godel/internal/protocol"
+	"os"
+
+	"github.com/urfave/cli/v3"
+)
+
+var cmdResetOffsets = &cli.Command{
+	Name:  "reset-offsets",
+	Usage: "move the offsets the group reads the partitions from, only when it has no consumers unless forced",
+	Arguments: []cli.Argument{
+		&cli.StringArg{
+			Name: "topic",
+		},
+		&cli.StringArg{
+			Name: "name",
+		},
+	},
+	Flags: []cli.Flag{
+		&cli.Uint32SliceFlag{
+			Name:    "partition",
+			Aliases: []string{"p"},
+			Usage:   "partitions to reset (all if missing)",
+		},
+		&cli.BoolFlag{
+			Name:  "to-earliest",
+			Usage: "reset to the first offset of the partitions",
+		},
+		&cli.BoolFlag{
+			Name:  "to-latest",
+			Usage: "reset to the end of the partitions, skipping all the messages",
+		},
+		&cli.Uint64Flag{
+			Name:  "to-offset",
+			Usage: "reset to the offset",
+		},
+		&cli.StringFlag{
+			Name:  "to-datetime",
+			Usage: "reset to the first message at or after the given time (RFC3339 or unix seconds)",
+		},
+		&cli.Int64Flag{
+			Name:  "shift-by",
+			Usage: "move the current offsets by n messages, negative to read them again",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print the new offsets",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "reset even if the group has consumers, moving them to the new offsets",
+		},
+	},
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		topic := cmd.StringArg("topic")
+		if topic == "" {
+			return errors.New("topic name is required")
+		}
+
+		name := cmd.StringArg("name")
+		if name == "" {
+			return errors.New("group name is required")
+		}
+
+		req := protocol.ReqResetOffsets{
+			Topic:      topic,
+			Group:      name,
+			Partitions: cmd.Uint32Slice("partition"),
+			ToEarliest: cmd.Bool("to-earliest"),
+			ToLatest:   cmd.Bool("to-latest"),
+			DryRun:     cmd.Bool("dry-run"),
+			Force:      cmd.Bool("force"),
+		}
+
+		targets := 0
+		if req.ToEarliest {
+			targets++
+		}
+
+		if req.ToLatest {
+			targets++
+		}
+
+		if cmd.IsSet("to-offset") {
+			offset := cmd.Uint64("to-offset")
+			req.ToOffset = &offset
+			targets++
+		}
+
+		if cmd.IsSet("to-datetime") {
+			timestamp, err := parseTimestamp(cmd.String("to-datetime"))
+			if err != nil {
+				return err
+			}
+
+			req.ToTimestamp = &timestamp
+			targets++
+		}
+
+		if cmd.IsSet("shift-by") {
+			shift := cmd.Int64("shift-by")
+			req.ShiftBy = &shift
+			targets++
+		}
+
+		if targets != 1 {
+			return errors.New("exactly one of --to-earliest, --to-latest, --to-offset, --to-datetime or --shift-by is required")
+		}
+
+		conn, err := client.ConnectToBroker(getAddr(cmd), func(c *client.Connection, err error) {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		})
+		if err != nil {
+			return err
+		}
+
+		resp, err := conn.ResetOffsets(req)
+		if err != nil {
+			return err
+		}
+
+		bytes, err := json.Marshal(&resp)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bytes))
+		return nil
+	},
+}
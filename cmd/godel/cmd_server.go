@@ -35,6 +35,31 @@ var cmdRunServer = &cli.Command{
 			Usage:    "interval at which the retention check will be scheduled by the broker",
 			OnlyOnce: true,
 		},
+		&cli.Int64Flag{
+			Name:     "log.flush.interval.messages",
+			Usage:    "default number of messages after which a partition is synced to disk",
+			OnlyOnce: true,
+		},
+		&cli.Int64Flag{
+			Name:     "log.flush.interval.ms",
+			Usage:    "default max time in ms messages are kept before syncing them to disk",
+			OnlyOnce: true,
+		},
+		&cli.Int64Flag{
+			Name:     "socket.request.max.bytes",
+			Usage:    "max size of a request, larger requests close the connection",
+			OnlyOnce: true,
+		},
+		&cli.Int64Flag{
+			Name:     "max.in.flight.requests.per.connection",
+			Usage:    "max requests processed at the same time for a connection, before reading more of them",
+			OnlyOnce: true,
+		},
+		&cli.BoolFlag{
+			Name:     "fsync.always",
+			Usage:    "sync every produced batch to disk before acknowledging it (same as log.flush.interval.messages=1)",
+			OnlyOnce: true,
+		},
 	},
 	Action: func(ctx context.Context, cmd *cli.Command) (err error) {
 		opts := options.DeafaultBrokerOptions()
@@ -54,6 +79,26 @@ var cmdRunServer = &cli.Command{
 			opts.WithLogRetentionCheckInterval(time.Duration(lrcims) * time.Millisecond)
 		}
 
+		if lfim := cmd.Int64("log.flush.interval.messages"); lfim != 0 {
+			opts.WithLogFlushIntervalMessages(lfim)
+		}
+
+		if lfims := cmd.Int64("log.flush.interval.ms"); lfims != 0 {
+			opts.WithLogFlushInterval(time.Duration(lfims) * time.Millisecond)
+		}
+
+		if srmb := cmd.Int64("socket.request.max.bytes"); srmb != 0 {
+			opts.WithSocketRequestMaxBytes(srmb)
+		}
+
+		if mifr := cmd.Int64("max.in.flight.requests.per.connection"); mifr != 0 {
+			opts.WithMaxInFlightRequestsPerConnection(mifr)
+		}
+
+		if cmd.Bool("fsync.always") {
+			opts.WithFsyncAlways()
+		}
+
 		port := cmd.Int("port")
 		if port == 0 {
 			port = 9090
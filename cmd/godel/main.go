@@ -43,6 +43,10 @@ func main() {
 				Commands: []*cli.Command{
 					cmdListConsumerGroups,
 					cmdGetConsumerGroup,
+					cmdCreateConsumerGroup,
+					cmdDeleteConsumerGroup,
+					cmdResetOffsets,
+					cmdConsumerGroupLag,
 				},
 			},
 		},
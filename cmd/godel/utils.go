@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/urfave/cli/v3"
@@ -45,3 +47,36 @@ func getGroupFromConsumerID(id string) (string, error) {
 
 	return substring, nil
 }
+
+// parseTimestamp parses a RFC3339 date or a unix timestamp in seconds.
+func parseTimestamp(s string) (int64, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return seconds, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.New("invalid timestamp: expected RFC3339 or unix seconds")
+	}
+
+	return t.Unix(), nil
+}
+
+// parseHeaders parses a list of key=value message headers.
+func parseHeaders(values []string) (map[string][]byte, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	headers := make(map[string][]byte, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, errors.New("invalid header: expected key=value")
+		}
+
+		headers[key] = []byte(value)
+	}
+
+	return headers, nil
+}
@@ -0,0 +1,96 @@
+package godel
+
+import (
+	"errors"
+	"godel/internal/protocol"
+	"strconv"
+)
+
+// ErrorCode is the code of an error returned by the broker.
+type ErrorCode = protocol.ErrorCode
+
+// Error is an error returned by the broker. Errors match the sentinel
+// errors below with errors.Is by their code, whatever their message.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "broker error " + strconv.Itoa(int(e.Code))
+	}
+
+	return e.Message
+}
+
+// Is matches errors with the same code. Errors without a dedicated
+// code (protocol.ErrCodeUnknown) match only if their message is the same.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok || t.Code != e.Code {
+		return false
+	}
+
+	return e.Code != protocol.ErrCodeUnknown || t.Message == e.Message
+}
+
+// Retriable reports whether the failed request may succeed if sent again.
+func (e *Error) Retriable() bool {
+	return e.Code.Retriable()
+}
+
+// IsRetriable reports whether err is a broker error whose request may
+// succeed if sent again (e.g. ErrRequestTimedOut). Any other error
+// (including connection errors) is not classified as retriable.
+func IsRetriable(err error) bool {
+	var brokerErr *Error
+	return errors.As(err, &brokerErr) && brokerErr.Retriable()
+}
+
+var (
+	ErrRequestTimedOut                  = newCodeError(protocol.ErrCodeRequestTimedOut)
+	ErrMessageTooLarge                  = newCodeError(protocol.ErrCodeMessageTooLarge)
+	ErrUnsupportedVersion               = newCodeError(protocol.ErrCodeUnsupportedVersion)
+	ErrTopicNotFound                    = newCodeError(protocol.ErrCodeTopicNotFound)
+	ErrTopicAlreadyExists               = newCodeError(protocol.ErrCodeTopicAlreadyExists)
+	ErrPartitionNotFound                = newCodeError(protocol.ErrCodePartitionNotFound)
+	ErrPartitionAlreadyExists           = newCodeError(protocol.ErrCodePartitionAlreadyExists)
+	ErrPartitionsNumMismatch            = newCodeError(protocol.ErrCodePartitionsNumMismatch)
+	ErrConsumerGroupNotFound            = newCodeError(protocol.ErrCodeConsumerGroupNotFound)
+	ErrConsumerNotFound                 = newCodeError(protocol.ErrCodeConsumerNotFound)
+	ErrConsumerIdAlreadyExists          = newCodeError(protocol.ErrCodeConsumerIdAlreadyExists)
+	ErrConsumerAlreadyStarted           = newCodeError(protocol.ErrCodeConsumerAlreadyStarted)
+	ErrConsumerGroupsOffsetsMismatch    = newCodeError(protocol.ErrCodeConsumerGroupsOffsetsMismatch)
+	ErrConsumerGroupsPartitionsMismatch = newCodeError(protocol.ErrCodeConsumerGroupsPartitionsMismatch)
+	ErrMissingGroupName                 = newCodeError(protocol.ErrCodeMissingGroupName)
+	ErrMissingConsumerId                = newCodeError(protocol.ErrCodeMissingConsumerId)
+	ErrCorruptRecord                    = newCodeError(protocol.ErrCodeCorruptRecord)
+	ErrInvalidTimestamp                 = newCodeError(protocol.ErrCodeInvalidTimestamp)
+	ErrOutOfOrderSequence               = newCodeError(protocol.ErrCodeOutOfOrderSequence)
+	ErrInvalidProducerEpoch             = newCodeError(protocol.ErrCodeInvalidProducerEpoch)
+	ErrTransactionNotFound              = newCodeError(protocol.ErrCodeTransactionNotFound)
+	ErrInvalidTransactionState          = newCodeError(protocol.ErrCodeInvalidTransactionState)
+	ErrPartitionNotInTransaction        = newCodeError(protocol.ErrCodePartitionNotInTransaction)
+	ErrRequestTooLarge                  = newCodeError(protocol.ErrCodeRequestTooLarge)
+	ErrNotCoordinator                   = newCodeError(protocol.ErrCodeNotCoordinator)
+	ErrIllegalGeneration                = newCodeError(protocol.ErrCodeIllegalGeneration)
+	ErrInconsistentGroupProtocol        = newCodeError(protocol.ErrCodeInconsistentGroupProtocol)
+	ErrConsumerGroupAlreadyExists       = newCodeError(protocol.ErrCodeConsumerGroupAlreadyExists)
+	ErrConsumerGroupNotEmpty            = newCodeError(protocol.ErrCodeConsumerGroupNotEmpty)
+	ErrInvalidRequest                   = newCodeError(protocol.ErrCodeInvalidRequest)
+	ErrInvalidConfig                    = newCodeError(protocol.ErrCodeInvalidConfig)
+)
+
+func newCodeError(code ErrorCode) *Error {
+	return &Error{Code: code, Message: code.Message()}
+}
+
+// brokerError returns the error of a response, nil if the code is protocol.ErrCodeNone.
+func brokerError(code ErrorCode, message string) error {
+	if code == protocol.ErrCodeNone {
+		return nil
+	}
+
+	return &Error{Code: code, Message: message}
+}
@@ -3,7 +3,7 @@ module godel
 go 1.25.1
 
 require (
-	github.com/goccy/go-yaml v1.18.0 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/urfave/cli/v3 v3.4.1 // indirect
+	github.com/goccy/go-yaml v1.18.0
+	github.com/google/uuid v1.6.0
+	github.com/urfave/cli/v3 v3.4.1
 )
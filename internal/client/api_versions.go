@@ -0,0 +1,108 @@
+package client
+
+import (
+	"errors"
+	"godel/internal/protocol"
+	"io"
+	"time"
+)
+
+// clientApiVersions are the max api versions supported by the client,
+// commands not listed here support only protocol.ApiVersionJSON.
+var clientApiVersions = map[int16]int16{
+	protocol.CmdProduce: protocol.ApiVersionBinary,
+	protocol.CmdConsume: protocol.ApiVersionBinary,
+	protocol.CmdFetch:   protocol.ApiVersionBinary,
+}
+
+// ApiVersions requests the api versions supported by the broker. It fails with
+// protocol.ErrRequestTimedOut if the broker doesn't answer within the connection
+// request timeout, e.g. brokers that predate the command.
+func (c *Connection) ApiVersions() (*protocol.RespApiVersions, error) {
+	corrID, err := GenerateCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+
+	reqBuf, err := protocol.Serialize(protocol.ReqApiVersions{})
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &protocol.BaseRequest{
+		Cmd:           protocol.CmdApiVersions,
+		ApiVersion:    0,
+		CorrelationID: corrID,
+		Payload:       reqBuf,
+	}
+
+	// buffered, so that a late response doesn't block the listener
+	respCh := make(chan *protocol.RespApiVersions, 1)
+	errCh := make(chan error, 1)
+
+	close := c.AppendListener(msg.CorrelationID, func(r *protocol.BaseResponse) {
+		resp, err := protocol.Deserialize[protocol.RespApiVersions](r.Payload)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		respCh <- resp
+	}, true)
+
+	defer close()
+
+	err = c.SendMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err := <-errCh:
+		return nil, err
+	case resp := <-respCh:
+		return resp, nil
+	case <-time.After(c.requestTimeout):
+		return nil, errors.New(protocol.ErrRequestTimedOut)
+	case <-c.closeCh:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// negotiateApiVersions chooses for every command the highest api
+// version supported by both the client and the broker. Brokers that
+// don't answer in time get protocol.ApiVersionJSON for every command.
+func (c *Connection) negotiateApiVersions() error {
+	resp, err := c.ApiVersions()
+	if err != nil && err.Error() == protocol.ErrRequestTimedOut {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if resp.ErrorCode != 0 {
+		return errors.New(resp.ErrorMessage)
+	}
+
+	versions := make(map[int16]int16, len(resp.ApiVersions))
+	for _, v := range resp.ApiVersions {
+		version := min(clientApiVersions[v.Cmd], v.MaxVersion)
+		if version >= v.MinVersion {
+			versions[v.Cmd] = version
+		}
+	}
+
+	c.mu.Lock()
+	c.apiVersions = versions
+	c.mu.Unlock()
+
+	return nil
+}
+
+// ApiVersion returns the api version negotiated for the command, or
+// protocol.ApiVersionJSON if the broker doesn't support the command.
+func (c *Connection) ApiVersion(cmd int16) int16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.apiVersions[cmd]
+}
@@ -5,16 +5,31 @@ import (
 )
 
 func (c *Connection) CommitOffset(topic, group string, partition uint32, offset uint64) (*protocol.RespCommitOffset, error) {
-	corrID, err := GenerateCorrelationID()
-	if err != nil {
-		return nil, err
-	}
-
-	req := protocol.ReqCommitOffset{
+	return c.commitOffset(protocol.ReqCommitOffset{
 		Topic:     topic,
 		Group:     group,
 		Partition: partition,
 		Offset:    offset,
+	})
+}
+
+// CommitConsumerOffset commits the offset only if the consumer owns
+// the partition in the group generation.
+func (c *Connection) CommitConsumerOffset(topic, group, consumerID string, generation uint32, partition uint32, offset uint64) (*protocol.RespCommitOffset, error) {
+	return c.commitOffset(protocol.ReqCommitOffset{
+		Topic:      topic,
+		Group:      group,
+		ConsumerID: consumerID,
+		Generation: generation,
+		Partition:  partition,
+		Offset:     offset,
+	})
+}
+
+func (c *Connection) commitOffset(req protocol.ReqCommitOffset) (*protocol.RespCommitOffset, error) {
+	corrID, err := GenerateCorrelationID()
+	if err != nil {
+		return nil, err
 	}
 
 	reqBuf, err := protocol.Serialize(req)
@@ -4,15 +4,61 @@ import (
 	"bufio"
 	"encoding/binary"
 	"godel/internal/protocol"
+	"godel/options"
 	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 type listener struct {
 	correlationID int32
 	callback      func(*protocol.BaseResponse)
 	oneShot       bool
+
+	// responses of persistent listeners, delivered in order
+	queue *responseQueue
+}
+
+// responseQueue runs the callback for every queued response, one at a time
+// and in the order they are received. Responses are queued without blocking,
+// so that a slow callback (e.g. waiting for another response) doesn't block
+// the connection reads.
+type responseQueue struct {
+	callback  func(*protocol.BaseResponse)
+	responses []*protocol.BaseResponse
+	running   bool
+	mu        sync.Mutex
+}
+
+func (q *responseQueue) push(resp *protocol.BaseResponse) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.responses = append(q.responses, resp)
+	if q.running {
+		return
+	}
+
+	q.running = true
+	go q.run()
+}
+
+func (q *responseQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.responses) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+
+		resp := q.responses[0]
+		q.responses = q.responses[1:]
+		q.mu.Unlock()
+
+		q.callback(resp)
+	}
 }
 
 type outgoingRequest struct {
@@ -30,9 +76,16 @@ type Connection struct {
 
 	closeCh  chan struct{}
 	requests chan outgoingRequest
+
+	// api version to be used for every command (see negotiateApiVersions)
+	apiVersions map[int16]int16
+
+	// max wait for the response of requests that don't carry their own timeout
+	requestTimeout time.Duration
 }
 
 // ConnectToBroker connects to a TCP server and returns a connection handle.
+// The api versions used for the requests are negotiated with the broker.
 func ConnectToBroker(addr string, onError func(*Connection, error)) (*Connection, error) {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -48,11 +101,19 @@ func ConnectToBroker(addr string, onError func(*Connection, error)) (*Connection
 
 		requests: make(chan outgoingRequest, 100),
 		closeCh:  make(chan struct{}),
+
+		requestTimeout: time.Duration(options.DefaultRequestTimeoutMs) * time.Millisecond,
 	}
 
 	c.startListening()
 	c.startSending()
 
+	err = c.negotiateApiVersions()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
 	return c, nil
 }
 
@@ -90,10 +151,15 @@ func (c *Connection) startListening() {
 				for i := 0; i < len(c.listeners); i++ {
 					l := c.listeners[i]
 					if l.correlationID == resp.CorrelationID {
-						// run callback in a separate goroutine
-						go func(cb func(*protocol.BaseResponse), r *protocol.BaseResponse) {
-							cb(r)
-						}(l.callback, resp)
+						// persistent listeners get the responses in order (e.g. consume streams)
+						if l.queue != nil {
+							l.queue.push(resp)
+						} else {
+							// run callback in a separate goroutine
+							go func(cb func(*protocol.BaseResponse), r *protocol.BaseResponse) {
+								cb(r)
+							}(l.callback, resp)
+						}
 
 						// remove one-shot listener
 						if l.oneShot {
@@ -162,15 +228,24 @@ func (c *Connection) SendMessage(req *protocol.BaseRequest) error {
 }
 
 // AppendListener adds a response listener.
-// If oneShot is true, it will be removed after the first matching response.
+// If oneShot is true, it will be removed after the first matching response,
+// otherwise the callback is called for every response in the order they are
+// received (never concurrently).
 func (c *Connection) AppendListener(correlationID int32, callback func(*protocol.BaseResponse), oneShot bool) func() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.listeners = append(c.listeners, listener{
+
+	l := listener{
 		correlationID: correlationID,
 		callback:      callback,
 		oneShot:       oneShot,
-	})
+	}
+
+	if !oneShot {
+		l.queue = &responseQueue{callback: callback}
+	}
+
+	c.listeners = append(c.listeners, l)
 
 	return func() {
 		c.removeListener(correlationID)
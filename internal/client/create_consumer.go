@@ -37,8 +37,6 @@ func (c *Connection) CreateConsumer(topic, group string, opts *options.ConsumerO
 		Payload:       reqBuf,
 	}
 
-	c.SendMessage(msg)
-
 	respCh := make(chan *protocol.RespCreateConsumer)
 	errCh := make(chan error)
 
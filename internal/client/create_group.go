@@ -0,0 +1,55 @@
+package client
+
+import (
+	"godel/internal/protocol"
+)
+
+func (c *Connection) CreateConsumerGroup(topic, group string) (*protocol.RespCreateConsumerGroup, error) {
+	corrID, err := GenerateCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := protocol.ReqCreateConsumerGroup{
+		Topic: topic,
+		Group: group,
+	}
+
+	reqBuf, err := protocol.Serialize(req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &protocol.BaseRequest{
+		Cmd:           protocol.CmdCreateConsumerGroup,
+		ApiVersion:    0,
+		CorrelationID: corrID,
+		Payload:       reqBuf,
+	}
+
+	respCh := make(chan *protocol.RespCreateConsumerGroup)
+	errCh := make(chan error)
+
+	close := c.AppendListener(msg.CorrelationID, func(r *protocol.BaseResponse) {
+		resp, err := protocol.Deserialize[protocol.RespCreateConsumerGroup](r.Payload)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		respCh <- resp
+	}, true)
+
+	defer close()
+
+	err = c.SendMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err := <-errCh:
+		return nil, err
+	case resp := <-respCh:
+		return resp, nil
+	}
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"godel/internal/protocol"
+)
+
+func (c *Connection) DeleteConsumerGroup(topic, group string, force bool) (*protocol.RespDeleteConsumerGroup, error) {
+	corrID, err := GenerateCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := protocol.ReqDeleteConsumerGroup{
+		Topic: topic,
+		Group: group,
+		Force: force,
+	}
+
+	reqBuf, err := protocol.Serialize(req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &protocol.BaseRequest{
+		Cmd:           protocol.CmdDeleteConsumerGroup,
+		ApiVersion:    0,
+		CorrelationID: corrID,
+		Payload:       reqBuf,
+	}
+
+	respCh := make(chan *protocol.RespDeleteConsumerGroup)
+	errCh := make(chan error)
+
+	close := c.AppendListener(msg.CorrelationID, func(r *protocol.BaseResponse) {
+		resp, err := protocol.Deserialize[protocol.RespDeleteConsumerGroup](r.Payload)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		respCh <- resp
+	}, true)
+
+	defer close()
+
+	err = c.SendMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err := <-errCh:
+		return nil, err
+	case resp := <-respCh:
+		return resp, nil
+	}
+}
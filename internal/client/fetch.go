@@ -0,0 +1,54 @@
+package client
+
+import (
+	"godel/internal/protocol"
+)
+
+// Fetch reads the messages of a partition without joining a consumer group,
+// the broker responds once req.MinBytes are available or after req.MaxWaitMs.
+func (c *Connection) Fetch(req protocol.ReqFetch) (*protocol.RespFetch, error) {
+	corrID, err := GenerateCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+
+	apiVersion := c.ApiVersion(protocol.CmdFetch)
+
+	reqBuf, err := protocol.SerializeVersion(apiVersion, req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &protocol.BaseRequest{
+		Cmd:           protocol.CmdFetch,
+		ApiVersion:    apiVersion,
+		CorrelationID: corrID,
+		Payload:       reqBuf,
+	}
+
+	respCh := make(chan *protocol.RespFetch)
+	errCh := make(chan error)
+
+	close := c.AppendListener(msg.CorrelationID, func(r *protocol.BaseResponse) {
+		resp, err := protocol.DeserializeVersion[protocol.RespFetch](apiVersion, r.Payload)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		respCh <- resp
+	}, true)
+
+	defer close()
+
+	err = c.SendMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err := <-errCh:
+		return nil, err
+	case resp := <-respCh:
+		return resp, nil
+	}
+}
@@ -4,39 +4,44 @@ import (
 	"godel/internal/protocol"
 )
 
-func (c *Connection) Produce(topic string, key, payload []byte) (*protocol.RespCreateTopics, error) {
+// Produce sends the messages to the topic. With protocol.AcksNone
+// the broker doesn't respond, so a nil response is returned.
+func (c *Connection) Produce(topic string, acks int8, timeoutMs uint64, messages ...protocol.ReqProduceMessage) (*protocol.RespProduce, error) {
 	corrID, err := GenerateCorrelationID()
 	if err != nil {
 		return nil, err
 	}
 
+	apiVersion := c.ApiVersion(protocol.CmdProduce)
+
 	req := protocol.ReqProduce{
-		Topic: topic,
-		Messages: []protocol.ReqProduceMessage{
-			{
-				Key:   key,
-				Value: []byte(payload),
-			},
-		},
+		Topic:     topic,
+		Acks:      &acks,
+		TimeoutMs: timeoutMs,
+		Messages:  messages,
 	}
 
-	reqBuf, err := protocol.Serialize(req)
+	reqBuf, err := protocol.SerializeVersion(apiVersion, req)
 	if err != nil {
 		return nil, err
 	}
 
 	msg := &protocol.BaseRequest{
 		Cmd:           protocol.CmdProduce,
-		ApiVersion:    0,
+		ApiVersion:    apiVersion,
 		CorrelationID: corrID,
 		Payload:       reqBuf,
 	}
 
-	respCh := make(chan *protocol.RespCreateTopics)
+	if acks == protocol.AcksNone {
+		return nil, c.SendMessage(msg)
+	}
+
+	respCh := make(chan *protocol.RespProduce)
 	errCh := make(chan error)
 
 	c.AppendListener(msg.CorrelationID, func(r *protocol.BaseResponse) {
-		resp, err := protocol.Deserialize[protocol.RespCreateTopics](r.Payload)
+		resp, err := protocol.DeserializeVersion[protocol.RespProduce](apiVersion, r.Payload)
 		if err != nil {
 			errCh <- err
 			return
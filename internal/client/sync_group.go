@@ -0,0 +1,59 @@
+package client
+
+import (
+	"godel/internal/protocol"
+)
+
+// SyncGroup acknowledges the partitions revoked to the consumer by a rebalance
+// notification of the generation, once they are committed.
+func (c *Connection) SyncGroup(topic, group, consumerID string, generation uint32) (*protocol.RespSyncGroup, error) {
+	corrID, err := GenerateCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+
+	req := protocol.ReqSyncGroup{
+		Topic:      topic,
+		Group:      group,
+		ConsumerID: consumerID,
+		Generation: generation,
+	}
+
+	reqBuf, err := protocol.Serialize(req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &protocol.BaseRequest{
+		Cmd:           protocol.CmdSyncGroup,
+		ApiVersion:    0,
+		CorrelationID: corrID,
+		Payload:       reqBuf,
+	}
+
+	respCh := make(chan *protocol.RespSyncGroup)
+	errCh := make(chan error)
+
+	close := c.AppendListener(msg.CorrelationID, func(r *protocol.BaseResponse) {
+		resp, err := protocol.Deserialize[protocol.RespSyncGroup](r.Payload)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		respCh <- resp
+	}, true)
+
+	defer close()
+
+	err = c.SendMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err := <-errCh:
+		return nil, err
+	case resp := <-respCh:
+		return resp, nil
+	}
+}
@@ -0,0 +1,72 @@
+// Package partitioner implements the partitioners shared by the broker and
+// the client, so that both choose the same partition for the same key.
+package partitioner
+
+import "sync/atomic"
+
+// Partitioner chooses the partitions the messages of a produced batch are appended to.
+type Partitioner interface {
+	// Partition returns the partition number of every message key, in order.
+	Partition(keys [][]byte, numPartitions uint32) []uint32
+}
+
+// Murmur2 hashes the message key, so messages
+// without a key always land on the same partition.
+type Murmur2 struct{}
+
+func (p *Murmur2) Partition(keys [][]byte, numPartitions uint32) []uint32 {
+	partitions := make([]uint32, len(keys))
+	for i := range keys {
+		partitions[i] = Hash(keys[i], numPartitions)
+	}
+
+	return partitions
+}
+
+// RoundRobin hashes the message key, while
+// messages without a key are rotated across partitions.
+type RoundRobin struct {
+	next atomic.Uint32
+}
+
+func (p *RoundRobin) Partition(keys [][]byte, numPartitions uint32) []uint32 {
+	partitions := make([]uint32, len(keys))
+	for i := range keys {
+		if len(keys[i]) > 0 {
+			partitions[i] = Hash(keys[i], numPartitions)
+			continue
+		}
+
+		partitions[i] = (p.next.Add(1) - 1) % numPartitions
+	}
+
+	return partitions
+}
+
+// Sticky hashes the message key, while messages without a key of the same
+// batch stick to a single partition (so they're appended in a single write).
+// The partition is rotated on every batch.
+type Sticky struct {
+	next atomic.Uint32
+}
+
+func (p *Sticky) Partition(keys [][]byte, numPartitions uint32) []uint32 {
+	partitions := make([]uint32, len(keys))
+
+	var sticky *uint32
+	for i := range keys {
+		if len(keys[i]) > 0 {
+			partitions[i] = Hash(keys[i], numPartitions)
+			continue
+		}
+
+		if sticky == nil {
+			partition := (p.next.Add(1) - 1) % numPartitions
+			sticky = &partition
+		}
+
+		partitions[i] = *sticky
+	}
+
+	return partitions
+}
@@ -0,0 +1,508 @@
+package protocol
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+)
+
+// Payload encodings, negotiated with BaseRequest.ApiVersion. The response
+// payload uses the same encoding as the request.
+//
+// In ApiVersionBinary the produce, consume and fetch payloads (ReqProduce,
+// RespProduce, RespConsume and RespFetch) are binary encoded, so that keys and
+// values are sent as they are instead of base64 strings. Every other payload
+// is still JSON encoded.
+const (
+	ApiVersionJSON   int16 = 0
+	ApiVersionBinary int16 = 1
+)
+
+const ErrMalformedPayload = "malformed.payload"
+
+// Binary payloads are made of the following fields:
+//
+//	integers:       uvarint (signed integers are zigzag varints)
+//	bool:           1 byte
+//	strings, bytes: length (uvarint) | bytes
+//	nullable bytes: length + 1 (uvarint, 0 for nil) | bytes
+//	optional ints:  present (bool) | value
+//	headers:        count + 1 (uvarint, 0 for nil) | (key (string) | value (bytes))...
+//
+// Lists are encoded as count (uvarint) followed by the items.
+
+// SerializeVersion encodes the payload with the encoding of the api version.
+// Payloads without a binary encoding are always JSON encoded.
+func SerializeVersion(apiVersion int16, data any) ([]byte, error) {
+	if m, ok := data.(encoding.BinaryMarshaler); ok && apiVersion >= ApiVersionBinary {
+		return m.MarshalBinary()
+	}
+
+	return Serialize(data)
+}
+
+// DeserializeVersion decodes the payload with the encoding of the api version.
+// Payloads without a binary encoding are always JSON encoded.
+func DeserializeVersion[T any](apiVersion int16, b []byte) (*T, error) {
+	var out T
+	if u, ok := any(&out).(encoding.BinaryUnmarshaler); ok && apiVersion >= ApiVersionBinary {
+		err := u.UnmarshalBinary(b)
+		if err != nil {
+			return nil, err
+		}
+
+		return &out, nil
+	}
+
+	return Deserialize[T](b)
+}
+
+func (r ReqProduce) MarshalBinary() ([]byte, error) {
+	b := appendString(nil, r.Topic)
+	b = binary.AppendUvarint(b, r.TimeoutMs)
+
+	b = appendBool(b, r.Acks != nil)
+	if r.Acks != nil {
+		b = binary.AppendVarint(b, int64(*r.Acks))
+	}
+
+	b = appendBool(b, r.Durable)
+	b = appendString(b, r.TransactionalID)
+
+	b = binary.AppendUvarint(b, uint64(len(r.Messages)))
+	for _, m := range r.Messages {
+		b = appendNullableBytes(b, m.Key)
+		b = appendNullableBytes(b, m.Value)
+		b = appendHeaders(b, m.Headers)
+		b = binary.AppendUvarint(b, m.Timestamp)
+		b = appendOptionalUint(b, m.Partition)
+		b = binary.AppendUvarint(b, m.ProducerID)
+		b = binary.AppendUvarint(b, uint64(m.ProducerEpoch))
+		b = binary.AppendUvarint(b, uint64(m.Sequence))
+	}
+
+	return b, nil
+}
+
+func (r *ReqProduce) UnmarshalBinary(b []byte) error {
+	d := binaryDecoder{buf: b}
+
+	r.Topic = d.string()
+	r.TimeoutMs = d.uvarint()
+
+	if d.bool() {
+		acks := d.int8()
+		r.Acks = &acks
+	}
+
+	r.Durable = d.bool()
+	r.TransactionalID = d.string()
+
+	count := d.count(8)
+	r.Messages = make([]ReqProduceMessage, 0, count)
+	for range count {
+		r.Messages = append(r.Messages, ReqProduceMessage{
+			Key:           d.nullableBytes(),
+			Value:         d.nullableBytes(),
+			Headers:       d.headers(),
+			Timestamp:     d.uvarint(),
+			Partition:     d.optionalUint32(),
+			ProducerID:    d.uvarint(),
+			ProducerEpoch: d.uint16(),
+			Sequence:      d.uint32(),
+		})
+	}
+
+	return d.finish()
+}
+
+func (r RespProduce) MarshalBinary() ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(r.Messages)))
+	for _, m := range r.Messages {
+		b = appendString(b, m.Key)
+		b = appendOptionalUint(b, m.Partition)
+		b = appendOptionalUint(b, m.Offset)
+		b = appendBool(b, m.Duplicate)
+		b = binary.AppendVarint(b, int64(m.ErrorCode))
+		b = appendString(b, m.ErrorMessage)
+	}
+
+	return b, nil
+}
+
+func (r *RespProduce) UnmarshalBinary(b []byte) error {
+	d := binaryDecoder{buf: b}
+
+	count := d.count(6)
+	if count > 0 {
+		r.Messages = make([]RespProduceMessage, 0, count)
+	}
+
+	for range count {
+		r.Messages = append(r.Messages, RespProduceMessage{
+			Key:          d.string(),
+			Partition:    d.optionalUint32(),
+			Offset:       d.optionalUint64(),
+			Duplicate:    d.bool(),
+			ErrorCode:    d.errorCode(),
+			ErrorMessage: d.string(),
+		})
+	}
+
+	return d.finish()
+}
+
+func (r RespConsume) MarshalBinary() ([]byte, error) {
+	b := appendBool(nil, r.Stop)
+	b = binary.AppendVarint(b, int64(r.ErrorCode))
+	b = appendString(b, r.ErrorMessage)
+
+	b = appendConsumeMessages(b, r.Messages)
+
+	return b, nil
+}
+
+func (r *RespConsume) UnmarshalBinary(b []byte) error {
+	d := binaryDecoder{buf: b}
+
+	r.Stop = d.bool()
+	r.ErrorCode = d.errorCode()
+	r.ErrorMessage = d.string()
+
+	r.Messages = d.consumeMessages()
+
+	return d.finish()
+}
+
+func (r RespFetch) MarshalBinary() ([]byte, error) {
+	b := appendString(nil, r.Topic)
+	b = binary.AppendUvarint(b, uint64(r.Partition))
+	b = binary.AppendUvarint(b, r.NextOffset)
+	b = binary.AppendUvarint(b, r.HighWatermark)
+	b = binary.AppendUvarint(b, r.LastStableOffset)
+	b = binary.AppendVarint(b, int64(r.ErrorCode))
+	b = appendString(b, r.ErrorMessage)
+
+	b = appendConsumeMessages(b, r.Messages)
+
+	return b, nil
+}
+
+func (r *RespFetch) UnmarshalBinary(b []byte) error {
+	d := binaryDecoder{buf: b}
+
+	r.Topic = d.string()
+	r.Partition = d.uint32()
+	r.NextOffset = d.uvarint()
+	r.HighWatermark = d.uvarint()
+	r.LastStableOffset = d.uvarint()
+	r.ErrorCode = d.errorCode()
+	r.ErrorMessage = d.string()
+
+	r.Messages = d.consumeMessages()
+
+	return d.finish()
+}
+
+// appendConsumeMessages encodes the messages of RespConsume and RespFetch,
+// preceded by a bool telling a nil list apart from an empty one.
+func appendConsumeMessages(b []byte, messages []RespConsumeMessage) []byte {
+	b = appendBool(b, messages != nil)
+	b = binary.AppendUvarint(b, uint64(len(messages)))
+	for _, m := range messages {
+		b = appendString(b, m.Key)
+		b = appendString(b, m.Group)
+		b = appendOptionalUint(b, m.Partition)
+		b = appendOptionalUint(b, m.Offset)
+		b = appendNullableBytes(b, m.Payload)
+		b = binary.AppendVarint(b, int64(m.ErrorCode))
+		b = appendString(b, m.ErrorMessage)
+		b = appendHeaders(b, m.Headers)
+	}
+
+	return b
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+
+	return append(b, 0)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendNullableBytes(b []byte, v []byte) []byte {
+	if v == nil {
+		return binary.AppendUvarint(b, 0)
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(v))+1)
+	return append(b, v...)
+}
+
+func appendOptionalUint[T uint32 | uint64](b []byte, v *T) []byte {
+	b = appendBool(b, v != nil)
+	if v != nil {
+		b = binary.AppendUvarint(b, uint64(*v))
+	}
+
+	return b
+}
+
+// appendHeaders encodes the headers sorted by key,
+// so that the same headers always get the same bytes.
+func appendHeaders(b []byte, headers map[string][]byte) []byte {
+	if headers == nil {
+		return binary.AppendUvarint(b, 0)
+	}
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	b = binary.AppendUvarint(b, uint64(len(keys))+1)
+	for _, k := range keys {
+		b = appendString(b, k)
+		b = appendNullableBytes(b, headers[k])
+	}
+
+	return b
+}
+
+// binaryDecoder decodes the fields of a binary payload keeping track
+// of the first error, so that it can be checked only once (see finish).
+type binaryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *binaryDecoder) fail() {
+	if d.err == nil {
+		d.err = errors.New(ErrMalformedPayload)
+	}
+}
+
+// finish returns the first decoding error. Trailing bytes are an error as well.
+func (d *binaryDecoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail()
+	}
+
+	return d.err
+}
+
+// overlong reports whether a varint has more bytes than needed, so that
+// every value has a single encoding.
+func overlong(varint []byte) bool {
+	return len(varint) > 1 && varint[len(varint)-1] == 0
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 || overlong(d.buf[:max(n, 0)]) {
+		d.fail()
+		return 0
+	}
+
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.buf)
+	if n <= 0 || overlong(d.buf[:max(n, 0)]) {
+		d.fail()
+		return 0
+	}
+
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *binaryDecoder) bool() bool {
+	b := d.bytes(1)
+	if d.err != nil {
+		return false
+	}
+
+	if b[0] > 1 {
+		d.fail()
+		return false
+	}
+
+	return b[0] == 1
+}
+
+func (d *binaryDecoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *binaryDecoder) string() string {
+	return string(d.bytes(d.uvarint()))
+}
+
+func (d *binaryDecoder) nullableBytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+
+	// copied, so that the decoded payload doesn't hold the whole buffer
+	return slices.Clone(d.bytes(n - 1))
+}
+
+// errorCode reads an ErrorCode, an int that is narrower than the varint on 32-bit platforms.
+func (d *binaryDecoder) errorCode() ErrorCode {
+	v := d.varint()
+	if v < math.MinInt || v > math.MaxInt {
+		d.fail()
+		return 0
+	}
+
+	return ErrorCode(v)
+}
+
+func (d *binaryDecoder) int8() int8 {
+	v := d.varint()
+	if v < math.MinInt8 || v > math.MaxInt8 {
+		d.fail()
+		return 0
+	}
+
+	return int8(v)
+}
+
+func (d *binaryDecoder) uint16() uint16 {
+	v := d.uvarint()
+	if v > math.MaxUint16 {
+		d.fail()
+		return 0
+	}
+
+	return uint16(v)
+}
+
+func (d *binaryDecoder) uint32() uint32 {
+	v := d.uvarint()
+	if v > math.MaxUint32 {
+		d.fail()
+		return 0
+	}
+
+	return uint32(v)
+}
+
+func (d *binaryDecoder) optionalUint32() *uint32 {
+	if !d.bool() {
+		return nil
+	}
+
+	v := d.uint32()
+	return &v
+}
+
+func (d *binaryDecoder) optionalUint64() *uint64 {
+	if !d.bool() {
+		return nil
+	}
+
+	v := d.uvarint()
+	return &v
+}
+
+// count reads a list length, every item of the list takes at least minItemSize
+// bytes, so larger counts are rejected before allocating the list.
+func (d *binaryDecoder) count(minItemSize int) int {
+	n := d.uvarint()
+	if d.err != nil {
+		return 0
+	}
+
+	if n > uint64(len(d.buf)/minItemSize) {
+		d.fail()
+		return 0
+	}
+
+	return int(n)
+}
+
+// consumeMessages decodes the messages encoded by appendConsumeMessages.
+func (d *binaryDecoder) consumeMessages() []RespConsumeMessage {
+	hasMessages := d.bool()
+	count := d.count(8)
+	if !hasMessages {
+		return nil
+	}
+
+	messages := make([]RespConsumeMessage, 0, count)
+	for range count {
+		messages = append(messages, RespConsumeMessage{
+			Key:          d.string(),
+			Group:        d.string(),
+			Partition:    d.optionalUint32(),
+			Offset:       d.optionalUint64(),
+			Payload:      d.nullableBytes(),
+			ErrorCode:    d.errorCode(),
+			ErrorMessage: d.string(),
+			Headers:      d.headers(),
+		})
+	}
+
+	return messages
+}
+
+func (d *binaryDecoder) headers() map[string][]byte {
+	n := d.uvarint()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+
+	// every header takes at least 2 bytes
+	count := n - 1
+	if count > uint64(len(d.buf)/2) {
+		d.fail()
+		return nil
+	}
+
+	headers := make(map[string][]byte, count)
+	for range count {
+		key := d.string()
+		value := d.nullableBytes()
+		if d.err != nil {
+			return nil
+		}
+
+		headers[key] = value
+	}
+
+	return headers
+}
@@ -0,0 +1,338 @@
+package protocol
+
+import (
+	"encoding"
+	"reflect"
+	"testing"
+)
+
+// roundTrip marshals the payload, unmarshals it into out and checks that
+// out is the same as the payload.
+func roundTrip[T any, PT interface {
+	*T
+	encoding.BinaryUnmarshaler
+}](t *testing.T, in encoding.BinaryMarshaler) {
+	t.Helper()
+
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	out := PT(new(T))
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	if !reflect.DeepEqual(in, *out) {
+		t.Fatalf("round trip mismatch:\n in: %#v\nout: %#v", in, *out)
+	}
+}
+
+// unmarshalArbitrary decodes arbitrary bytes, that must fail with an error
+// and never panic. Payloads decoded without errors must be encoded back to
+// the same bytes, since every payload has a single encoding.
+func unmarshalArbitrary[T any, PT interface {
+	*T
+	encoding.BinaryUnmarshaler
+}](t *testing.T, b []byte) {
+	t.Helper()
+
+	out := PT(new(T))
+	if err := out.UnmarshalBinary(b); err != nil {
+		if err.Error() != ErrMalformedPayload {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+
+	m, ok := any(*out).(encoding.BinaryMarshaler)
+	if !ok {
+		t.Fatalf("%T is not a binary marshaler", *out)
+	}
+
+	again, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	if string(again) != string(b) {
+		t.Fatalf("decoded payload encoded differently:\n in: %x\nout: %x", b, again)
+	}
+}
+
+// fuzzHeaders builds headers from a key and a value, nil when the key is empty.
+func fuzzHeaders(key string, value []byte) map[string][]byte {
+	if key == "" {
+		return nil
+	}
+
+	return map[string][]byte{key: value, key + "-2": nil}
+}
+
+// fuzzBytes returns nil for empty bytes when null is true,
+// so that nil and empty bytes are both covered.
+func fuzzBytes(b []byte, null bool) []byte {
+	if len(b) == 0 && null {
+		return nil
+	}
+	if b == nil {
+		return []byte{}
+	}
+
+	return b
+}
+
+func FuzzReqProduceRoundTrip(f *testing.F) {
+	f.Add("topic", uint64(1000), int8(-1), true, false, "txn", []byte("key"), []byte("value"), "h", []byte("v"), uint64(1700000000), uint32(2), true, uint64(7), uint16(1), uint32(42), 3)
+	f.Add("", uint64(0), int8(0), false, true, "", []byte{}, []byte{}, "", []byte{}, uint64(0), uint32(0), false, uint64(0), uint16(0), uint32(0), 0)
+
+	f.Fuzz(func(t *testing.T, topic string, timeoutMs uint64, acks int8, hasAcks, durable bool, txnID string,
+		key, value []byte, headerKey string, headerValue []byte,
+		timestamp uint64, partition uint32, hasPartition bool, producerID uint64, epoch uint16, sequence uint32, count int) {
+
+		r := ReqProduce{
+			Topic:           topic,
+			TimeoutMs:       timeoutMs,
+			Durable:         durable,
+			TransactionalID: txnID,
+			Messages:        []ReqProduceMessage{},
+		}
+
+		if hasAcks {
+			r.Acks = &acks
+		}
+
+		for i := range count % 4 {
+			m := ReqProduceMessage{
+				Key:           fuzzBytes(key, i%2 == 0),
+				Value:         fuzzBytes(value, i%2 == 1),
+				Headers:       fuzzHeaders(headerKey, headerValue),
+				Timestamp:     timestamp,
+				ProducerID:    producerID,
+				ProducerEpoch: epoch,
+				Sequence:      sequence + uint32(i),
+			}
+
+			if hasPartition {
+				p := partition
+				m.Partition = &p
+			}
+
+			r.Messages = append(r.Messages, m)
+		}
+
+		roundTrip[ReqProduce](t, r)
+	})
+}
+
+func FuzzRespProduceRoundTrip(f *testing.F) {
+	f.Add("key", uint32(1), true, uint64(10), true, false, 5, "topic.not.found", 2)
+	f.Add("", uint32(0), false, uint64(0), false, true, 0, "", 0)
+
+	f.Fuzz(func(t *testing.T, key string, partition uint32, hasPartition bool, offset uint64, hasOffset, duplicate bool,
+		errorCode int, errorMessage string, count int) {
+
+		r := RespProduce{}
+
+		for range count % 4 {
+			m := RespProduceMessage{
+				Key:          key,
+				Duplicate:    duplicate,
+				ErrorCode:    ErrorCode(errorCode),
+				ErrorMessage: errorMessage,
+			}
+
+			if hasPartition {
+				p := partition
+				m.Partition = &p
+			}
+
+			if hasOffset {
+				o := offset
+				m.Offset = &o
+			}
+
+			r.Messages = append(r.Messages, m)
+		}
+
+		roundTrip[RespProduce](t, r)
+	})
+}
+
+// fuzzConsumeMessages builds the messages of RespConsume and RespFetch,
+// nil when count is negative.
+func fuzzConsumeMessages(count int, key, group string, partition uint32, offset uint64, hasOffsets bool,
+	payload []byte, headerKey string, headerValue []byte) []RespConsumeMessage {
+
+	if count < 0 {
+		return nil
+	}
+
+	messages := []RespConsumeMessage{}
+	for i := range count % 4 {
+		m := RespConsumeMessage{
+			Key:     key,
+			Group:   group,
+			Payload: fuzzBytes(payload, i%2 == 0),
+			Headers: fuzzHeaders(headerKey, headerValue),
+		}
+
+		if hasOffsets {
+			p, o := partition, offset+uint64(i)
+			m.Partition, m.Offset = &p, &o
+		}
+
+		messages = append(messages, m)
+	}
+
+	return messages
+}
+
+func FuzzRespConsumeRoundTrip(f *testing.F) {
+	f.Add(false, 0, "", 2, "key", "group", uint32(1), uint64(10), true, []byte("payload"), "h", []byte("v"))
+	f.Add(true, 11, "consumer.not.found", -1, "", "", uint32(0), uint64(0), false, []byte{}, "", []byte{})
+
+	f.Fuzz(func(t *testing.T, stop bool, errorCode int, errorMessage string, count int,
+		key, group string, partition uint32, offset uint64, hasOffsets bool,
+		payload []byte, headerKey string, headerValue []byte) {
+
+		r := RespConsume{
+			Stop:         stop,
+			ErrorCode:    ErrorCode(errorCode),
+			ErrorMessage: errorMessage,
+			Messages:     fuzzConsumeMessages(count, key, group, partition, offset, hasOffsets, payload, headerKey, headerValue),
+		}
+
+		roundTrip[RespConsume](t, r)
+	})
+}
+
+func FuzzRespFetchRoundTrip(f *testing.F) {
+	f.Add("topic", uint32(0), uint64(5), uint64(10), uint64(8), 0, "", 3, "key", uint32(0), uint64(5), true, []byte("payload"), "h", []byte("v"))
+	f.Add("", uint32(9), uint64(0), uint64(0), uint64(0), 7, "partition.not.found", -1, "", uint32(0), uint64(0), false, []byte{}, "", []byte{})
+
+	f.Fuzz(func(t *testing.T, topic string, partition uint32, nextOffset, highWatermark, lastStableOffset uint64,
+		errorCode int, errorMessage string, count int,
+		key string, messagePartition uint32, offset uint64, hasOffsets bool,
+		payload []byte, headerKey string, headerValue []byte) {
+
+		r := RespFetch{
+			Topic:            topic,
+			Partition:        partition,
+			NextOffset:       nextOffset,
+			HighWatermark:    highWatermark,
+			LastStableOffset: lastStableOffset,
+			ErrorCode:        ErrorCode(errorCode),
+			ErrorMessage:     errorMessage,
+			Messages:         fuzzConsumeMessages(count, key, "", messagePartition, offset, hasOffsets, payload, headerKey, headerValue),
+		}
+
+		roundTrip[RespFetch](t, r)
+	})
+}
+
+// seedMalformed adds the encoding of a valid payload to the corpus, along with
+// its truncations, a trailing byte and an oversized list count.
+func seedMalformed(f *testing.F, valid encoding.BinaryMarshaler) {
+	b, err := valid.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(b)
+	for i := range b {
+		f.Add(b[:i])
+	}
+
+	f.Add(append(b, 0))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+}
+
+func validReqProduce() ReqProduce {
+	acks, partition := int8(1), uint32(1)
+	return ReqProduce{
+		Topic: "topic",
+		Acks:  &acks,
+		Messages: []ReqProduceMessage{
+			{Key: []byte("k"), Value: []byte("v"), Headers: map[string][]byte{"h": []byte("v")}, Partition: &partition},
+			{Value: []byte("v2")},
+		},
+	}
+}
+
+func validConsumeMessages() []RespConsumeMessage {
+	partition, offset := uint32(0), uint64(3)
+	return []RespConsumeMessage{
+		{Key: "k", Partition: &partition, Offset: &offset, Payload: []byte("p"), Headers: map[string][]byte{"h": nil}},
+	}
+}
+
+func FuzzReqProduceUnmarshal(f *testing.F) {
+	seedMalformed(f, validReqProduce())
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		unmarshalArbitrary[ReqProduce](t, b)
+	})
+}
+
+func FuzzRespProduceUnmarshal(f *testing.F) {
+	partition, offset := uint32(1), uint64(10)
+	seedMalformed(f, RespProduce{Messages: []RespProduceMessage{
+		{Key: "k", Partition: &partition, Offset: &offset},
+		{ErrorCode: ErrCodeMessageTooLarge, ErrorMessage: ErrMessageTooLarge},
+	}})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		unmarshalArbitrary[RespProduce](t, b)
+	})
+}
+
+func FuzzRespConsumeUnmarshal(f *testing.F) {
+	seedMalformed(f, RespConsume{Messages: validConsumeMessages()})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		unmarshalArbitrary[RespConsume](t, b)
+	})
+}
+
+func FuzzRespFetchUnmarshal(f *testing.F) {
+	seedMalformed(f, RespFetch{Topic: "topic", NextOffset: 4, HighWatermark: 4, Messages: validConsumeMessages()})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		unmarshalArbitrary[RespFetch](t, b)
+	})
+}
+
+func TestUnmarshalBinaryMalformed(t *testing.T) {
+	valid, err := validReqProduce().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "empty", b: []byte{}},
+		{name: "truncated", b: valid[:len(valid)-1]},
+		{name: "trailing bytes", b: append(valid, 0)},
+		{name: "invalid bool", b: append(appendString(nil, "t"), 0, 2)},
+		// topic, timeout, no acks, not durable, no transaction, a huge messages count
+		{name: "oversized count", b: []byte{0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{name: "overlong varint", b: []byte{0x80, 0x00}},
+		// topic, timeout, acks of 200 that doesn't fit an int8
+		{name: "out of range acks", b: []byte{0, 0, 1, 0x90, 0x03, 0, 0, 0}},
+		{name: "overflowing varint", b: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r ReqProduce
+			err := r.UnmarshalBinary(tt.b)
+			if err == nil || err.Error() != ErrMalformedPayload {
+				t.Fatalf("UnmarshalBinary() error = %v, want %s", err, ErrMalformedPayload)
+			}
+		})
+	}
+}
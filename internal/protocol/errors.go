@@ -1,5 +1,7 @@
 package protocol
 
+import "strings"
+
 const ErrTopicNotFound = "topic.not.found"
 const ErrConsumerIdAlreadyExists = "consumer.id.already.exists"
 const ErrPartitionAlreadyExists = "partition.already.exists"
@@ -12,3 +14,143 @@ const ErrConsumerGroupsPartitionsMismatch = "consumer.groups.partitions.mismatch
 const ErrMissingGroupName = "missing.group.name"
 const ErrMissingConsumerId = "missing.consumer.id"
 const ErrConsumerAlreadyStarted = "consumer.already.started"
+const ErrPartitionNotFound = "partition.not.found"
+const ErrCorruptRecord = "corrupt.record"
+const ErrInvalidTimestamp = "invalid.timestamp"
+const ErrOutOfOrderSequence = "out.of.order.sequence.number"
+const ErrInvalidProducerEpoch = "invalid.producer.epoch"
+const ErrTransactionNotFound = "transaction.not.found"
+const ErrInvalidTransactionState = "invalid.transaction.state"
+const ErrPartitionNotInTransaction = "partition.not.in.transaction"
+const ErrRequestTimedOut = "request.timed.out"
+const ErrMessageTooLarge = "message.too.large"
+const ErrRequestTooLarge = "request.too.large"
+const ErrUnsupportedVersion = "unsupported.version"
+const ErrNotCoordinator = "not.coordinator"
+const ErrIllegalGeneration = "illegal.generation"
+const ErrInconsistentGroupProtocol = "inconsistent.group.protocol"
+const ErrConsumerGroupAlreadyExists = "consumer.group.already.exists"
+const ErrConsumerGroupNotEmpty = "consumer.group.not.empty"
+const ErrInvalidRequest = "invalid.request"
+const ErrInvalidConfig = "invalid.config"
+
+// ErrorCode is the code of the error of a response, sent along with the
+// error message. 0 means no error, while errors without a dedicated code
+// (e.g. I/O errors) have ErrCodeUnknown.
+type ErrorCode int
+
+// Error codes are part of the protocol: existing codes must never change.
+const (
+	ErrCodeNone                             ErrorCode = 0
+	ErrCodeUnknown                          ErrorCode = 1
+	ErrCodeRequestTimedOut                  ErrorCode = 2
+	ErrCodeMessageTooLarge                  ErrorCode = 3
+	ErrCodeUnsupportedVersion               ErrorCode = 4
+	ErrCodeTopicNotFound                    ErrorCode = 5
+	ErrCodeTopicAlreadyExists               ErrorCode = 6
+	ErrCodePartitionNotFound                ErrorCode = 7
+	ErrCodePartitionAlreadyExists           ErrorCode = 8
+	ErrCodePartitionsNumMismatch            ErrorCode = 9
+	ErrCodeConsumerGroupNotFound            ErrorCode = 10
+	ErrCodeConsumerNotFound                 ErrorCode = 11
+	ErrCodeConsumerIdAlreadyExists          ErrorCode = 12
+	ErrCodeConsumerAlreadyStarted           ErrorCode = 13
+	ErrCodeConsumerGroupsOffsetsMismatch    ErrorCode = 14
+	ErrCodeConsumerGroupsPartitionsMismatch ErrorCode = 15
+	ErrCodeMissingGroupName                 ErrorCode = 16
+	ErrCodeMissingConsumerId                ErrorCode = 17
+	ErrCodeCorruptRecord                    ErrorCode = 18
+	ErrCodeInvalidTimestamp                 ErrorCode = 19
+	ErrCodeOutOfOrderSequence               ErrorCode = 20
+	ErrCodeInvalidProducerEpoch             ErrorCode = 21
+	ErrCodeTransactionNotFound              ErrorCode = 22
+	ErrCodeInvalidTransactionState          ErrorCode = 23
+	ErrCodePartitionNotInTransaction        ErrorCode = 24
+	ErrCodeRequestTooLarge                  ErrorCode = 25
+	ErrCodeNotCoordinator                   ErrorCode = 26 // reserved until groups and transactions are distributed
+	ErrCodeIllegalGeneration                ErrorCode = 27
+	ErrCodeInconsistentGroupProtocol        ErrorCode = 28
+	ErrCodeConsumerGroupAlreadyExists       ErrorCode = 29
+	ErrCodeConsumerGroupNotEmpty            ErrorCode = 30
+	ErrCodeInvalidRequest                   ErrorCode = 31
+	ErrCodeInvalidConfig                    ErrorCode = 32
+)
+
+type errorCodeInfo struct {
+	message   string
+	retriable bool
+}
+
+// errorCodes holds the message and the retry classification of every error code.
+//
+// Retriable errors are transient: the same request may succeed if sent again
+// (e.g. timed out requests, or a coordinator moved to another broker). Every
+// other error is fatal for the request, that fails again until the request
+// or the broker state is changed (e.g. the topic is created).
+//
+// Idempotent producers must not retry fatal sequence and epoch errors with the
+// same producer id: a new one must be requested with CmdInitProducerId.
+var errorCodes = map[ErrorCode]errorCodeInfo{
+	ErrCodeRequestTimedOut:                  {ErrRequestTimedOut, true},
+	ErrCodeMessageTooLarge:                  {ErrMessageTooLarge, false},
+	ErrCodeUnsupportedVersion:               {ErrUnsupportedVersion, false},
+	ErrCodeTopicNotFound:                    {ErrTopicNotFound, false},
+	ErrCodeTopicAlreadyExists:               {ErrTopicAlreadyExists, false},
+	ErrCodePartitionNotFound:                {ErrPartitionNotFound, false},
+	ErrCodePartitionAlreadyExists:           {ErrPartitionAlreadyExists, false},
+	ErrCodePartitionsNumMismatch:            {ErrPartitionsNumMismatch, false},
+	ErrCodeConsumerGroupNotFound:            {ErrConsumerGroupNotFound, false},
+	ErrCodeConsumerNotFound:                 {ErrConsumerNotFound, false},
+	ErrCodeConsumerIdAlreadyExists:          {ErrConsumerIdAlreadyExists, false},
+	ErrCodeConsumerAlreadyStarted:           {ErrConsumerAlreadyStarted, false},
+	ErrCodeConsumerGroupsOffsetsMismatch:    {ErrConsumerGroupsOffsetsMismatch, false},
+	ErrCodeConsumerGroupsPartitionsMismatch: {ErrConsumerGroupsPartitionsMismatch, false},
+	ErrCodeMissingGroupName:                 {ErrMissingGroupName, false},
+	ErrCodeMissingConsumerId:                {ErrMissingConsumerId, false},
+	ErrCodeCorruptRecord:                    {ErrCorruptRecord, false},
+	ErrCodeInvalidTimestamp:                 {ErrInvalidTimestamp, false},
+	ErrCodeOutOfOrderSequence:               {ErrOutOfOrderSequence, false},
+	ErrCodeInvalidProducerEpoch:             {ErrInvalidProducerEpoch, false},
+	ErrCodeTransactionNotFound:              {ErrTransactionNotFound, false},
+	ErrCodeInvalidTransactionState:          {ErrInvalidTransactionState, false},
+	ErrCodePartitionNotInTransaction:        {ErrPartitionNotInTransaction, false},
+	ErrCodeRequestTooLarge:                  {ErrRequestTooLarge, false},
+	ErrCodeNotCoordinator:                   {ErrNotCoordinator, true},
+	ErrCodeIllegalGeneration:                {ErrIllegalGeneration, false},
+	ErrCodeInconsistentGroupProtocol:        {ErrInconsistentGroupProtocol, false},
+	ErrCodeConsumerGroupAlreadyExists:       {ErrConsumerGroupAlreadyExists, false},
+	ErrCodeConsumerGroupNotEmpty:            {ErrConsumerGroupNotEmpty, false},
+	ErrCodeInvalidRequest:                   {ErrInvalidRequest, false},
+	ErrCodeInvalidConfig:                    {ErrInvalidConfig, false},
+}
+
+// ErrorCodeOf returns the error code of an error returned by the broker,
+// matching its message (or the message prefix, for errors carrying details
+// after a colon, like "corrupt.record: topic ..."). It returns ErrCodeNone
+// for a nil error and ErrCodeUnknown for errors without a dedicated code.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ErrCodeNone
+	}
+
+	message, _, _ := strings.Cut(err.Error(), ":")
+	for code, info := range errorCodes {
+		if info.message == message {
+			return code
+		}
+	}
+
+	return ErrCodeUnknown
+}
+
+// Message returns the error message of the code, empty for ErrCodeNone
+// and ErrCodeUnknown since their message is not known in advance.
+func (c ErrorCode) Message() string {
+	return errorCodes[c].message
+}
+
+// Retriable reports whether a request failed with the code may succeed
+// if sent again (see errorCodes for the retry classification).
+func (c ErrorCode) Retriable() bool {
+	return errorCodes[c].retriable
+}
@@ -9,19 +9,43 @@ import (
 )
 
 const (
-	CmdProduce            int16 = 1
-	CmdConsume            int16 = 2
-	CmdListTopics         int16 = 3
-	CmdCreateConsumer     int16 = 4
-	CmdDeleteTopic        int16 = 5
-	CmdNotifyRebalabce    int16 = 6
-	CmdGetTopic           int16 = 7
-	CmdCommitOffset       int16 = 8
-	CmdHeartbeat          int16 = 9
-	CmdDeleteConsumer     int16 = 10
-	CmdListConsumerGroups int16 = 11
-	CmdCreateTopics       int16 = 12
-	CmdGetConsumerGroup   int16 = 13
+	CmdProduce             int16 = 1
+	CmdConsume             int16 = 2
+	CmdListTopics          int16 = 3
+	CmdCreateConsumer      int16 = 4
+	CmdDeleteTopic         int16 = 5
+	CmdNotifyRebalabce     int16 = 6
+	CmdGetTopic            int16 = 7
+	CmdCommitOffset        int16 = 8
+	CmdHeartbeat           int16 = 9
+	CmdDeleteConsumer      int16 = 10
+	CmdListConsumerGroups  int16 = 11
+	CmdCreateTopics        int16 = 12
+	CmdGetConsumerGroup    int16 = 13
+	CmdListOffsets         int16 = 14
+	CmdInitProducerId      int16 = 15
+	CmdBeginTransaction    int16 = 16
+	CmdAddPartitionsToTxn  int16 = 17
+	CmdEndTransaction      int16 = 18
+	CmdApiVersions         int16 = 19
+	CmdFetch               int16 = 20
+	CmdSyncGroup           int16 = 21
+	CmdCreateConsumerGroup int16 = 22
+	CmdDeleteConsumerGroup int16 = 23
+	CmdResetOffsets        int16 = 24
+)
+
+// produce acknowledgement levels (acks)
+const (
+	AcksNone   int8 = 0  // no response is sent
+	AcksLeader int8 = 1  // response sent after the local append
+	AcksAll    int8 = -1 // response sent after all the replicas append (fsync until replication exists)
+)
+
+// special timestamps for the list offsets command
+const (
+	ListOffsetsLatest   int64 = -1
+	ListOffsetsEarliest int64 = -2
 )
 
 type BaseRequest struct {
@@ -31,7 +55,13 @@ type BaseRequest struct {
 	Payload       []byte
 }
 
-func DeserializeRequest(r io.Reader) (*BaseRequest, error) {
+// request header size: inner length (4), cmd (2), api version (2), correlation id (4)
+const requestHeaderSize = 4 + 2 + 2 + 4
+
+// DeserializeRequest reads a request frame. Frames larger than maxBytes
+// (socket.request.max.bytes) are rejected before allocating them, so the
+// connection must be closed since the stream can't be read any further.
+func DeserializeRequest(r io.Reader, maxBytes int64) (*BaseRequest, error) {
 	lenBuf := make([]byte, 4)
 	_, err := io.ReadFull(r, lenBuf)
 	if err != nil {
@@ -39,6 +69,13 @@ func DeserializeRequest(r io.Reader) (*BaseRequest, error) {
 	}
 
 	reqLen := binary.BigEndian.Uint32(lenBuf)
+	if maxBytes > 0 && int64(reqLen) > maxBytes {
+		return nil, errors.New(ErrRequestTooLarge)
+	}
+
+	if reqLen < requestHeaderSize {
+		return nil, errors.New("request too short")
+	}
 
 	req := make([]byte, reqLen)
 	_, err = io.ReadFull(r, req)
@@ -7,20 +7,31 @@ type ReqCommitOffset struct {
 	Partition uint32 `json:"parition"`
 	Offset    uint64 `json:"offset"`
 	Group     string `json:"consumerGroup"`
+
+	// when the generation is set, the offset is committed only if the
+	// consumer owns the partition in the current group generation
+	ConsumerID string `json:"consumerId,omitempty"`
+	Generation uint32 `json:"generation,omitempty"`
+
+	// when set, the offset is committed with the ongoing transaction
+	TransactionalID string `json:"transactionalId,omitempty"`
+	ProducerID      uint64 `json:"producerId,omitempty"`
+	ProducerEpoch   uint16 `json:"producerEpoch,omitempty"`
 }
 
 type ReqConsume struct {
-	ID              string `json:"id"`
-	Topic           string `json:"topic"`
-	Group           string `json:"group"`
-	FromBeginning   bool   `json:"fromBeginning"`
-	TimeoutMs       uint64 `json:"timeoutMs"`
+	ID              string            `json:"id"`
+	Topic           string            `json:"topic"`
+	Group           string            `json:"group"`
+	FromBeginning   bool              `json:"fromBeginning"`
+	TimeoutMs       uint64            `json:"timeoutMs"`
+	StartOffsets    map[uint32]uint64 `json:"startOffsets,omitempty"`
 	ConsumerOptions options.ConsumerOptions
 }
 
 type ReqCreateTopics struct {
 	Topics    []ReqCreateTopicTopic `json:"topics"`
-	TimeoutMs uint64                `json:"timeoutMs"`
+	TimeoutMs uint64                `json:"timeoutMs"` // 0 for no timeout
 }
 
 type ReqCreateTopicTopic struct {
@@ -51,12 +62,35 @@ type ReqListTopics struct {
 type ReqProduce struct {
 	Topic     string              `json:"topic"`
 	Messages  []ReqProduceMessage `json:"message"`
-	TimeoutMs uint64              `json:"timeoutMs"`
+	TimeoutMs uint64              `json:"timeoutMs"` // 0 for no timeout
+
+	// acknowledgement level (AcksNone, AcksLeader or AcksAll), AcksLeader if missing
+	Acks *int8 `json:"acks,omitempty"`
+
+	// wait for the messages to be synced to disk before responding (same as AcksAll)
+	Durable bool `json:"durable,omitempty"`
+
+	// when set, the messages are produced inside the ongoing transaction
+	TransactionalID string `json:"transactionalId,omitempty"`
 }
 
 type ReqProduceMessage struct {
-	Key   []byte `json:"key"`
-	Value []byte `json:"value"`
+	Key     []byte            `json:"key"`
+	Value   []byte            `json:"value"`
+	Headers map[string][]byte `json:"headers,omitempty"`
+
+	// create time in unix seconds, set by the broker if missing
+	Timestamp uint64 `json:"timestamp,omitempty"`
+
+	// explicit partition, chosen by the topic partitioner if missing
+	Partition *uint32 `json:"partition,omitempty"`
+
+	// idempotent producer fields (see CmdInitProducerId), the sequence
+	// starts from 0 and is incremented by 1 for every message sent to
+	// the same partition. A 0 producer id disables the duplicates check.
+	ProducerID    uint64 `json:"producerId,omitempty"`
+	ProducerEpoch uint16 `json:"producerEpoch,omitempty"`
+	Sequence      uint32 `json:"sequence,omitempty"`
 }
 
 type ReqCreateConsumer struct {
@@ -74,7 +108,93 @@ type ReqGetTopic struct {
 	Topic string `json:"topic"`
 }
 
+type ReqListOffsets struct {
+	Topic      string   `json:"topic"`
+	Partitions []uint32 `json:"partitions,omitempty"`
+	Timestamp  int64    `json:"timestamp"`
+}
+
 type ReqGetConsumerGroup struct {
-	Topic string `json:topic"`
+	Topic string `json:"topic"`
 	Name  string `json:"name"`
 }
+
+type ReqInitProducerId struct {
+	// optional, transactional producers keep the same producer id across restarts
+	TransactionalID string `json:"transactionalId,omitempty"`
+}
+
+type ReqBeginTransaction struct {
+	TransactionalID string `json:"transactionalId"`
+	ProducerID      uint64 `json:"producerId"`
+	ProducerEpoch   uint16 `json:"producerEpoch"`
+}
+
+type ReqAddPartitionsToTxn struct {
+	TransactionalID string   `json:"transactionalId"`
+	ProducerID      uint64   `json:"producerId"`
+	ProducerEpoch   uint16   `json:"producerEpoch"`
+	Topic           string   `json:"topic"`
+	Partitions      []uint32 `json:"partitions"`
+}
+
+type ReqEndTransaction struct {
+	TransactionalID string `json:"transactionalId"`
+	ProducerID      uint64 `json:"producerId"`
+	ProducerEpoch   uint16 `json:"producerEpoch"`
+	Commit          bool   `json:"commit"` // abort if false
+}
+
+type ReqApiVersions struct{}
+
+// ReqFetch reads the messages of a partition without joining a consumer group.
+// The response is sent as soon as MinBytes are available, or after MaxWaitMs.
+type ReqFetch struct {
+	Topic          string                 `json:"topic"`
+	Partition      uint32                 `json:"partition"`
+	Offset         uint64                 `json:"offset"`
+	MaxBytes       int64                  `json:"maxBytes"`  // options.DefaultFetchMaxBytes if missing
+	MinBytes       int64                  `json:"minBytes"`  // 0 to respond immediately
+	MaxWaitMs      uint64                 `json:"maxWaitMs"` // clamped to options.MaxFetchWaitMs
+	IsolationLevel options.IsolationLevel `json:"isolationLevel,omitempty"`
+}
+
+// ReqSyncGroup acknowledges the partitions revoked by a rebalance notification
+// (see RespNotifyRebalance), once the consumer stopped processing and committed
+// them: the group assigns them to other consumers only after that.
+type ReqSyncGroup struct {
+	Topic      string `json:"topic"`
+	Group      string `json:"group"`
+	ConsumerID string `json:"consumerId"`
+	Generation uint32 `json:"generation"`
+}
+
+type ReqCreateConsumerGroup struct {
+	Topic string `json:"topic"`
+	Group string `json:"group"`
+}
+
+type ReqDeleteConsumerGroup struct {
+	Topic string `json:"topic"`
+	Group string `json:"group"`
+	Force bool   `json:"force,omitempty"` // removes the consumers of the group
+}
+
+// ReqResetOffsets moves the committed offsets of a consumer group, exactly one
+// of the reset targets must be set. Offsets are clamped to the partitions range.
+// Groups with consumers are reset only when forced, moving the consumers of the
+// partitions to the new offsets.
+type ReqResetOffsets struct {
+	Topic      string   `json:"topic"`
+	Group      string   `json:"group"`
+	Partitions []uint32 `json:"partitions,omitempty"` // all the partitions if missing
+
+	ToEarliest  bool    `json:"toEarliest,omitempty"`
+	ToLatest    bool    `json:"toLatest,omitempty"`
+	ToOffset    *uint64 `json:"toOffset,omitempty"`
+	ToTimestamp *int64  `json:"toTimestamp,omitempty"` // first message at or after the timestamp
+	ShiftBy     *int64  `json:"shiftBy,omitempty"`     // from the current offsets, negative to go back
+
+	DryRun bool `json:"dryRun,omitempty"` // only returns the new offsets
+	Force  bool `json:"force,omitempty"`
+}
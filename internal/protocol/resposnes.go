@@ -3,9 +3,9 @@ package protocol
 import "godel/options"
 
 type RespHeartbeat struct {
-	ConsumerID   string `json:"consumerId"`
-	ErrorCode    int    `json:"errorCode"`
-	ErrorMessage string `json:"errorMessage,omitempty"`
+	ConsumerID   string    `json:"consumerId"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
 type RespCreateTopics struct {
@@ -13,29 +13,29 @@ type RespCreateTopics struct {
 }
 
 type RespCreateTopicTopic struct {
-	Name         string `json:"name"`
-	ErrorCode    int    `json:"errorCode"`
-	ErrorMessage string `json:"errorMessage,omitempty"`
+	Name         string    `json:"name"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
 type RespDeleteConsumer struct {
-	ID           string `json:"id"`
-	Topic        string `json:"topic"`
-	Group        string `json:"group"`
-	ErrorCode    int    `json:"errorCode"`
-	ErrorMessage string `json:"errorMessage,omitempty"`
+	ID           string    `json:"id"`
+	Topic        string    `json:"topic"`
+	Group        string    `json:"group"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
 type RespCommitOffset struct {
-	Partition    *uint32 `json:"partition,omitempty"`
-	Offset       *uint64 `json:"offset,omitempty"`
-	ErrorCode    int     `json:"errorCode"`
-	ErrorMessage string  `json:"errorMessage,omitempty"`
+	Partition    *uint32   `json:"partition,omitempty"`
+	Offset       *uint64   `json:"offset,omitempty"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
 type RespListConsumerGroups struct {
 	Groups       []ConsumerGroup `json:"groups"`
-	ErrorCode    int             `json:"errorCode"`
+	ErrorCode    ErrorCode       `json:"errorCode"`
 	ErrorMessage string          `json:"errorMessage,omitempty"`
 }
 
@@ -47,6 +47,7 @@ type ConsumerGroup struct {
 
 type Consumer struct {
 	ID         string   `json:"id"`
+	InstanceID string   `json:"instanceId,omitempty"` // group.instance.id of static members
 	Partitions []uint32 `json:"partitions,omitempty"`
 }
 
@@ -56,9 +57,9 @@ type ConsumerGroupOffset struct {
 }
 
 type RespListTopics struct {
-	Topics       []Topic `json:"topics,omitempty"`
-	ErrorCode    int     `json:"errorCode"`
-	ErrorMessage string  `json:"errorMessage,omitempty"`
+	Topics       []Topic   `json:"topics,omitempty"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
 type Topic struct {
@@ -73,56 +74,187 @@ type RespProduce struct {
 }
 
 type RespProduceMessage struct {
-	Key          string  `json:"key"`
-	Partition    *uint32 `json:"partition,omitempty"`
-	Offset       *uint64 `json:"offset,omitempty"`
-	ErrorCode    int     `json:"errorCode"`
-	ErrorMessage string  `json:"errorMessage,omitempty"`
+	Key          string    `json:"key"`
+	Partition    *uint32   `json:"partition,omitempty"`
+	Offset       *uint64   `json:"offset,omitempty"`
+	Duplicate    bool      `json:"duplicate,omitempty"` // already appended, the offset is not known
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
 type RespConsume struct {
 	Stop         bool                 `json:"stop"`
 	Messages     []RespConsumeMessage `json:"messages"`
-	ErrorCode    int                  `json:"errorCode"`
+	ErrorCode    ErrorCode            `json:"errorCode"`
 	ErrorMessage string               `json:"errorMessage,omitempty"`
 }
 
 type RespConsumeMessage struct {
-	Key          string  `json:"key"`
-	Group        string  `json:"conumerGroup"`
-	Partition    *uint32 `json:"partition,omitempty"`
-	Offset       *uint64 `json:"offset,omitempty"`
-	Payload      []byte  `json:"payload"`
-	ErrorCode    int     `json:"errorCode"`
-	ErrorMessage string  `json:"errorMessage,omitempty"`
+	Key          string    `json:"key"`
+	Group        string    `json:"conumerGroup"`
+	Partition    *uint32   `json:"partition,omitempty"`
+	Offset       *uint64   `json:"offset,omitempty"`
+	Payload      []byte    `json:"payload"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+
+	Headers map[string][]byte `json:"headers,omitempty"`
 }
 
 type RespCreateConsumer struct {
-	ID           string `json:"id"`
-	Topic        string `json:"topic"`
-	Group        string `json:"conumerGroup"`
-	ErrorCode    int    `json:"errorCode"`
-	ErrorMessage string `json:"errorMessage,omitempty"`
+	ID           string    `json:"id"`
+	Topic        string    `json:"topic"`
+	Group        string    `json:"conumerGroup"`
+	Generation   uint32    `json:"generation"`           // group generation after the join
+	Partitions   []uint32  `json:"partitions,omitempty"` // assigned in the generation
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
 type RespDeleteTopic struct {
-	Topic        string `json:"topic"`
-	ErrorCode    int    `json:"errorCode"`
-	ErrorMessage string `json:"errorMessage,omitempty"`
+	Topic        string    `json:"topic"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
+// RespNotifyRebalance is sent with CmdNotifyRebalabce on the consume stream of
+// a consumer (same correlation id, JSON encoded whatever the api version) when
+// its partitions change, and with the assigned partitions when it starts.
+//
+// Messages of revoked partitions are never sent after the notification: the
+// consumer must process and commit them, then acknowledge with CmdSyncGroup.
+// Messages of assigned partitions are sent only after the notification.
 type RespNotifyRebalance struct {
-	Group string `json:"group"`
+	Group      string   `json:"group"`
+	Generation uint32   `json:"generation"`
+	Revoked    []uint32 `json:"revoked,omitempty"`
+	Assigned   []uint32 `json:"assigned,omitempty"`
 }
 
 type RespGetTopic struct {
-	Topic        Topic  `json:"topic"`
-	ErrorCode    int    `json:"errorCode"`
-	ErrorMessage string `json:"errorMessage,omitempty"`
+	Topic        Topic     `json:"topic"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
 }
 
 type RespGetConsumerGroup struct {
-	Group        ConsumerGroup `json:"consumerGroup"`
-	ErrorCode    int           `json:"errorCode"`
-	ErrorMessage string        `json:"errorMessage,omitempty"`
+	Group        ConsumerGroup            `json:"consumerGroup"`
+	Partitions   []ConsumerGroupPartition `json:"partitions,omitempty"`
+	TotalLag     uint64                   `json:"totalLag"`
+	ErrorCode    ErrorCode                `json:"errorCode"`
+	ErrorMessage string                   `json:"errorMessage,omitempty"`
+}
+
+// ConsumerGroupPartition is the progress of a consumer group on a partition.
+// The lag is the number of messages from the offset the group reads next
+// (after the committed one, or the log start if none) to the log end.
+type ConsumerGroupPartition struct {
+	Partition       uint32  `json:"partition"`
+	LogStartOffset  uint64  `json:"logStartOffset"`
+	LogEndOffset    uint64  `json:"logEndOffset"` // offset of the next message appended
+	CommittedOffset *uint64 `json:"committedOffset,omitempty"`
+	Lag             uint64  `json:"lag"`
+	ConsumerID      string  `json:"consumerId,omitempty"` // consumer owning the partition
+}
+
+type RespListOffsets struct {
+	Topic        string                     `json:"topic"`
+	Partitions   []RespListOffsetsPartition `json:"partitions,omitempty"`
+	ErrorCode    ErrorCode                  `json:"errorCode"`
+	ErrorMessage string                     `json:"errorMessage,omitempty"`
+}
+
+type RespListOffsetsPartition struct {
+	Partition    uint32    `json:"partition"`
+	Offset       *uint64   `json:"offset,omitempty"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+}
+
+type RespInitProducerId struct {
+	ProducerID    uint64    `json:"producerId"`
+	ProducerEpoch uint16    `json:"producerEpoch"`
+	ErrorCode     ErrorCode `json:"errorCode"`
+	ErrorMessage  string    `json:"errorMessage,omitempty"`
+}
+
+type RespTransaction struct {
+	TransactionalID string    `json:"transactionalId"`
+	ErrorCode       ErrorCode `json:"errorCode"`
+	ErrorMessage    string    `json:"errorMessage,omitempty"`
+}
+
+type RespFetch struct {
+	Topic     string               `json:"topic"`
+	Partition uint32               `json:"partition"`
+	Messages  []RespConsumeMessage `json:"messages"`
+
+	// offset to be fetched next, it may be past the last returned message
+	// when transaction markers or aborted messages are skipped
+	NextOffset       uint64 `json:"nextOffset"`
+	HighWatermark    uint64 `json:"highWatermark"`
+	LastStableOffset uint64 `json:"lastStableOffset"`
+
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+}
+
+// RespApiVersions is always JSON encoded, whatever the request api version,
+// since the client doesn't know the supported versions yet.
+type RespApiVersions struct {
+	ApiVersions  []ApiVersion `json:"apiVersions"`
+	ErrorCode    ErrorCode    `json:"errorCode"`
+	ErrorMessage string       `json:"errorMessage,omitempty"`
+}
+
+type ApiVersion struct {
+	Cmd        int16 `json:"cmd"`
+	MinVersion int16 `json:"minVersion"`
+	MaxVersion int16 `json:"maxVersion"`
+}
+
+// RespError is sent in place of the command response when the request
+// can't be processed at all (e.g. unsupported api version). It's always
+// JSON encoded, so it's decoded by the JSON response of every command.
+type RespError struct {
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+}
+
+type RespSyncGroup struct {
+	Generation   uint32    `json:"generation"`
+	Partitions   []uint32  `json:"partitions,omitempty"` // partitions owned after the revocation
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+}
+
+type RespCreateConsumerGroup struct {
+	Topic        string    `json:"topic"`
+	Group        string    `json:"group"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+}
+
+type RespDeleteConsumerGroup struct {
+	Topic        string    `json:"topic"`
+	Group        string    `json:"group"`
+	ErrorCode    ErrorCode `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage,omitempty"`
+}
+
+type RespResetOffsets struct {
+	Topic        string                      `json:"topic"`
+	Group        string                      `json:"group"`
+	DryRun       bool                        `json:"dryRun,omitempty"`
+	Partitions   []RespResetOffsetsPartition `json:"partitions,omitempty"`
+	ErrorCode    ErrorCode                   `json:"errorCode"`
+	ErrorMessage string                      `json:"errorMessage,omitempty"`
+}
+
+// RespResetOffsetsPartition has the offsets the group reads the partition
+// from, before and after the reset.
+type RespResetOffsetsPartition struct {
+	Partition      uint32 `json:"partition"`
+	PreviousOffset uint64 `json:"previousOffset"`
+	Offset         uint64 `json:"offset"`
 }
@@ -10,13 +10,32 @@ const (
 	// topic defaults
 	DefaultRetentionMs                 int64  = 604800000
 	DefaultMaxMessageBytes             int64  = 1000001
+	DefaultIndexIntervalBytes          int64  = 4096
+	DefaultDeleteRetentionMs           int64  = 86400000
+	DefaultMaxTimestampDifferenceMs    int64  = -1
 	DefaultRetentionBytes              int64  = -1
 	DefaultLogRetentionCheckIntervalMs int64  = 300000
+	DefaultLogFlushIntervalMessages    int64  = -1
+	DefaultLogFlushIntervalMs          int64  = -1
+	DefaultLogFlushSchedulerIntervalMs int64  = 1000
+	DefaultSocketRequestMaxBytes       int64  = 104857600
 	DefaultNumPartitions               uint32 = 1
 	DefaultBasePath                    string = "./godel_data"
 
+	// flush.messages value syncing every batch before acknowledging it
+	FlushMessagesAlways int64 = 1
+
 	// consumer defaults
 	DefaultSessionTimeoutMs     int64 = 10000
 	DefaultHeartbeatIntervalMs  int64 = 3000
 	DefaultAutoCommitIntervalMs int64 = 5000
+	DefaultRebalanceTimeoutMs   int64 = 30000
+
+	// fetch defaults
+	DefaultFetchMaxBytes int64 = 1048576
+	MaxFetchWaitMs       int64 = 30000 // longer waits are clamped
+
+	// connection defaults
+	DefaultMaxInFlightRequestsPerConnection int64 = 100
+	DefaultRequestTimeoutMs                 int64 = 30000 // client side wait for a response
 )
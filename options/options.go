@@ -2,6 +2,8 @@ package options
 
 import (
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	yaml "github.com/goccy/go-yaml"
@@ -10,6 +12,56 @@ import (
 type CleanupPolicy string
 
 var CleanupPolicyDelete CleanupPolicy = "delete"
+var CleanupPolicyCompact CleanupPolicy = "compact"
+var CleanupPolicyCompactDelete CleanupPolicy = "compact,delete"
+
+// policies splits a comma separated cleanup policy (e.g. compact,delete)
+func (p CleanupPolicy) policies() []CleanupPolicy {
+	policies := []CleanupPolicy{}
+	for _, policy := range strings.Split(string(p), ",") {
+		policies = append(policies, CleanupPolicy(strings.TrimSpace(policy)))
+	}
+
+	return policies
+}
+
+// Deletes reports whether old segments must be deleted
+// according to retention.ms and retention.bytes.
+func (p CleanupPolicy) Deletes() bool {
+	return slices.Contains(p.policies(), CleanupPolicyDelete)
+}
+
+// Compacts reports whether segments must be compacted
+// keeping only the latest message for each key.
+func (p CleanupPolicy) Compacts() bool {
+	return slices.Contains(p.policies(), CleanupPolicyCompact)
+}
+
+// TimestampType tells which timestamp is stored in the messages.
+type TimestampType string
+
+// the timestamp set by the producer (or by the broker if missing)
+var TimestampTypeCreateTime TimestampType = "CreateTime"
+
+// the time the message is appended by the broker
+var TimestampTypeLogAppendTime TimestampType = "LogAppendTime"
+
+// Valid reports whether the timestamp type is CreateTime or LogAppendTime.
+func (t TimestampType) Valid() bool {
+	return t == TimestampTypeCreateTime || t == TimestampTypeLogAppendTime
+}
+
+// PartitionerType is the strategy used to choose the partition of produced messages.
+type PartitionerType string
+
+// murmur2 hash of the key (messages without a key land on a single partition)
+var PartitionerMurmur2 PartitionerType = "murmur2"
+
+// murmur2 hash of the key, messages without a key are rotated across partitions
+var PartitionerRoundRobin PartitionerType = "round-robin"
+
+// murmur2 hash of the key, messages without a key stick to one partition per batch
+var PartitionerSticky PartitionerType = "sticky"
 
 type TopicOptions struct {
 	NumPartitions   uint32        `json:"num.partitions"`
@@ -18,9 +70,26 @@ type TopicOptions struct {
 	RetentionBytes  int64         `json:"retention.bytes"`
 	SegmentBytes    int64         `json:"segment.bytes"`
 	MaxMessageBytes int64         `json:"max.message.bytes"`
+
+	IndexIntervalBytes int64 `json:"index.interval.bytes"`
+
+	// a pointer since 0 is valid (tombstones are removed on the next compaction),
+	// when nil DefaultDeleteRetentionMs is used
+	DeleteRetentionMilli *int64 `json:"delete.retention.ms,omitempty"`
+
+	// when 0 the broker log.flush.interval.* options are used
+	FlushMessages int64 `json:"flush.messages"`
+	FlushMilli    int64 `json:"flush.ms"`
+
+	MessageTimestampType        TimestampType `json:"message.timestamp.type"`
+	MaxTimestampDifferenceMilli int64         `json:"max.timestamp.difference.ms"`
+
+	Partitioner PartitionerType `json:"partitioner"`
 }
 
 func DefaultTopicOptions() *TopicOptions {
+	deleteRetentionMilli := DefaultDeleteRetentionMs
+
 	return &TopicOptions{
 		NumPartitions:   DefaultNumPartitions,   // single partition
 		CleanupPolicy:   CleanupPolicyDelete,    // delete
@@ -28,6 +97,14 @@ func DefaultTopicOptions() *TopicOptions {
 		RetentionBytes:  DefaultRetentionBytes,  // no limit
 		SegmentBytes:    GigaByte,               // 1 GiB
 		MaxMessageBytes: DefaultMaxMessageBytes, // 7 days
+
+		IndexIntervalBytes:   DefaultIndexIntervalBytes, // 4 KiB
+		DeleteRetentionMilli: &deleteRetentionMilli,     // 1 day
+
+		MessageTimestampType:        TimestampTypeCreateTime,
+		MaxTimestampDifferenceMilli: DefaultMaxTimestampDifferenceMs, // no limit
+
+		Partitioner: PartitionerSticky,
 	}
 }
 
@@ -61,6 +138,48 @@ func (t *TopicOptions) WithMaxMessageBytes(b int64) *TopicOptions {
 	return t
 }
 
+func (t *TopicOptions) WithIndexIntervalBytes(b int64) *TopicOptions {
+	t.IndexIntervalBytes = b
+	return t
+}
+
+func (t *TopicOptions) WithDeleteRetentionTime(d time.Duration) *TopicOptions {
+	ms := d.Milliseconds()
+	t.DeleteRetentionMilli = &ms
+	return t
+}
+
+func (t *TopicOptions) WithFlushMessages(n int64) *TopicOptions {
+	t.FlushMessages = n
+	return t
+}
+
+func (t *TopicOptions) WithFlushInterval(d time.Duration) *TopicOptions {
+	t.FlushMilli = d.Milliseconds()
+	return t
+}
+
+// WithFsyncAlways makes every produced batch synced to disk before being acknowledged.
+func (t *TopicOptions) WithFsyncAlways() *TopicOptions {
+	t.FlushMessages = FlushMessagesAlways
+	return t
+}
+
+func (t *TopicOptions) WithMessageTimestampType(tt TimestampType) *TopicOptions {
+	t.MessageTimestampType = tt
+	return t
+}
+
+func (t *TopicOptions) WithMaxTimestampDifference(d time.Duration) *TopicOptions {
+	t.MaxTimestampDifferenceMilli = d.Milliseconds()
+	return t
+}
+
+func (t *TopicOptions) WithPartitioner(p PartitionerType) *TopicOptions {
+	t.Partitioner = p
+	return t
+}
+
 func MergeTopicOptions(o1, o2 *TopicOptions) {
 	if o1.NumPartitions == 0 {
 		o1.NumPartitions = o2.NumPartitions
@@ -85,17 +204,64 @@ func MergeTopicOptions(o1, o2 *TopicOptions) {
 	if o1.MaxMessageBytes == 0 {
 		o1.MaxMessageBytes = o2.MaxMessageBytes
 	}
+
+	if o1.IndexIntervalBytes == 0 {
+		o1.IndexIntervalBytes = o2.IndexIntervalBytes
+	}
+
+	if o1.DeleteRetentionMilli == nil {
+		o1.DeleteRetentionMilli = o2.DeleteRetentionMilli
+	}
+
+	if o1.FlushMessages == 0 {
+		o1.FlushMessages = o2.FlushMessages
+	}
+
+	if o1.FlushMilli == 0 {
+		o1.FlushMilli = o2.FlushMilli
+	}
+
+	if o1.MessageTimestampType == "" {
+		o1.MessageTimestampType = o2.MessageTimestampType
+	}
+
+	if o1.MaxTimestampDifferenceMilli == 0 {
+		o1.MaxTimestampDifferenceMilli = o2.MaxTimestampDifferenceMilli
+	}
+
+	if o1.Partitioner == "" {
+		o1.Partitioner = o2.Partitioner
+	}
 }
 
 type BrokerOptions struct {
 	BasePath                       string `json:"base.path"`
 	LogRetentionCheckIntervalMilli int64  `json:"log.retention.check.interval.ms"`
+
+	// default flush.messages and flush.ms for topics that don't set them
+	LogFlushIntervalMessages       int64 `json:"log.flush.interval.messages"`
+	LogFlushIntervalMilli          int64 `json:"log.flush.interval.ms"`
+	LogFlushSchedulerIntervalMilli int64 `json:"log.flush.scheduler.interval.ms"`
+
+	// max size of a request frame, larger frames close the connection
+	SocketRequestMaxBytes int64 `json:"socket.request.max.bytes"`
+
+	// max requests processed at the same time for a connection, before
+	// reading more of them (long running consume requests don't take a slot)
+	MaxInFlightRequestsPerConnection int64 `json:"max.in.flight.requests.per.connection"`
 }
 
 func DeafaultBrokerOptions() *BrokerOptions {
 	return &BrokerOptions{
 		BasePath:                       DefaultBasePath,
 		LogRetentionCheckIntervalMilli: DefaultLogRetentionCheckIntervalMs, // 5 mins
+
+		LogFlushIntervalMessages:       DefaultLogFlushIntervalMessages,    // never, left to the OS
+		LogFlushIntervalMilli:          DefaultLogFlushIntervalMs,          // never, left to the OS
+		LogFlushSchedulerIntervalMilli: DefaultLogFlushSchedulerIntervalMs, // 1 sec
+
+		SocketRequestMaxBytes:            DefaultSocketRequestMaxBytes, // 100 MiB
+		MaxInFlightRequestsPerConnection: DefaultMaxInFlightRequestsPerConnection,
 	}
 }
 
@@ -109,6 +275,38 @@ func (b *BrokerOptions) WithLogRetentionCheckInterval(d time.Duration) *BrokerOp
 	return b
 }
 
+func (b *BrokerOptions) WithLogFlushIntervalMessages(n int64) *BrokerOptions {
+	b.LogFlushIntervalMessages = n
+	return b
+}
+
+func (b *BrokerOptions) WithLogFlushInterval(d time.Duration) *BrokerOptions {
+	b.LogFlushIntervalMilli = d.Milliseconds()
+	return b
+}
+
+func (b *BrokerOptions) WithLogFlushSchedulerInterval(d time.Duration) *BrokerOptions {
+	b.LogFlushSchedulerIntervalMilli = d.Milliseconds()
+	return b
+}
+
+func (b *BrokerOptions) WithSocketRequestMaxBytes(n int64) *BrokerOptions {
+	b.SocketRequestMaxBytes = n
+	return b
+}
+
+func (b *BrokerOptions) WithMaxInFlightRequestsPerConnection(n int64) *BrokerOptions {
+	b.MaxInFlightRequestsPerConnection = n
+	return b
+}
+
+// WithFsyncAlways makes every produced batch synced to disk before being
+// acknowledged, for all the topics not setting their own flush.messages.
+func (b *BrokerOptions) WithFsyncAlways() *BrokerOptions {
+	b.LogFlushIntervalMessages = FlushMessagesAlways
+	return b
+}
+
 func LoadBrokerOptionsFromYaml(path string) (*BrokerOptions, error) {
 	blob, err := os.ReadFile(path)
 	if err != nil {
@@ -134,14 +332,82 @@ func MergeBrokerOptions(o1, o2 *BrokerOptions) {
 	if o1.LogRetentionCheckIntervalMilli == 0 {
 		o1.LogRetentionCheckIntervalMilli = o2.LogRetentionCheckIntervalMilli
 	}
+
+	if o1.LogFlushIntervalMessages == 0 {
+		o1.LogFlushIntervalMessages = o2.LogFlushIntervalMessages
+	}
+
+	if o1.LogFlushIntervalMilli == 0 {
+		o1.LogFlushIntervalMilli = o2.LogFlushIntervalMilli
+	}
+
+	if o1.LogFlushSchedulerIntervalMilli == 0 {
+		o1.LogFlushSchedulerIntervalMilli = o2.LogFlushSchedulerIntervalMilli
+	}
+
+	if o1.SocketRequestMaxBytes == 0 {
+		o1.SocketRequestMaxBytes = o2.SocketRequestMaxBytes
+	}
+
+	if o1.MaxInFlightRequestsPerConnection == 0 {
+		o1.MaxInFlightRequestsPerConnection = o2.MaxInFlightRequestsPerConnection
+	}
 }
 
+// IsolationLevel tells which transactional messages are read by consumers.
+type IsolationLevel string
+
+// all the messages are read, including the ones of open and aborted transactions
+var IsolationLevelReadUncommitted IsolationLevel = "read_uncommitted"
+
+// only the messages of committed transactions (and non transactional ones) are read
+var IsolationLevelReadCommitted IsolationLevel = "read_committed"
+
+// RebalanceProtocol tells how the partitions of a consumer group are moved
+// when consumers join or leave the group.
+type RebalanceProtocol string
+
+// all the partitions are revoked and then assigned again,
+// consumers stop reading until the rebalance is done
+var RebalanceProtocolEager RebalanceProtocol = "eager"
+
+// only the partitions moving to another consumer are revoked
+// and assigned, the others are read without interruptions
+var RebalanceProtocolCooperative RebalanceProtocol = "cooperative"
+
+// AssignmentStrategy tells how the partitions of a topic are assigned
+// to the consumers of a group.
+type AssignmentStrategy string
+
+// consecutive ranges of partitions, the first consumers get one more
+// partition when they can't be divided evenly
+var AssignmentStrategyRange AssignmentStrategy = "range"
+
+// partitions are dealt to the consumers one at a time
+var AssignmentStrategyRoundRobin AssignmentStrategy = "roundrobin"
+
+// balanced like roundrobin, but consumers keep as many of their
+// partitions as possible, so rebalances move the fewest partitions
+var AssignmentStrategySticky AssignmentStrategy = "sticky"
+
 type ConsumerOptions struct {
-	SessionTimeoutMilli     int64 `json:"session.timeout.ms"`
-	HeartbeatIntervalMilli  int64 `json:"heartbeat.interval.ms"`
-	EnableAutoCommit        bool  `json:"enable.auto.commit"`
-	AutoCommitIntervalMilli int64 `json:"auto.commit.interval.ms"`
-	FromBeginning           bool  `json:"from.beginning"`
+	SessionTimeoutMilli     int64          `json:"session.timeout.ms"`
+	HeartbeatIntervalMilli  int64          `json:"heartbeat.interval.ms"`
+	EnableAutoCommit        bool           `json:"enable.auto.commit"`
+	AutoCommitIntervalMilli int64          `json:"auto.commit.interval.ms"`
+	FromBeginning           bool           `json:"from.beginning"`
+	IsolationLevel          IsolationLevel `json:"isolation.level"`
+
+	// how partitions are moved by rebalances, the group is cooperative
+	// only when all its consumers are
+	RebalanceProtocol RebalanceProtocol `json:"rebalance.protocol"`
+	// max time the group waits for the consumer to acknowledge revoked partitions
+	RebalanceTimeoutMilli int64 `json:"rebalance.timeout.ms"`
+	// how partitions are assigned, all the consumers of a group must use the same
+	PartitionAssignmentStrategy AssignmentStrategy `json:"partition.assignment.strategy"`
+	// static membership: a consumer rejoining with the same instance id within
+	// the session timeout gets the partitions back, without rebalancing
+	GroupInstanceID string `json:"group.instance.id,omitempty"`
 }
 
 func DefaulcConsumerOption() *ConsumerOptions {
@@ -151,6 +417,11 @@ func DefaulcConsumerOption() *ConsumerOptions {
 		AutoCommitIntervalMilli: DefaultAutoCommitIntervalMs,
 		EnableAutoCommit:        true,
 		FromBeginning:           false,
+		IsolationLevel:          IsolationLevelReadUncommitted,
+		RebalanceProtocol:       RebalanceProtocolEager,
+		RebalanceTimeoutMilli:   DefaultRebalanceTimeoutMs, // 30 secs
+
+		PartitionAssignmentStrategy: AssignmentStrategyRange,
 	}
 }
 
@@ -174,6 +445,31 @@ func (o *ConsumerOptions) DisableAutoCommit() *ConsumerOptions {
 	return o
 }
 
+func (o *ConsumerOptions) WithIsolationLevel(l IsolationLevel) *ConsumerOptions {
+	o.IsolationLevel = l
+	return o
+}
+
+func (o *ConsumerOptions) WithRebalanceProtocol(p RebalanceProtocol) *ConsumerOptions {
+	o.RebalanceProtocol = p
+	return o
+}
+
+func (o *ConsumerOptions) WithRebalanceTimeout(d time.Duration) *ConsumerOptions {
+	o.RebalanceTimeoutMilli = d.Milliseconds()
+	return o
+}
+
+func (o *ConsumerOptions) WithPartitionAssignmentStrategy(s AssignmentStrategy) *ConsumerOptions {
+	o.PartitionAssignmentStrategy = s
+	return o
+}
+
+func (o *ConsumerOptions) WithGroupInstanceID(id string) *ConsumerOptions {
+	o.GroupInstanceID = id
+	return o
+}
+
 func MergeConsumerOptions(o1, o2 *ConsumerOptions) {
 	if o1.HeartbeatIntervalMilli == 0 {
 		o1.HeartbeatIntervalMilli = o2.HeartbeatIntervalMilli
@@ -186,4 +482,20 @@ func MergeConsumerOptions(o1, o2 *ConsumerOptions) {
 	if o1.AutoCommitIntervalMilli == 0 {
 		o1.AutoCommitIntervalMilli = o2.AutoCommitIntervalMilli
 	}
+
+	if o1.IsolationLevel == "" {
+		o1.IsolationLevel = o2.IsolationLevel
+	}
+
+	if o1.RebalanceProtocol == "" {
+		o1.RebalanceProtocol = o2.RebalanceProtocol
+	}
+
+	if o1.RebalanceTimeoutMilli == 0 {
+		o1.RebalanceTimeoutMilli = o2.RebalanceTimeoutMilli
+	}
+
+	if o1.PartitionAssignmentStrategy == "" {
+		o1.PartitionAssignmentStrategy = o2.PartitionAssignmentStrategy
+	}
 }